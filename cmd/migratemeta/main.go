@@ -0,0 +1,41 @@
+/*
+migratemeta rewrites legacy JSON metadata of a stopped front node.
+
+	migratemeta -root ./front0_server0_test_server [-dry-run]
+
+A running node is migrated by POST /api/v1/cluster/metadata/migrate.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/ciiim/cloudborad/internal/fs"
+)
+
+func main() {
+	root := flag.String("root", "", "root path of the front file system")
+	dryRun := flag.Bool("dry-run", false, "only count legacy metadata")
+	flag.Parse()
+	if *root == "" {
+		flag.Usage()
+		return
+	}
+
+	// the peer is never served, it only names the node
+	front := fs.NewDTFS(*fs.NewDPeer("migratemeta", "127.0.0.1:0", 20, nil), *root)
+	if front == nil {
+		log.Fatal("Open front file system failed")
+	}
+	result, err := front.MigrateMetaData(context.Background(), *dryRun)
+	// spaces save what they occupy when closed
+	if e := front.Close(); e != nil {
+		log.Println("Close front file system error: ", e)
+	}
+	if err != nil {
+		log.Fatal("Migrate metadata failed: ", err)
+	}
+	log.Printf("%d scanned, %d legacy, %d migrated, %d failed", result.Scanned, result.Legacy, result.Migrated, result.Failed)
+}
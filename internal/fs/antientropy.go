@@ -0,0 +1,204 @@
+package fs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	ANTI_ENTROPY_INTERVAL = time.Minute * 10
+)
+
+/*
+AntiEntropyPolicy decides how often a peer compares
+its blocks with every other replica holder.
+
+Interval <= 0 disables anti-entropy.
+
+Use DFS.Set(AntiEntropyPolicy{...}) before Serve to change it.
+*/
+type AntiEntropyPolicy struct {
+	Interval time.Duration
+}
+
+var DefaultAntiEntropyPolicy = AntiEntropyPolicy{
+	Interval: ANTI_ENTROPY_INTERVAL,
+}
+
+// implemented by DPeer
+type antiEntropyPeer interface {
+	MerkleTree(ctx context.Context, pi peers.PeerInfo) (*merkleTree, error)
+	ListKeys(ctx context.Context, pi peers.PeerInfo, buckets []int) ([]keyEntry, error)
+}
+
+// implemented by DFS, used by rpc server
+type merkleSource interface {
+	merkleTreeFor(pi peers.PeerInfo) *merkleTree
+	sharedKeys(pi peers.PeerInfo, buckets []int) []keyEntry
+}
+
+var _ merkleSource = (*DFS)(nil)
+
+/*
+Keys stored here that pi should also hold.
+
+buckets - only keys in these merkle buckets, nil means all
+
+A shard has one copy, on the peer its layout names, it is not shared.
+*/
+func (d *DFS) sharedKeys(pi peers.PeerInfo, buckets []int) []keyEntry {
+	var inBucket map[int]bool
+	if buckets != nil {
+		inBucket = make(map[int]bool, len(buckets))
+		for _, b := range buckets {
+			inBucket[b] = true
+		}
+	}
+	var entries []keyEntry
+	d.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+		if isShardKey(key) || inBucket != nil && !inBucket[bucketOf(key)] {
+			return true
+		}
+		replicas := d.PickReplicas(key)
+		if containsPeer(replicas, d.self.Info()) && containsPeer(replicas, pi) {
+			entries = append(entries, keyEntry{Key: key, Size: bfi.Size_, Hash: bfi.Hash_})
+		}
+		return true
+	})
+	return entries
+}
+
+func (d *DFS) merkleTreeFor(pi peers.PeerInfo) *merkleTree {
+	return newMerkleTree(d.sharedKeys(pi, nil))
+}
+
+func (d *DFS) runAntiEntropy() {
+	if d.antiEntropyPolicy.Interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-d.closing
+		cancel()
+	}()
+	ticker := time.NewTicker(d.antiEntropyPolicy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closing:
+			return
+		case <-ticker.C:
+			d.antiEntropy(ctx)
+		}
+	}
+}
+
+// one round with every online peer
+func (d *DFS) antiEntropy(ctx context.Context) {
+	d.metrics.Inc(METRIC_ANTI_ENTROPY_ROUND)
+	for _, pi := range d.self.PList() {
+		if pi.Equal(d.self.Info()) || !d.detector.IsOnline(pi) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := d.syncWith(ctx, pi); err != nil {
+			d.metrics.Inc(METRIC_ANTI_ENTROPY_FAILED)
+			log.Printf("[DFS] Anti-entropy with %s error: %s", pi.PName(), err)
+		}
+	}
+}
+
+/*
+Compare merkle trees with pi,
+and transfer only the keys in buckets that differ.
+
+missing here - pull from pi
+
+missing on pi - push to pi
+
+size or content differs - check all replicas like read repair
+*/
+func (d *DFS) syncWith(ctx context.Context, pi peers.PeerInfo) error {
+	ap, ok := d.self.(antiEntropyPeer)
+	if !ok {
+		return nil
+	}
+	remote, err := ap.MerkleTree(ctx, pi)
+	if err != nil {
+		return err
+	}
+	buckets := d.merkleTreeFor(pi).Diff(remote)
+	if len(buckets) == 0 {
+		return nil
+	}
+	dlog.debug("syncWith", "%s, %d buckets differ", pi.PName(), len(buckets))
+
+	remoteKeys, err := ap.ListKeys(ctx, pi, buckets)
+	if err != nil {
+		return err
+	}
+	remoteEntries := make(map[string]keyEntry, len(remoteKeys))
+	for _, e := range remoteKeys {
+		remoteEntries[e.Key] = e
+	}
+	localEntries := make(map[string]keyEntry)
+	for _, e := range d.sharedKeys(pi, buckets) {
+		localEntries[e.Key] = e
+	}
+
+	for key, e := range remoteEntries {
+		local, ok := localEntries[key]
+		if !ok {
+			d.pullFrom(ctx, pi, key)
+			continue
+		}
+		if local != e {
+			d.metrics.Inc(METRIC_ANTI_ENTROPY_DIVERGENT)
+			if file, err := d.getLocally(ctx, key); err == nil {
+				d.readRepair(ctx, key, file, nil, withoutPeer(d.PickReplicas(key), d.self.Info()))
+			}
+		}
+	}
+	for key := range localEntries {
+		if _, ok := remoteEntries[key]; !ok {
+			d.pushTo(ctx, pi, key)
+		}
+	}
+	return nil
+}
+
+func (d *DFS) pullFrom(ctx context.Context, pi peers.PeerInfo, key string) {
+	file, err := d.getFrom(ctx, pi, key)
+	if err != nil {
+		d.metrics.Inc(METRIC_ANTI_ENTROPY_FAILED)
+		log.Printf("[DFS] Anti-entropy: pull %s from %s error: %s", key, pi.PName(), err)
+		return
+	}
+	if err := d.storeLocally(ctx, key, file.Stat().Name(), file.Data()); err != nil {
+		d.metrics.Inc(METRIC_ANTI_ENTROPY_FAILED)
+		log.Printf("[DFS] Anti-entropy: store %s error: %s", key, err)
+		return
+	}
+	d.metrics.Inc(METRIC_ANTI_ENTROPY_PULLED)
+}
+
+func (d *DFS) pushTo(ctx context.Context, pi peers.PeerInfo, key string) {
+	file, err := d.getLocally(ctx, key)
+	if err != nil {
+		d.metrics.Inc(METRIC_ANTI_ENTROPY_FAILED)
+		log.Printf("[DFS] Anti-entropy: get %s error: %s", key, err)
+		return
+	}
+	if err := d.storeTo(ctx, pi, key, file.Stat().Name(), file.Data()); err != nil {
+		d.metrics.Inc(METRIC_ANTI_ENTROPY_FAILED)
+		log.Printf("[DFS] Anti-entropy: push %s to %s error: %s", key, pi.PName(), err)
+		return
+	}
+	d.metrics.Inc(METRIC_ANTI_ENTROPY_PUSHED)
+}
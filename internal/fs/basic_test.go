@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"context"
 	"crypto/md5"
 	"fmt"
 	"strings"
@@ -28,7 +29,7 @@ func TestStore(t *testing.T) {
 		t.Error("newBasicFileSystem error")
 	}
 	md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(testFileName), byte(testDataLen))))
-	if err := f.Store(md5, testFileName, []byte(testData)); err != nil {
+	if err := f.Store(context.Background(), md5, testFileName, []byte(testData)); err != nil {
 		t.Error(err)
 		return
 	}
@@ -42,7 +43,7 @@ func TestGet(t *testing.T) {
 	}
 	defer f.Close()
 	md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(testFileName), byte(testDataLen))))
-	file, err := f.Get(md5[:])
+	file, err := f.Get(context.Background(), md5[:])
 	if err != nil {
 		t.Error(err)
 		return
@@ -86,7 +87,7 @@ func TestBigFile(t *testing.T) {
 	go func() {
 		md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(data0), byte(dataLen0))))
 		//md5Time := time.Since(start)
-		if err := f.Store(md5, filename0, []byte(data0)); err != nil {
+		if err := f.Store(context.Background(), md5, filename0, []byte(data0)); err != nil {
 			t.Error(err)
 			wg.Done()
 
@@ -97,7 +98,7 @@ func TestBigFile(t *testing.T) {
 	go func() {
 		md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(data1), byte(dataLen1))))
 		//md5Time := time.Since(start)
-		if err := f.Store(md5, filename1, []byte(data1)); err != nil {
+		if err := f.Store(context.Background(), md5, filename1, []byte(data1)); err != nil {
 			t.Error(err)
 			wg.Done()
 
@@ -109,7 +110,7 @@ func TestBigFile(t *testing.T) {
 	go func() {
 		md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(data2), byte(dataLen2))))
 		//md5Time := time.Since(start)
-		if err := f.Store(md5, filename2, []byte(data2)); err != nil {
+		if err := f.Store(context.Background(), md5, filename2, []byte(data2)); err != nil {
 			t.Error(err)
 			wg.Done()
 
@@ -135,7 +136,7 @@ func TestBigFileStore(t *testing.T) {
 	md5 := fmt.Sprintf("%x", md5.Sum(append([]byte(data0), byte(dataLen0))))
 	//md5Time := time.Since(start)
 	start := time.Now()
-	if err := f.Store(md5, filename0, []byte(data0)); err != nil {
+	if err := f.Store(context.Background(), md5, filename0, []byte(data0)); err != nil {
 		t.Error(err)
 		return
 	}
@@ -162,7 +163,7 @@ func TestBigFileGet(t *testing.T) {
 	for i := num; i > 0; i-- {
 		go func() {
 			for j := 0; j < 512/num; j++ {
-				if _, err := f.Get(md5); err != nil {
+				if _, err := f.Get(context.Background(), md5); err != nil {
 					t.Error(err)
 					return
 				}
@@ -176,3 +177,29 @@ func TestBigFileGet(t *testing.T) {
 	t.Logf("use time:%v", delta)
 
 }
+
+func TestStoreCapacity(t *testing.T) {
+	f := newBasicFileSystem(t.TempDir(), 100, nil)
+	defer f.Close()
+
+	// parallel stores never take more than the capacity
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value := []byte(fmt.Sprintf("block %04d", i))
+			if err := f.Store(context.Background(), blockChecksum(value), "block", value); err == nil {
+				mu.Lock()
+				stored++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stored != 10 || f.Occupy() != 100 {
+		t.Errorf("stored %d blocks, occupy %v", stored, f.Occupy())
+	}
+}
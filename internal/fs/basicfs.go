@@ -2,10 +2,13 @@
 package fs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/ciiim/cloudborad/internal/database"
@@ -18,6 +21,8 @@ type basicFileSystem struct {
 	rootPath string //相对路径 relative path
 	capacity Byte
 	occupy   Byte
+	// guards occupy, so the capacity check and the update are one step
+	occupyMu sync.Mutex
 
 	fileInfoDBName string
 
@@ -26,6 +31,9 @@ type basicFileSystem struct {
 	calcStoreFilePathFn CalcStoreFilePathFnType
 
 	HashFn Hash
+
+	// orders touch and deleteIfOlder, so a touched file is kept
+	touchMu sync.Mutex
 }
 
 type CalcStoreFilePathFnType = func(fileinfo BasicFileInfo) string
@@ -104,7 +112,10 @@ func newBasicFileSystem(rootPath string, capacity int64, calcStorePathFn CalcSto
 	return bfs
 }
 
-func (bfs *basicFileSystem) Store(key, fileName string, value []byte) error {
+func (bfs *basicFileSystem) Store(ctx context.Context, key, fileName string, value []byte) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if key == "" {
 		return fmt.Errorf("key is empty")
 	}
@@ -112,16 +123,22 @@ func (bfs *basicFileSystem) Store(key, fileName string, value []byte) error {
 		return fmt.Errorf("value is nil")
 	}
 
-	//check exist
-	if bfs.isExist(key) {
-		return nil //ErrExist //XXX: 需要一个更好的处理方案
+	//check exist, a stored file is in use again, see deleteIfOlder
+	if exists, err := bfs.touch(key); err != nil || exists {
+		return err //ErrExist //XXX: 需要一个更好的处理方案
 	}
-	//check capacity
-	if bfs.occupy+int64(len(value)) > bfs.capacity {
+	//check capacity, the space is taken until the file fails to store
+	size := int64(len(value))
+	if !bfs.take(size) {
 		return ErrFull
 	}
+	defer func() {
+		if err != nil {
+			bfs.free(size)
+		}
+	}()
 
-	bfi := NewFileInfo(fileName, key, "", int64(len(value)), false)
+	bfi := NewFileInfo(fileName, blockChecksum(value), "", int64(len(value)), false, time.Now())
 
 	// bfi.Path = rootPath/<path>
 	bfi.Path_ = bfs.rootPath + "/" + bfs.calcStoreFilePathFn(bfi)
@@ -136,17 +153,13 @@ func (bfs *basicFileSystem) Store(key, fileName string, value []byte) error {
 	if err := bfs.storeFileInfo(key, bfi); err != nil {
 		return err
 	}
-	if err := bfs.storeFile(bfi, value); err != nil {
-		return err
-	}
-
-	//update occupy
-	bfs.occupy += bfi.Size_
-
-	return nil
+	return bfs.storeFile(bfi, value)
 }
 
-func (bfs *basicFileSystem) Get(key string) (File, error) {
+func (bfs *basicFileSystem) Get(ctx context.Context, key string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if key == "" {
 		return nil, fmt.Errorf("key is empty")
 	}
@@ -161,7 +174,10 @@ func (bfs *basicFileSystem) Get(key string) (File, error) {
 	}, err
 }
 
-func (bfs *basicFileSystem) Delete(key string) error {
+func (bfs *basicFileSystem) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if key == "" {
 		return fmt.Errorf("key is empty")
 	}
@@ -175,18 +191,70 @@ func (bfs *basicFileSystem) Delete(key string) error {
 	if err := bfs.deleteFile(bfi); err != nil {
 		return err
 	}
-	if bfs.occupy == 0 {
-		panic("[Delete Panic] occupy is 0")
-	}
 	//update occupy
-	bfs.occupy -= bfi.Size_
+	bfs.free(bfi.Size_)
 	return nil
 }
 
+// add size to occupy, false if it does not fit in capacity
+func (bfs *basicFileSystem) take(size Byte) bool {
+	bfs.occupyMu.Lock()
+	defer bfs.occupyMu.Unlock()
+	if bfs.occupy+size > bfs.capacity {
+		return false
+	}
+	bfs.occupy += size
+	return true
+}
+
+func (bfs *basicFileSystem) free(size Byte) {
+	bfs.occupyMu.Lock()
+	defer bfs.occupyMu.Unlock()
+	if bfs.occupy < size {
+		panic("[Delete Panic] occupy is less than the size freed")
+	}
+	bfs.occupy -= size
+}
+
+func (bfs *basicFileSystem) occupied() Byte {
+	bfs.occupyMu.Lock()
+	defer bfs.occupyMu.Unlock()
+	return bfs.occupy
+}
+
 func (bfs *basicFileSystem) Set(opt any) error {
 	return nil
 }
 
+// set the ModTime of a file to now, false if it is not stored
+func (bfs *basicFileSystem) touch(key string) (bool, error) {
+	bfs.touchMu.Lock()
+	defer bfs.touchMu.Unlock()
+	bfi, err := bfs.getFileInfo(key)
+	if errors.Is(err, ErrFileNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	bfi.ModTime_ = time.Now()
+	return true, bfs.storeFileInfo(key, bfi)
+}
+
+// delete a file if its ModTime is not after before, return if it is deleted
+func (bfs *basicFileSystem) deleteIfOlder(ctx context.Context, key string, before time.Time) (bool, error) {
+	bfs.touchMu.Lock()
+	defer bfs.touchMu.Unlock()
+	bfi, err := bfs.getFileInfo(key)
+	if err != nil {
+		return false, err
+	}
+	if bfi.ModTime_.After(before) {
+		return false, nil
+	}
+	return true, bfs.Delete(ctx, key)
+}
+
 func (bfs *basicFileSystem) isExist(key string) bool {
 	if key == "" {
 		return false
@@ -197,20 +265,21 @@ func (bfs *basicFileSystem) isExist(key string) bool {
 
 // unit can be "B", "KB", "MB", "GB" or just leave it blank
 func (bfs *basicFileSystem) Occupy(unit ...string) float64 {
+	occupy := bfs.occupied()
 	if len(unit) == 0 {
-		return float64(bfs.occupy)
+		return float64(occupy)
 	}
 	switch unit[0] {
 	case "B":
-		return float64(bfs.occupy)
+		return float64(occupy)
 	case "KB":
-		return float64(bfs.occupy) / 1024
+		return float64(occupy) / 1024
 	case "MB":
-		return float64(bfs.occupy) / 1024 / 1024
+		return float64(occupy) / 1024 / 1024
 	case "GB":
-		return float64(bfs.occupy) / 1024 / 1024 / 1024
+		return float64(occupy) / 1024 / 1024 / 1024
 	default:
-		return float64(bfs.occupy)
+		return float64(occupy)
 	}
 }
 
@@ -260,6 +329,9 @@ func (bfs *basicFileSystem) deleteFile(bfi BasicFileInfo) error {
 
 func (bfs *basicFileSystem) getFileInfo(hashSum string) (BasicFileInfo, error) {
 	infoBytes, err := bfs.levelDB.Get([]byte(hashSum), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return BasicFileInfo{}, ErrFileNotFound
+	}
 	if err != nil {
 		return BasicFileInfo{}, err
 	}
@@ -285,6 +357,25 @@ func (bfs *basicFileSystem) storeFileInfo(hashSum string, file BasicFileInfo) er
 	return err
 }
 
+// iterate all file info, stop if fn returns false
+func (bfs *basicFileSystem) rangeFileInfo(fn func(key string, bfi BasicFileInfo) bool) error {
+	iter := bfs.levelDB.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if string(iter.Key()) == "cap_and_occupy" {
+			continue
+		}
+		var bfi BasicFileInfo
+		if err := json.Unmarshal(iter.Value(), &bfi); err != nil {
+			continue
+		}
+		if !fn(string(iter.Key()), bfi) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
 func (bfs *basicFileSystem) deleteFileInfo(hashSum string) error {
 	return bfs.levelDB.Delete([]byte(hashSum), nil)
 }
@@ -333,7 +424,7 @@ func (bfs *basicFileSystem) Close() error {
 	log.Println("basicFileSystem Closing.")
 
 	//save cap and ouppy
-	if err := storeCapAndOccupy(bfs.levelDB, bfs.capacity, bfs.occupy); err != nil {
+	if err := storeCapAndOccupy(bfs.levelDB, bfs.capacity, bfs.occupied()); err != nil {
 		log.Println("Save filesystem error:", err)
 	}
 	return bfs.levelDB.Close()
@@ -0,0 +1,409 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+// one block of a batch store
+type BatchItem struct {
+	Key      string
+	Filename string
+	Value    []byte
+}
+
+/*
+Result of one key in a batch.
+
+File is only set by BatchGet,
+Landed only by BatchStore, the peers the block landed on, see BlockPlacer.
+*/
+type BatchResult struct {
+	Key    string
+	File   File
+	Landed []peers.PeerInfo
+	Err    error
+}
+
+/*
+BlockBatcher reads and stores many blocks with one call per peer,
+Group uses it for the blocks of a file.
+
+locations - where each key landed, see BlockPlacer, nil or empty to use the ring.
+
+Implemented by DFS.
+*/
+type BlockBatcher interface {
+	BatchGetAt(ctx context.Context, keys []string, locations [][]string) []BatchResult
+	BatchStore(ctx context.Context, items []BatchItem) []BatchResult
+}
+
+var _ BlockBatcher = (*DFS)(nil)
+
+// implemented by DPeer
+type batchPeer interface {
+	BatchGet(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error)
+	BatchPut(ctx context.Context, pi peers.PeerInfo, items []BatchItem) ([]BatchResult, error)
+	BatchDelete(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error)
+	BatchHas(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error)
+	BatchTouch(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error)
+}
+
+var _ batchPeer = (*DPeer)(nil)
+
+const (
+	// data in one batch call, a batch to a peer is split into calls of at most this
+	BATCH_MAX_BYTES = 2 * int(BLOCK_SIZE)
+
+	// largest gRPC message, a full batch call or block with its keys and file info
+	RPC_MAX_MSG_SIZE = BATCH_MAX_BYTES + 1024*1024
+)
+
+/*
+Split n items into runs whose sizes add up to at most limit,
+an item larger than limit is a run by itself.
+
+Return the end index of every run.
+*/
+func splitBySize(n int, size func(i int) int, limit int) []int {
+	var ends []int
+	total := 0
+	for i := 0; i < n; i++ {
+		if total > 0 && total+size(i) > limit {
+			ends = append(ends, i)
+			total = 0
+		}
+		total += size(i)
+	}
+	if n > 0 {
+		ends = append(ends, n)
+	}
+	return ends
+}
+
+// indexes of the keys of a batch that go to one peer
+type peerBatch struct {
+	pi  peers.PeerInfo
+	idx []int
+}
+
+type peerBatches map[string]*peerBatch
+
+func (b peerBatches) add(pi peers.PeerInfo, i int) {
+	pb, ok := b[pi.PName()]
+	if !ok {
+		pb = &peerBatch{pi: pi}
+		b[pi.PName()] = pb
+	}
+	pb.idx = append(pb.idx, i)
+}
+
+// call fn for every peer in parallel
+func (b peerBatches) run(fn func(pb *peerBatch)) {
+	var wg sync.WaitGroup
+	wg.Add(len(b))
+	for _, pb := range b {
+		go func(pb *peerBatch) {
+			defer wg.Done()
+			fn(pb)
+		}(pb)
+	}
+	wg.Wait()
+}
+
+/*
+Get many keys with one call per peer.
+
+Keys are read from their first online replica,
+a key that fails there is read again by Get,
+which tries the other replicas, hints and recovery.
+
+Results are in the same order as keys.
+*/
+func (d *DFS) BatchGet(ctx context.Context, keys []string) []BatchResult {
+	return d.BatchGetAt(ctx, keys, nil)
+}
+
+/*
+BatchGet that reads a key from its first online location,
+a key that fails there is read again by GetAt.
+*/
+func (d *DFS) BatchGetAt(ctx context.Context, keys []string, locations [][]string) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	batches := peerBatches{}
+	for i, key := range keys {
+		results[i].Key = key
+		holders := d.PickReplicas(key)
+		if i < len(locations) && len(locations[i]) > 0 {
+			holders = d.peersAt(locations[i])
+		}
+		if len(holders) == 0 {
+			results[i].Err = peers.ErrPeerNotFound
+			continue
+		}
+		batches.add(d.firstOnline(holders), i)
+	}
+
+	batches.run(func(pb *peerBatch) {
+		batchKeys := make([]string, 0, len(pb.idx))
+		for _, i := range pb.idx {
+			batchKeys = append(batchKeys, keys[i])
+		}
+		for j, r := range d.batchGetFrom(ctx, pb.pi, batchKeys) {
+			i := pb.idx[j]
+			if r.Err != nil && ctx.Err() == nil {
+				log.Printf("[DFS] BatchGet %s from %s error: %s", keys[i], pb.pi.PName(), r.Err)
+				if i < len(locations) {
+					r.File, r.Err = d.GetAt(ctx, keys[i], locations[i])
+				} else {
+					r.File, r.Err = d.Get(ctx, keys[i])
+				}
+			}
+			results[i] = r
+		}
+	})
+	return results
+}
+
+/*
+Store many blocks with one call per replica holder,
+a call carries at most BATCH_MAX_BYTES, more take several calls.
+
+The error of a block is the last error of its replicas, like Store,
+a full replica spills over to the next peer after the batch.
+*/
+func (d *DFS) BatchStore(ctx context.Context, items []BatchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+	batches := peerBatches{}
+	for i, item := range items {
+		results[i].Key = item.Key
+		replicas := d.PickReplicas(item.Key)
+		if len(replicas) == 0 {
+			results[i].Err = peers.ErrPeerNotFound
+			continue
+		}
+		for _, pi := range replicas {
+			batches.add(pi, i)
+		}
+	}
+
+	var mu sync.Mutex
+	full := map[int]int{} // item index -> number of full replicas
+	batches.run(func(pb *peerBatch) {
+		batchItems := make([]BatchItem, 0, len(pb.idx))
+		for _, i := range pb.idx {
+			batchItems = append(batchItems, items[i])
+		}
+		errs := make([]error, 0, len(batchItems))
+		start := 0
+		for _, end := range splitBySize(len(batchItems), func(i int) int { return len(batchItems[i].Value) }, BATCH_MAX_BYTES) {
+			errs = append(errs, d.batchStoreTo(ctx, pb.pi, batchItems[start:end])...)
+			start = end
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for j, err := range errs {
+			if errors.Is(err, ErrFull) {
+				full[pb.idx[j]]++
+			}
+			if err != nil {
+				log.Printf("[DFS] BatchStore %s to %s error: %s", batchItems[j].Key, pb.pi.PName(), err)
+				results[pb.idx[j]].Err = err
+				continue
+			}
+			results[pb.idx[j]].Landed = append(results[pb.idx[j]].Landed, pb.pi)
+		}
+	})
+
+	for i, n := range full {
+		item := items[i]
+		spare := d.spillCandidates(item.Key, d.PickReplicas(item.Key))
+		for ; n > 0 && len(spare) > 0; spare = spare[1:] {
+			d.metrics.Inc(METRIC_SPILL_OVER)
+			if err := d.storeTo(ctx, spare[0], item.Key, item.Filename, item.Value); err != nil {
+				log.Printf("[DFS] BatchStore spill %s over to %s error: %s", item.Key, spare[0].PName(), err)
+				continue
+			}
+			results[i].Landed = append(results[i].Landed, spare[0])
+			n--
+		}
+		if n == 0 {
+			// every full replica spilled over, other errors are kept
+			if errors.Is(results[i].Err, ErrFull) {
+				results[i].Err = nil
+			}
+		}
+	}
+	return results
+}
+
+/*
+Delete many keys with one call per replica holder.
+
+The error of a key is the last error of its replicas, like Delete.
+*/
+func (d *DFS) BatchDelete(ctx context.Context, keys []string) []BatchResult {
+	results := make([]BatchResult, len(keys))
+	batches := peerBatches{}
+	for i, key := range keys {
+		results[i].Key = key
+		replicas := d.PickReplicas(key)
+		if len(replicas) == 0 {
+			results[i].Err = peers.ErrPeerNotFound
+			continue
+		}
+		for _, pi := range replicas {
+			batches.add(pi, i)
+		}
+	}
+
+	var mu sync.Mutex
+	batches.run(func(pb *peerBatch) {
+		batchKeys := make([]string, 0, len(pb.idx))
+		for _, i := range pb.idx {
+			batchKeys = append(batchKeys, keys[i])
+		}
+		errs := d.batchDeleteFrom(ctx, pb.pi, batchKeys)
+		mu.Lock()
+		defer mu.Unlock()
+		for j, err := range errs {
+			if err != nil {
+				log.Printf("[DFS] BatchDelete %s from %s error: %s", batchKeys[j], pb.pi.PName(), err)
+				results[pb.idx[j]].Err = err
+			}
+		}
+	})
+	return results
+}
+
+// this peer if it is a holder, or the first holder not known to be down
+func (d *DFS) firstOnline(holders []peers.PeerInfo) peers.PeerInfo {
+	for _, pi := range holders {
+		if pi.Equal(d.self.Info()) {
+			return pi
+		}
+	}
+	for _, pi := range holders {
+		if d.detector.IsOnline(pi) {
+			return pi
+		}
+	}
+	return holders[0]
+}
+
+func (d *DFS) batchGetFrom(ctx context.Context, pi peers.PeerInfo, keys []string) []BatchResult {
+	bp, ok := d.self.(batchPeer)
+	if pi.Equal(d.self.Info()) || !ok {
+		results := make([]BatchResult, 0, len(keys))
+		for _, key := range keys {
+			file, err := d.getFrom(ctx, pi, key)
+			results = append(results, BatchResult{Key: key, File: file, Err: err})
+		}
+		return results
+	}
+	// a peer answers the keys whose data fits one message, the rest are asked again
+	results := make([]BatchResult, 0, len(keys))
+	for len(results) < len(keys) {
+		rest := keys[len(results):]
+		answered, err := bp.BatchGet(ctx, pi, rest)
+		if err == nil && (len(answered) == 0 || len(answered) > len(rest)) {
+			err = ErrInternal
+		}
+		if err != nil {
+			for _, key := range rest {
+				results = append(results, BatchResult{Key: key, Err: err})
+			}
+			break
+		}
+		results = append(results, answered...)
+	}
+	return results
+}
+
+// same as storeTo for every item, errors are in the same order as items
+func (d *DFS) batchStoreTo(ctx context.Context, pi peers.PeerInfo, items []BatchItem) []error {
+	errs := make([]error, len(items))
+	bp, ok := d.self.(batchPeer)
+	if pi.Equal(d.self.Info()) || !d.detector.IsOnline(pi) || !ok {
+		for i, item := range items {
+			errs[i] = d.storeTo(ctx, pi, item.Key, item.Filename, item.Value)
+		}
+		return errs
+	}
+
+	results, err := bp.BatchPut(ctx, pi, items)
+	if err == nil && len(results) != len(items) {
+		err = ErrInternal
+	}
+	if isPeerUnavailable(err) && ctx.Err() == nil {
+		d.detector.MarkOffline(pi)
+		for i, item := range items {
+			errs[i] = d.storeHint(pi, item.Key, item.Filename, item.Value)
+		}
+		return errs
+	}
+	for i := range items {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = results[i].Err
+		}
+	}
+	return errs
+}
+
+// keys of the batch stored on pi, touch - refresh their mod time, see blockToucher
+func (d *DFS) batchHasFrom(ctx context.Context, pi peers.PeerInfo, keys []string, touch bool) ([]string, error) {
+	bp, ok := d.self.(batchPeer)
+	if !pi.Equal(d.self.Info()) && ok {
+		if touch {
+			return bp.BatchTouch(ctx, pi, keys)
+		}
+		return bp.BatchHas(ctx, pi, keys)
+	}
+	var exists []string
+	for _, key := range keys {
+		var ok bool
+		var err error
+		if touch && pi.Equal(d.self.Info()) {
+			ok, err = d.touchLocally(ctx, key)
+		} else {
+			ok, err = d.hasOn(ctx, pi, key)
+		}
+		if err != nil {
+			return exists, err
+		}
+		if ok {
+			exists = append(exists, key)
+		}
+	}
+	return exists, nil
+}
+
+func (d *DFS) batchDeleteFrom(ctx context.Context, pi peers.PeerInfo, keys []string) []error {
+	errs := make([]error, len(keys))
+	bp, ok := d.self.(batchPeer)
+	if pi.Equal(d.self.Info()) || !ok {
+		for i, key := range keys {
+			errs[i] = d.deleteFrom(ctx, pi, key)
+		}
+		return errs
+	}
+
+	results, err := bp.BatchDelete(ctx, pi, keys)
+	if err == nil && len(results) != len(keys) {
+		err = ErrInternal
+	}
+	for i := range keys {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = results[i].Err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDFSBatchLocal(t *testing.T) {
+	p := NewDPeer("BatchServer", "127.0.0.1:9632", 20, nil)
+	d := NewDFS(p, t.TempDir(), 1024*1024, nil)
+	defer d.Close()
+	ctx := context.Background()
+
+	var items []BatchItem
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("batchkey%d", i)
+		keys = append(keys, key)
+		items = append(items, BatchItem{Key: key, Filename: key + ".txt", Value: []byte(key)})
+	}
+	for _, r := range d.BatchStore(ctx, items) {
+		if r.Err != nil {
+			t.Fatalf("store %s: %s", r.Key, r.Err)
+		}
+	}
+
+	results := d.BatchGet(ctx, append(keys, "missing"))
+	for i, key := range keys {
+		if results[i].Key != key || results[i].Err != nil {
+			t.Fatalf("get %s: got %s, %v", key, results[i].Key, results[i].Err)
+		}
+		if string(results[i].File.Data()) != key {
+			t.Errorf("get %s: got data %q", key, results[i].File.Data())
+		}
+	}
+	if err := results[len(keys)].Err; !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("get missing: got %v, want ErrFileNotFound", err)
+	}
+
+	for _, r := range d.BatchDelete(ctx, keys[:5]) {
+		if r.Err != nil {
+			t.Fatalf("delete %s: %s", r.Key, r.Err)
+		}
+	}
+	for i, r := range d.BatchGet(ctx, keys) {
+		if deleted := i < 5; deleted != errors.Is(r.Err, ErrFileNotFound) {
+			t.Errorf("get %s after delete: %v", r.Key, r.Err)
+		}
+	}
+}
+
+func TestSplitBySize(t *testing.T) {
+	sizes := []int{3, 3, 5, 1, 1, 1}
+	ends := splitBySize(len(sizes), func(i int) int { return sizes[i] }, 4)
+	if fmt.Sprint(ends) != "[1 2 3 6]" {
+		t.Errorf("got %v", ends)
+	}
+	if ends := splitBySize(0, nil, 4); len(ends) != 0 {
+		t.Errorf("got %v for no items", ends)
+	}
+}
+
+// full blocks over gRPC take more than one message
+func TestDFSBatchRemote(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	server := NewDFS(NewDPeer("BatchRemote", addr, 20, nil), t.TempDir(), 1<<30, nil)
+	defer server.Close()
+	go server.Serve()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	client := NewDFS(NewDPeer("BatchClient", "127.0.0.1:1", 20, nil), t.TempDir(), 1<<30, nil)
+	defer client.Close()
+	pi := NewDPeerInfo("BatchRemote", addr)
+	ctx := context.Background()
+
+	var items []BatchItem
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("fullblock%d", i)
+		keys = append(keys, key)
+		items = append(items, BatchItem{Key: key, Filename: key, Value: bytes.Repeat([]byte{byte(i)}, int(BLOCK_SIZE))})
+	}
+	start := 0
+	for _, end := range splitBySize(len(items), func(i int) int { return len(items[i].Value) }, BATCH_MAX_BYTES) {
+		for _, err := range client.batchStoreTo(ctx, pi, items[start:end]) {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		start = end
+	}
+	results := client.batchGetFrom(ctx, pi, keys)
+	if len(results) != len(keys) {
+		t.Fatalf("got %d results", len(results))
+	}
+	for i, r := range results {
+		if r.Err != nil || r.Key != keys[i] || !bytes.Equal(r.File.Data(), items[i].Value) {
+			t.Errorf("get %s: got %s, %v", keys[i], r.Key, r.Err)
+		}
+	}
+}
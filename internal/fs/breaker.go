@@ -0,0 +1,243 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+type BreakerState string
+
+const (
+	BREAKER_CLOSED    BreakerState = "closed"
+	BREAKER_OPEN      BreakerState = "open"
+	BREAKER_HALF_OPEN BreakerState = "half-open"
+)
+
+const (
+	DEFAULT_BREAKER_FAILURES     = 5
+	DEFAULT_BREAKER_OPEN_TIMEOUT = time.Second * 10
+
+	DEFAULT_RETRY_ATTEMPTS   = 3
+	DEFAULT_RETRY_BASE_DELAY = time.Millisecond * 50
+	DEFAULT_RETRY_MAX_DELAY  = time.Second
+)
+
+/*
+BreakerPolicy decides when calls to a peer stop being sent.
+
+closed - calls are sent, Failures unavailable errors in a row open it
+
+open - calls fail at once with ErrCircuitOpen, half-open after OpenTimeout
+
+half-open - one call is sent, success closes it, failure opens it again
+
+Failures <= 0 disables the breaker.
+
+Use DFS.Set(BreakerPolicy{...}) or DTFS.Set before Serve to change it.
+*/
+type BreakerPolicy struct {
+	Failures    int
+	OpenTimeout time.Duration
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{
+	Failures:    DEFAULT_BREAKER_FAILURES,
+	OpenTimeout: DEFAULT_BREAKER_OPEN_TIMEOUT,
+}
+
+/*
+RetryPolicy of idempotent rpcs, e.g. Get, Delete, ListPeer.
+
+Only unavailable errors are retried,
+the delay doubles from BaseDelay up to MaxDelay with random jitter.
+
+Attempts <= 1 disables retry.
+
+Use DFS.Set(RetryPolicy{...}) or DTFS.Set before Serve to change it.
+*/
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  DEFAULT_RETRY_ATTEMPTS,
+	BaseDelay: DEFAULT_RETRY_BASE_DELAY,
+	MaxDelay:  DEFAULT_RETRY_MAX_DELAY,
+}
+
+// delay before the attempt after attempt n, n begins from 0
+func (r RetryPolicy) backoff(n int) time.Duration {
+	d := r.BaseDelay << n
+	if d > r.MaxDelay || d <= 0 {
+		d = r.MaxDelay
+	}
+	// jitter: [d/2, d)
+	if d > 1 {
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool // the call of half-open state is running
+}
+
+// nil if a call may be sent now
+func (b *circuitBreaker) allow(policy BreakerPolicy) error {
+	if policy.Failures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BREAKER_OPEN:
+		if time.Since(b.openedAt) < policy.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.state = BREAKER_HALF_OPEN
+		b.probing = true
+	case BREAKER_HALF_OPEN:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(policy BreakerPolicy, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.state = BREAKER_CLOSED
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BREAKER_HALF_OPEN || (policy.Failures > 0 && b.failures >= policy.Failures) {
+		b.state = BREAKER_OPEN
+		b.openedAt = time.Now()
+	}
+}
+
+// the call is done and its result is unknown
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// breakers of every peer, shared by copies of a DPeer
+type breakerSet struct {
+	// guards breakers and the policies
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+
+	policy BreakerPolicy
+	retry  RetryPolicy
+}
+
+func newBreakerSet() *breakerSet {
+	return &breakerSet{
+		breakers: make(map[string]*circuitBreaker),
+		policy:   DefaultBreakerPolicy,
+		retry:    DefaultRetryPolicy,
+	}
+}
+
+func (s *breakerSet) states() map[string]BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states := make(map[string]BreakerState, len(s.breakers))
+	for name, b := range s.breakers {
+		states[name] = b.State()
+	}
+	return states
+}
+
+func (s *breakerSet) get(pi peers.PeerInfo) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[pi.PName()]
+	if !ok {
+		b = &circuitBreaker{state: BREAKER_CLOSED}
+		s.breakers[pi.PName()] = b
+	}
+	return b
+}
+
+func (s *breakerSet) setPolicy(policy BreakerPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+func (s *breakerSet) setRetry(retry RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retry = retry
+}
+
+func (s *breakerSet) policies() (BreakerPolicy, RetryPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.policy, s.retry
+}
+
+/*
+Call fn through the breaker of pi, with timeout d for each attempt.
+
+idempotent - retry on unavailable errors, see RetryPolicy
+*/
+func (s *breakerSet) call(ctx context.Context, pi peers.PeerInfo, idempotent bool, d time.Duration, fn func(ctx context.Context) error) error {
+	b := s.get(pi)
+	policy, retry := s.policies()
+	attempts := 1
+	if idempotent && retry.Attempts > 1 {
+		attempts = retry.Attempts
+	}
+	for n := 0; ; n++ {
+		if err := b.allow(policy); err != nil {
+			return err
+		}
+		actx, cancel := withTimeout(ctx, d)
+		err := fn(actx)
+		cancel()
+		// the caller gave up, it says nothing about the peer
+		if ctx.Err() != nil {
+			b.release()
+			return err
+		}
+		b.record(policy, isPeerUnavailable(err))
+		if err == nil || !isPeerUnavailable(err) || n+1 >= attempts {
+			return err
+		}
+		select {
+		case <-time.After(retry.backoff(n)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
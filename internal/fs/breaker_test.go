@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	policy := BreakerPolicy{Failures: 2, OpenTimeout: time.Millisecond * 20}
+	b := &circuitBreaker{state: BREAKER_CLOSED}
+
+	for i := 0; i < policy.Failures; i++ {
+		if err := b.allow(policy); err != nil {
+			t.Fatalf("closed breaker refused call %d: %s", i, err)
+		}
+		b.record(policy, true)
+	}
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("got state %s after %d failures, want open", b.State(), policy.Failures)
+	}
+	if err := b.allow(policy); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open breaker allowed a call: %v", err)
+	}
+
+	// one probe after OpenTimeout
+	time.Sleep(policy.OpenTimeout)
+	if err := b.allow(policy); err != nil {
+		t.Fatalf("half-open breaker refused the probe: %s", err)
+	}
+	if b.State() != BREAKER_HALF_OPEN {
+		t.Fatalf("got state %s, want half-open", b.State())
+	}
+	if err := b.allow(policy); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("half-open breaker allowed a second call")
+	}
+	b.record(policy, true)
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("got state %s after failed probe, want open", b.State())
+	}
+
+	time.Sleep(policy.OpenTimeout)
+	if err := b.allow(policy); err != nil {
+		t.Fatal(err)
+	}
+	b.record(policy, false)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("got state %s after good probe, want closed", b.State())
+	}
+}
+
+func TestBreakerRetry(t *testing.T) {
+	s := newBreakerSet()
+	s.setPolicy(BreakerPolicy{Failures: 4, OpenTimeout: time.Minute})
+	s.setRetry(RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond * 2})
+	pi := NewDPeerInfo("down", "127.0.0.1:9")
+	ctx := context.Background()
+
+	calls := 0
+	unavailable := func(ctx context.Context) error {
+		calls++
+		return status.Error(codes.Unavailable, "down")
+	}
+	s.call(ctx, pi, true, time.Second, unavailable)
+	if calls != 3 {
+		t.Errorf("idempotent call sent %d times, want 3", calls)
+	}
+
+	// not idempotent, sent once and the breaker opens at the 4th failure
+	calls = 0
+	s.call(ctx, pi, false, time.Second, unavailable)
+	if calls != 1 {
+		t.Errorf("call sent %d times, want 1", calls)
+	}
+	if got := s.states()["down"]; got != BREAKER_OPEN {
+		t.Fatalf("got state %s, want open", got)
+	}
+
+	// open breaker fails fast
+	calls = 0
+	if err := s.call(ctx, pi, true, time.Second, unavailable); !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Errorf("got %v after %d calls, want ErrCircuitOpen", err, calls)
+	}
+	if !isPeerUnavailable(ErrCircuitOpen) {
+		t.Error("open breaker should make the peer unavailable")
+	}
+
+	// other errors are not retried and do not count
+	calls = 0
+	other := NewDPeerInfo("up", "127.0.0.1:9")
+	s.call(ctx, other, true, time.Second, func(ctx context.Context) error {
+		calls++
+		return ErrFileNotFound
+	})
+	if calls != 1 || s.states()["up"] != BREAKER_CLOSED {
+		t.Errorf("got %d calls and state %s", calls, s.states()["up"])
+	}
+}
+
+// policies and timeouts set while calls are running, run with -race
+func TestBreakerPolicyConcurrent(t *testing.T) {
+	p := NewDPeer("self", "127.0.0.1:9631", 20, nil)
+	pi := NewDPeerInfo("peer", "127.0.0.1:9")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			p.breakers.call(context.Background(), pi, true, time.Second, func(ctx context.Context) error { return nil })
+			// a copy shares the timeouts
+			copied := *p
+			copied.Timeout()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		p.SetBreakerPolicy(BreakerPolicy{Failures: i})
+		p.SetRetryPolicy(RetryPolicy{Attempts: i})
+		p.SetTimeout(RPCTimeout{Sync: time.Duration(i) * time.Millisecond})
+	}
+	<-done
+	if got := p.Timeout().Sync; got != 99*time.Millisecond {
+		t.Errorf("got sync timeout %s", got)
+	}
+}
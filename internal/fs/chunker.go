@@ -0,0 +1,168 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	CHUNK_FIXED = iota
+	CHUNK_CDC
+)
+
+const (
+	DEFAULT_CHUNK_MIN = 512 * 1024
+	DEFAULT_CHUNK_AVG = 2 * 1024 * 1024
+	DEFAULT_CHUNK_MAX = int(BLOCK_SIZE)
+)
+
+/*
+ChunkPolicy decides how Group.StoreFile splits a file into blocks
+when the client gives no boundaries.
+
+Mode - CHUNK_FIXED cuts BLOCK_SIZE blocks,
+CHUNK_CDC cuts where the content says (FastCDC),
+so an insert only changes the blocks around it and the rest deduplicate.
+
+Min, Avg, Max - sizes of CHUNK_CDC blocks, Max is at most BLOCK_SIZE.
+
+Use Group.Set(ChunkPolicy{...}) to change it.
+*/
+type ChunkPolicy struct {
+	Mode int
+	Min  int
+	Avg  int
+	Max  int
+}
+
+var DefaultChunkPolicy = ChunkPolicy{
+	Mode: CHUNK_FIXED,
+	Min:  DEFAULT_CHUNK_MIN,
+	Avg:  DEFAULT_CHUNK_AVG,
+	Max:  DEFAULT_CHUNK_MAX,
+}
+
+func (p ChunkPolicy) check() error {
+	switch p.Mode {
+	case CHUNK_FIXED:
+		return nil
+	case CHUNK_CDC:
+		if p.Min <= 0 || p.Min > p.Avg || p.Avg > p.Max || p.Max > int(BLOCK_SIZE) {
+			return fmt.Errorf("chunk sizes want 0 < min <= avg <= max <= %d, got %d, %d, %d", BLOCK_SIZE, p.Min, p.Avg, p.Max)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown chunk mode %d", p.Mode)
+	}
+}
+
+// chunker cuts a stream into blocks, next returns io.EOF after the last one
+type chunker interface {
+	next() ([]byte, error)
+}
+
+func newChunker(p ChunkPolicy, stream io.Reader) chunker {
+	if p.Mode == CHUNK_CDC {
+		return newCDCChunker(p, stream)
+	}
+	return &fixedChunker{stream: stream, size: int(BLOCK_SIZE)}
+}
+
+type fixedChunker struct {
+	stream io.Reader
+	size   int
+}
+
+func (c *fixedChunker) next() ([]byte, error) {
+	data := make([]byte, c.size)
+	n, err := io.ReadFull(c.stream, data)
+	if err == io.ErrUnexpectedEOF {
+		return data[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+cdcChunker is FastCDC with normalized chunking.
+
+A gear hash rolls over the data, a block is cut where its high bits are zero.
+Before Avg the mask has more bits, after it fewer,
+so block sizes gather around Avg.
+*/
+type cdcChunker struct {
+	r      *bufio.Reader
+	policy ChunkPolicy
+	maskS  uint64
+	maskL  uint64
+}
+
+func newCDCChunker(p ChunkPolicy, stream io.Reader) *cdcChunker {
+	avgBits := bits.Len(uint(p.Avg)) - 1
+	return &cdcChunker{
+		r:      bufio.NewReaderSize(stream, p.Max),
+		policy: p,
+		maskS:  ^uint64(0) << (64 - (avgBits + 1)),
+		maskL:  ^uint64(0) << (64 - (avgBits - 1)),
+	}
+}
+
+func (c *cdcChunker) next() ([]byte, error) {
+	buf, err := c.r.Peek(c.policy.Max)
+	if len(buf) == 0 {
+		if err == nil || err == bufio.ErrBufferFull {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data := append([]byte(nil), buf[:c.cut(buf)]...)
+	_, err = c.r.Discard(len(data))
+	return data, err
+}
+
+// length of the first block of buf
+func (c *cdcChunker) cut(buf []byte) int {
+	if len(buf) <= c.policy.Min {
+		return len(buf)
+	}
+	normal := c.policy.Avg
+	if normal > len(buf) {
+		normal = len(buf)
+	}
+	var fp uint64
+	i := c.policy.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[buf[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < len(buf); i++ {
+		fp = (fp << 1) + gearTable[buf[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return len(buf)
+}
+
+// random values of the gear hash, fixed so every node cuts the same blocks
+var gearTable = func() (table [256]uint64) {
+	// splitmix64
+	seed := uint64(0x436c6f7564426f72)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
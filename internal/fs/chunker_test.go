@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, p ChunkPolicy, data []byte) [][]byte {
+	c := newChunker(p, bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestCDCChunker(t *testing.T) {
+	p := ChunkPolicy{Mode: CHUNK_CDC, Min: 1024, Avg: 4096, Max: 16384}
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := chunkAll(t, p, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > p.Max || (len(chunk) < p.Min && i != len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+	if n := len(chunks); n < len(data)/p.Max || n > len(data)/p.Min {
+		t.Errorf("got %d chunks", n)
+	}
+
+	// an insert at the start only changes the first blocks
+	edited := chunkAll(t, p, append([]byte("inserted"), data...))
+	hashes := make(map[string]bool)
+	for _, chunk := range chunks {
+		hashes[blockChecksum(chunk)] = true
+	}
+	shared := 0
+	for _, chunk := range edited {
+		if hashes[blockChecksum(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Errorf("%d of %d chunks shared after an insert", shared, len(chunks))
+	}
+}
+
+func TestChunkPolicy(t *testing.T) {
+	g := newUploadGroup(t)
+	if err := g.Set(ChunkPolicy{Mode: CHUNK_CDC, Min: 10, Avg: 5, Max: 20}); err == nil {
+		t.Error("min larger than avg accepted")
+	}
+	if err := g.Set(ChunkPolicy{Mode: CHUNK_CDC, Min: 1, Avg: 2, Max: int(BLOCK_SIZE) + 1}); err == nil {
+		t.Error("max larger than BLOCK_SIZE accepted")
+	}
+	if err := g.Set(ChunkPolicy{Mode: CHUNK_CDC, Min: 1024, Avg: 4096, Max: 16384}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for i, block := range blocks {
+		if block.BlockID != int64(i) || block.Size > 16384 {
+			t.Fatalf("got block %+v", block)
+		}
+		b, err := g.GetBlockData(ctx, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if len(blocks) < 4 || !bytes.Equal(got, data) {
+		t.Errorf("got %d blocks", len(blocks))
+	}
+}
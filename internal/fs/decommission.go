@@ -0,0 +1,461 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+var (
+	ErrDecommissionRunning    = errors.New("decommission is running")
+	ErrDecommissionNotRunning = errors.New("decommission is not running")
+	ErrNoPeerToTakeOver       = errors.New("no peer to take over")
+)
+
+type DecommissionState string
+
+const (
+	DECOMMISSION_IDLE      DecommissionState = "idle"
+	DECOMMISSION_DRAINING  DecommissionState = "draining"
+	DECOMMISSION_MIGRATING DecommissionState = "migrating"
+	DECOMMISSION_VERIFYING DecommissionState = "verifying"
+	DECOMMISSION_DONE      DecommissionState = "done"
+	DECOMMISSION_CANCELLED DecommissionState = "cancelled"
+	DECOMMISSION_FAILED    DecommissionState = "failed"
+)
+
+type DecommissionProgress struct {
+	State DecommissionState `json:"state"`
+
+	TotalBlocks    int64 `json:"total_blocks"`
+	MovedBlocks    int64 `json:"moved_blocks"`
+	FailedBlocks   int64 `json:"failed_blocks"`
+	VerifiedBlocks int64 `json:"verified_blocks"`
+
+	TotalSpaces    int64 `json:"total_spaces"`
+	MovedSpaces    int64 `json:"moved_spaces"`
+	FailedSpaces   int64 `json:"failed_spaces"`
+	VerifiedSpaces int64 `json:"verified_spaces"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	Error     string    `json:"error,omitempty"`
+}
+
+/*
+decommission is a running (or finished) decommission workflow:
+
+draining -> migrating -> verifying -> leave the ring
+*/
+type decommission struct {
+	mu       sync.RWMutex
+	progress DecommissionProgress
+	cancel   context.CancelFunc
+}
+
+// file systems that can move all their data to other peers
+type drainer interface {
+	drain(ctx context.Context, d *decommission) error
+	verify(ctx context.Context, d *decommission) error
+}
+
+var _ drainer = (*DFS)(nil)
+var _ drainer = (*DTFS)(nil)
+
+// file systems that remove the data they moved once every system is verified
+type releaser interface {
+	release(ctx context.Context) error
+}
+
+var _ releaser = (*DFS)(nil)
+var _ releaser = (*DTFS)(nil)
+
+func (d *decommission) update(fn func(p *DecommissionProgress)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(&d.progress)
+}
+
+func (d *decommission) Progress() DecommissionProgress {
+	if d == nil {
+		return DecommissionProgress{State: DECOMMISSION_IDLE}
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.progress
+}
+
+func (d *decommission) running() bool {
+	switch d.Progress().State {
+	case DECOMMISSION_DRAINING, DECOMMISSION_MIGRATING, DECOMMISSION_VERIFYING:
+		return true
+	}
+	return false
+}
+
+func (d *decommission) setState(state DecommissionState) {
+	d.update(func(p *DecommissionProgress) {
+		p.State = state
+	})
+}
+
+/*
+Move every block stored here to its new replicas.
+
+The peer is draining, so PickReplicas will not return it.
+Shards are not moved, their layout names this peer,
+they are rebuilt elsewhere by shard repair once it is gone, see Group.RepairFile.
+*/
+func (d *DFS) drain(ctx context.Context, dc *decommission) error {
+	var keys []string
+	d.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+		if !isShardKey(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	dc.update(func(p *DecommissionProgress) {
+		p.TotalBlocks += int64(len(keys))
+	})
+	var err error
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e := d.moveBlock(ctx, key); e != nil {
+			err = e
+			log.Printf("[DFS] Decommission: move %s error: %s", key, e)
+			dc.update(func(p *DecommissionProgress) { p.FailedBlocks++ })
+			continue
+		}
+		dc.update(func(p *DecommissionProgress) { p.MovedBlocks++ })
+	}
+	return err
+}
+
+func (d *DFS) moveBlock(ctx context.Context, key string) error {
+	replicas := withoutPeer(d.PickReplicas(key), d.self.Info())
+	if len(replicas) == 0 {
+		return ErrNoPeerToTakeOver
+	}
+	file, err := d.getLocally(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, pi := range replicas {
+		if err := d.storeTo(ctx, pi, key, file.Stat().Name(), file.Data()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// every block stored here can be read from all its new replicas, shards are not moved
+func (d *DFS) verify(ctx context.Context, dc *decommission) error {
+	var err error
+	d.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			return false
+		}
+		if isShardKey(key) {
+			return true
+		}
+		for _, pi := range withoutPeer(d.PickReplicas(key), d.self.Info()) {
+			file, e := d.getFrom(ctx, pi, key)
+			if e == nil && int64(len(file.Data())) != bfi.Size_ {
+				e = fmt.Errorf("size %d, want %d", len(file.Data()), bfi.Size_)
+			}
+			if e != nil {
+				err = fmt.Errorf("verify %s on %s: %w", key, pi.PName(), e)
+				return false
+			}
+		}
+		dc.update(func(p *DecommissionProgress) { p.VerifiedBlocks++ })
+		return true
+	})
+	return err
+}
+
+// remove the blocks every new replica has, shards stay until the node leaves
+func (d *DFS) release(ctx context.Context) error {
+	var keys []string
+	d.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+		if !isShardKey(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	var err error
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e := d.releaseBlock(ctx, key); e != nil {
+			err = e
+			log.Printf("[DFS] Decommission: remove %s error: %s", key, e)
+		}
+	}
+	return err
+}
+
+func (d *DFS) releaseBlock(ctx context.Context, key string) error {
+	replicas := withoutPeer(d.PickReplicas(key), d.self.Info())
+	if len(replicas) == 0 {
+		return ErrNoPeerToTakeOver
+	}
+	for _, pi := range replicas {
+		exists, err := d.hasOn(ctx, pi, key)
+		if err == nil && !exists {
+			err = ErrFileNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("check %s on %s: %w", key, pi.PName(), err)
+		}
+	}
+	return d.deleteLocally(ctx, key)
+}
+
+/*
+Move every space stored here to its new owner,
+dirs are created before the files in them.
+*/
+func (dt *DTFS) drain(ctx context.Context, dc *decommission) error {
+	spaces, err := dt.ListSpaces()
+	if err != nil {
+		return err
+	}
+	dc.update(func(p *DecommissionProgress) {
+		p.TotalSpaces += int64(len(spaces))
+	})
+	for _, spaceKey := range spaces {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e := dt.moveSpace(ctx, spaceKey); e != nil {
+			err = e
+			log.Printf("[DTFS] Decommission: move space %s error: %s", spaceKey, e)
+			dc.update(func(p *DecommissionProgress) { p.FailedSpaces++ })
+			continue
+		}
+		dc.update(func(p *DecommissionProgress) { p.MovedSpaces++ })
+	}
+	return err
+}
+
+func (dt *DTFS) moveSpace(ctx context.Context, spaceKey string) error {
+	owner := dt.PickPeer(spaceKey)
+	if owner == nil || owner.Equal(dt.self.info) {
+		return ErrNoPeerToTakeOver
+	}
+	if err := dt.self.Put(ctx, owner, spaceKey, NEW_SPACE, nil).Err; err != nil {
+		return err
+	}
+	return dt.walkSpace(spaceKey, func(path string, isDir bool) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isDir {
+			dir, name := filepath.Split(path)
+			return dt.self.Put(ctx, owner, spaceKey, filepath.Join(dir, DIR_PERFIX+name), nil).Err
+		}
+		file, err := dt.getLocally(ctx, spaceKey+"/"+path)
+		if err != nil {
+			return err
+		}
+		return dt.self.Put(ctx, owner, spaceKey, path, file.Data()).Err
+	})
+}
+
+// every file and dir of spaces stored here can be found on the new owner
+func (dt *DTFS) verify(ctx context.Context, dc *decommission) error {
+	spaces, err := dt.ListSpaces()
+	if err != nil {
+		return err
+	}
+	for _, spaceKey := range spaces {
+		owner := dt.PickPeer(spaceKey)
+		if owner == nil || owner.Equal(dt.self.info) {
+			return ErrNoPeerToTakeOver
+		}
+		err := dt.walkSpace(spaceKey, func(path string, isDir bool) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := dt.self.Get(ctx, owner, spaceKey+"/"+path).Err; err != nil {
+				return fmt.Errorf("verify %s/%s on %s: %w", spaceKey, path, owner.PName(), err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		dc.update(func(p *DecommissionProgress) { p.VerifiedSpaces++ })
+	}
+	return nil
+}
+
+// remove the spaces moved to their new owners, reads stop falling back to this node
+func (dt *DTFS) release(ctx context.Context) error {
+	spaces, err := dt.ListSpaces()
+	if err != nil {
+		return err
+	}
+	for _, spaceKey := range spaces {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if e := dt.RemoveSpace(spaceKey); e != nil {
+			err = e
+			log.Printf("[DTFS] Decommission: remove space %s error: %s", spaceKey, e)
+		}
+	}
+	return err
+}
+
+// path is relative to the base dir of the space, parents come first
+func (dt *DTFS) walkSpace(spaceKey string, fn func(path string, isDir bool) error) error {
+	base := filepath.Join(dt.rootPath, spaceKey, BASE_DIR)
+	return filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == base {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), d.IsDir())
+	})
+}
+
+/*
+Start to decommission this node in background.
+
+1. mark the node draining, other peers stop writing to it
+2. move all blocks and spaces to their new owners
+3. verify the new owners have them
+4. remove the moved blocks and spaces
+5. leave the ring
+
+Use DecommissionProgress to watch it and CancelDecommission to stop it,
+a cancelled or failed decommission marks the node online again.
+*/
+func (g *Group) Decommission() error {
+	g.decomMu.Lock()
+	defer g.decomMu.Unlock()
+	if g.decom != nil && g.decom.running() {
+		return ErrDecommissionRunning
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.decom = &decommission{
+		progress: DecommissionProgress{
+			State:     DECOMMISSION_DRAINING,
+			StartTime: time.Now(),
+		},
+		cancel: cancel,
+	}
+	go g.decommission(ctx, g.decom)
+	return nil
+}
+
+func (g *Group) DecommissionProgress() DecommissionProgress {
+	g.decomMu.Lock()
+	defer g.decomMu.Unlock()
+	return g.decom.Progress()
+}
+
+func (g *Group) CancelDecommission() error {
+	g.decomMu.Lock()
+	defer g.decomMu.Unlock()
+	if g.decom == nil || !g.decom.running() {
+		return ErrDecommissionNotRunning
+	}
+	g.decom.cancel()
+	return nil
+}
+
+func (g *Group) decommission(ctx context.Context, dc *decommission) {
+	defer dc.cancel()
+	systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+
+	err := g.runDecommission(ctx, dc, systems)
+	if err == nil {
+		log.Println("[Group] Decommission done")
+		dc.update(func(p *DecommissionProgress) {
+			p.State = DECOMMISSION_DONE
+			p.EndTime = time.Now()
+		})
+		return
+	}
+
+	// back to online
+	for _, fs := range systems {
+		if e := fs.Peer().PSetStat(peers.P_STAT_ONLINE); e != nil {
+			log.Println("[Group] Set stat online error:", e)
+		}
+	}
+	state := DECOMMISSION_FAILED
+	if errors.Is(err, context.Canceled) {
+		state = DECOMMISSION_CANCELLED
+	}
+	log.Printf("[Group] Decommission %s: %s", state, err)
+	dc.update(func(p *DecommissionProgress) {
+		p.State = state
+		p.Error = err.Error()
+		p.EndTime = time.Now()
+	})
+}
+
+func (g *Group) runDecommission(ctx context.Context, dc *decommission, systems []DistributeFileSystem) error {
+	log.Println("[Group] Decommission: draining")
+	for _, fs := range systems {
+		if err := fs.Peer().PSetStat(peers.P_STAT_DRAINING); err != nil {
+			return err
+		}
+	}
+
+	dc.setState(DECOMMISSION_MIGRATING)
+	log.Println("[Group] Decommission: migrating")
+	for _, fs := range systems {
+		if d, ok := fs.(drainer); ok {
+			if err := d.drain(ctx, dc); err != nil {
+				return err
+			}
+		}
+	}
+
+	dc.setState(DECOMMISSION_VERIFYING)
+	log.Println("[Group] Decommission: verifying")
+	for _, fs := range systems {
+		if d, ok := fs.(drainer); ok {
+			if err := d.verify(ctx, dc); err != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// every copy is verified, a failure here only leaves files behind
+	for _, fs := range systems {
+		if r, ok := fs.(releaser); ok {
+			if err := r.release(ctx); err != nil {
+				log.Println("[Group] Decommission: remove moved data error:", err)
+			}
+		}
+	}
+
+	g.Quit()
+	return nil
+}
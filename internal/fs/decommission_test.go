@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+func TestDTFSDrainingOwner(t *testing.T) {
+	dt := NewDTFS(*NewDPeer("front0", "127.0.0.1:1", 20, nil), t.TempDir())
+	defer dt.Close()
+	other := NewDPeerInfo("front1", "127.0.0.1:2")
+	dt.AddPeer(other)
+	var spaceKey string
+	for i := 0; spaceKey == ""; i++ {
+		if key := fmt.Sprintf("space%d", i); dt.self.Pick(key).Equal(dt.self.info) {
+			spaceKey = key
+		}
+	}
+	if err := dt.storeLocally(context.Background(), spaceKey, NEW_SPACE, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new owner first, this draining node is the fallback
+	setLocalStat(dt.self, peers.P_STAT_DRAINING)
+	owners := dt.owners(spaceKey)
+	if len(owners) != 2 || !owners[0].Equal(other) || !owners[1].Equal(dt.self.info) {
+		t.Fatalf("got owners %v", owners)
+	}
+
+	if err := dt.release(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spaces, err := dt.ListSpaces(); err != nil || len(spaces) != 0 {
+		t.Errorf("got spaces %v, %v after release", spaces, err)
+	}
+	if dt.GetSpace(spaceKey) != nil {
+		t.Error("released space is still open")
+	}
+}
+
+func TestDFSDrain(t *testing.T) {
+	d, p := newMemDFS(t, "drain", 1, 4)
+	ctx := context.Background()
+	block := []byte("block of a draining peer")
+	key := blockChecksum(block)
+	shard := Fileshard{Key: shardKey(key, 0)}
+	if err := d.storeLocally(ctx, key, key, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.storeLocally(ctx, shard.Key, shard.fileName(), block); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.self.PSetStat(peers.P_STAT_DRAINING); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shard stays, its layout names this peer
+	dc := &decommission{}
+	if err := d.drain(ctx, dc); err != nil {
+		t.Fatal(err)
+	}
+	if progress := dc.Progress(); progress.TotalBlocks != 1 || progress.MovedBlocks != 1 {
+		t.Errorf("got progress %+v", progress)
+	}
+	for _, pi := range d.PickReplicas(key) {
+		if _, ok := p.files[pi.PName()][key]; !ok {
+			t.Errorf("block is not moved to %s", pi.PName())
+		}
+	}
+	for name, files := range p.files {
+		if _, ok := files[shard.Key]; ok {
+			t.Errorf("shard is copied to %s", name)
+		}
+	}
+	if err := d.verify(ctx, dc); err != nil {
+		t.Fatal(err)
+	}
+
+	// the moved block is removed here
+	if err := d.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := d.hasLocally(ctx, key); ok {
+		t.Error("moved block is not removed")
+	}
+	if ok, _ := d.hasLocally(ctx, shard.Key); !ok {
+		t.Error("shard is removed before the node leaves")
+	}
+}
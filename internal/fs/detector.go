@@ -0,0 +1,150 @@
+package fs
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DETECT_INTERVAL = time.Second * 3
+)
+
+/*
+failureDetector pings every known peer periodically
+and records whether it is online.
+
+Callbacks registered by OnOnline will be called
+when a peer comes back online.
+*/
+type failureDetector struct {
+	self     peers.Peer
+	interval time.Duration
+
+	mu     sync.RWMutex
+	status map[string]peers.PeerStatType // peer name -> status
+	since  map[string]time.Time          // peer name -> when it went offline
+
+	onOnline []func(pi peers.PeerInfo)
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newFailureDetector(self peers.Peer, interval time.Duration) *failureDetector {
+	return &failureDetector{
+		self:     self,
+		interval: interval,
+		status:   make(map[string]peers.PeerStatType),
+		since:    make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (fd *failureDetector) OnOnline(fn func(pi peers.PeerInfo)) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.onOnline = append(fd.onOnline, fn)
+}
+
+func (fd *failureDetector) run() {
+	ticker := time.NewTicker(fd.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fd.stop:
+			return
+		case <-ticker.C:
+			fd.probe()
+		}
+	}
+}
+
+func (fd *failureDetector) probe() {
+	for _, pi := range fd.self.PList() {
+		if pi.Equal(fd.self.Info()) {
+			continue
+		}
+		if err := fd.self.PPing(pi); err != nil {
+			fd.MarkOffline(pi)
+			continue
+		}
+		fd.markOnline(pi)
+	}
+}
+
+// Peer is regarded as online until it fails once.
+func (fd *failureDetector) IsOnline(pi peers.PeerInfo) bool {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+	stat, ok := fd.status[pi.PName()]
+	return !ok || stat == peers.P_STAT_ONLINE
+}
+
+func (fd *failureDetector) MarkOffline(pi peers.PeerInfo) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if fd.status[pi.PName()] != peers.P_STAT_OFFLINE {
+		log.Printf("[Detector] %s is offline", pi.PName())
+		fd.since[pi.PName()] = time.Now()
+	}
+	fd.status[pi.PName()] = peers.P_STAT_OFFLINE
+}
+
+// how long pi has been offline, 0 if it is online
+func (fd *failureDetector) OfflineFor(pi peers.PeerInfo, now time.Time) time.Duration {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+	if fd.status[pi.PName()] != peers.P_STAT_OFFLINE {
+		return 0
+	}
+	return now.Sub(fd.since[pi.PName()])
+}
+
+/*
+Unknown -> online is also a transition,
+so work left before restart (e.g. hints) will be done.
+*/
+func (fd *failureDetector) markOnline(pi peers.PeerInfo) {
+	fd.mu.Lock()
+	stat, ok := fd.status[pi.PName()]
+	fd.status[pi.PName()] = peers.P_STAT_ONLINE
+	delete(fd.since, pi.PName())
+	callbacks := fd.onOnline
+	fd.mu.Unlock()
+
+	if ok && stat == peers.P_STAT_ONLINE {
+		return
+	}
+	log.Printf("[Detector] %s is online", pi.PName())
+	for _, fn := range callbacks {
+		go fn(pi)
+	}
+}
+
+func (fd *failureDetector) Close() {
+	fd.stopOnce.Do(func() {
+		close(fd.stop)
+	})
+}
+
+// the rpc failed because the peer cannot be reached, not because of the request
+func isPeerUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
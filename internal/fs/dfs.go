@@ -1,9 +1,12 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
 )
@@ -22,6 +25,21 @@ type DistributeFileInfo struct {
 type DFS struct {
 	*basicFileSystem
 	self peers.Peer
+
+	policy            ReplicaPolicy
+	repairPolicy      ReadRepairPolicy
+	antiEntropyPolicy AntiEntropyPolicy
+	hedgePolicy       HedgePolicy
+
+	hints    *hintStore
+	detector *failureDetector
+	latency  *latencyTracker
+
+	metrics Metrics
+
+	port      rpcPort
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 var _ DistributeFileSystem = (*DFS)(nil)
@@ -36,29 +54,163 @@ func (d *DFS) PickPeer(key string) peers.PeerInfo {
 	return d.self.Pick(key)
 }
 
+/*
+Peers that hold the replicas of key, the first one is the owner.
+
+Draining peers are skipped, their blocks are moving to these peers.
+*/
+func (d *DFS) PickReplicas(key string) []peers.PeerInfo {
+	return pickReplicas(withoutDraining(d.self.PickN(key, 0)), d.policy)
+}
+
 func NewDFS(self peers.Peer, rootPath string, capacity int64, calcStorePathFn CalcStoreFilePathFnType) *DFS {
 	d := &DFS{
 		basicFileSystem: newBasicFileSystem(rootPath, capacity, calcStorePathFn),
 
-		self: self.(DPeer),
+		self:              self,
+		policy:            DefaultReplicaPolicy,
+		repairPolicy:      DefaultReadRepairPolicy,
+		antiEntropyPolicy: DefaultAntiEntropyPolicy,
+		hedgePolicy:       DefaultHedgePolicy,
+
+		hints:    newHintStore(rootPath),
+		detector: newFailureDetector(self, DETECT_INTERVAL),
+		latency:  newLatencyTracker(),
+
+		closing: make(chan struct{}),
 	}
+	d.detector.OnOnline(d.replayHints)
 	return d
 }
 
-func (d *DFS) Get(key string) (File, error) {
-	pi := d.PickPeer(key)
-	if pi == nil {
+/*
+Get from replicas in order, a slow replica is hedged with the next one,
+see HedgePolicy.
+
+If no replica has it, try to recover it from the next peer.
+*/
+func (d *DFS) Get(ctx context.Context, key string) (File, error) {
+	replicas := d.PickReplicas(key)
+	if len(replicas) == 0 {
 		return nil, peers.ErrPeerNotFound
 	}
+	file, reads := d.readReplicas(ctx, key, replicas)
+	if file == nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var err error
+	var missed []peers.PeerInfo
+	read := make(map[string]bool)
+	for _, r := range reads {
+		read[r.pi.PName()] = true
+		if r.err == nil {
+			continue
+		}
+		log.Printf("[DFS] Get %s from %s error: %s", key, r.pi.PName(), r.err)
+		err = r.err
+		if !isPeerUnavailable(r.err) {
+			missed = append(missed, r.pi)
+		}
+	}
+	if file != nil {
+		if len(missed) > 0 || d.shouldCheckReplicas() {
+			var unchecked []peers.PeerInfo
+			for _, pi := range replicas {
+				if !read[pi.PName()] {
+					unchecked = append(unchecked, pi)
+				}
+			}
+			go d.readRepair(context.Background(), key, file, missed, unchecked)
+		}
+		return file, nil
+	}
+	// the owner may be unavailable and the block is still a hint here
+	if ht, ok := d.hints.get(key); ok {
+		return DistributeFile{
+			data: ht.Value,
+			info: DistributeFileInfo{
+				BasicFileInfo: NewFileInfo(ht.Filename, ht.Key, "", int64(len(ht.Value)), false),
+				DPeerInfo:     d.self.Info().(DPeerInfo),
+			},
+		}, nil
+	}
+	if errors.Is(err, ErrFileNotFound) {
+		return d.recoverFile(ctx, key)
+	}
+	return nil, err
+}
+
+/*
+Store to every replica, a full replica spills over to the next peer.
+
+Return the last error if any replica failed.
+
+Use StoreBlock to know where the block landed.
+*/
+func (d *DFS) Store(ctx context.Context, key string, filename string, value []byte) error {
+	_, err := d.StoreBlock(ctx, key, filename, value)
+	return err
+}
+
+func (d *DFS) Delete(ctx context.Context, key string) error {
+	replicas := d.PickReplicas(key)
+	if len(replicas) == 0 {
+		return peers.ErrPeerNotFound
+	}
+	var err error
+	for _, pi := range replicas {
+		if e := d.deleteFrom(ctx, pi, key); e != nil {
+			log.Printf("[DFS] Delete %s from %s error: %s", key, pi.PName(), e)
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+Set options of DFS.
+
+opt - ReplicaPolicy, ReadRepairPolicy, AntiEntropyPolicy, HedgePolicy, RPCTimeout
+*/
+func (d *DFS) Set(opt any) error {
+	switch o := opt.(type) {
+	case ReplicaPolicy:
+		d.policy = o
+		return nil
+	case ReadRepairPolicy:
+		d.repairPolicy = o
+		return nil
+	case AntiEntropyPolicy:
+		d.antiEntropyPolicy = o
+		return nil
+	case HedgePolicy:
+		d.hedgePolicy = o
+		return nil
+	case RPCTimeout:
+		if p, ok := d.self.(interface{ SetTimeout(RPCTimeout) }); ok {
+			p.SetTimeout(o)
+		}
+		return nil
+	case BreakerPolicy:
+		if p, ok := d.self.(interface{ SetBreakerPolicy(BreakerPolicy) }); ok {
+			p.SetBreakerPolicy(o)
+		}
+		return nil
+	case RetryPolicy:
+		if p, ok := d.self.(interface{ SetRetryPolicy(RetryPolicy) }); ok {
+			p.SetRetryPolicy(o)
+		}
+		return nil
+	default:
+		return d.basicFileSystem.Set(opt)
+	}
+}
+
+func (d *DFS) getFrom(ctx context.Context, pi peers.PeerInfo, key string) (File, error) {
 	// get from local
 	if pi.Equal(d.self.Info()) {
 		log.Println("[DFS]Get from local.")
-		df, err := d.getLocally(key)
-		if errors.Is(err, ErrFileNotFound) {
-			return d.recoverFile(key)
-		} else {
-			return df, err
-		}
+		return d.getLocally(ctx, key)
 	}
 
 	// no peer
@@ -68,22 +220,23 @@ func (d *DFS) Get(key string) (File, error) {
 
 	// get from remote
 	log.Println("[DFS]Get from remote.")
-	resp := d.self.Get(pi, key)
+	start := time.Now()
+	resp := d.self.Get(ctx, pi, key)
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	d.latency.observe(pi, time.Since(start))
 	return DistributeFile{
 		data: resp.Data,
 		info: resp.Info.(DistributeFileInfo),
-	}, resp.Err
+	}, nil
 }
 
-func (d *DFS) Store(key string, filename string, value []byte) error {
-	pi := d.PickPeer(key)
-	if pi == nil {
-		return peers.ErrPeerNotFound
-	}
+func (d *DFS) storeTo(ctx context.Context, pi peers.PeerInfo, key string, filename string, value []byte) error {
 	// store locally
 	if pi.Equal(d.self.Info()) {
 		log.Println("[DFS]Store locally.")
-		return d.storeLocally(key, filename, value)
+		return d.storeLocally(ctx, key, filename, value)
 	}
 
 	// no peer
@@ -91,19 +244,51 @@ func (d *DFS) Store(key string, filename string, value []byte) error {
 		return fmt.Errorf("no peer for key %s", key)
 	}
 
+	// owner is known to be down, leave a hint
+	if !d.detector.IsOnline(pi) {
+		return d.storeHint(pi, key, filename, value)
+	}
+
 	// store remotely
 	log.Println("[DFS]Put to remote")
-	return d.self.Put(pi, key, filename, value).Err
+	err := d.self.Put(ctx, pi, key, filename, value).Err
+	if isPeerUnavailable(err) && ctx.Err() == nil {
+		d.detector.MarkOffline(pi)
+		return d.storeHint(pi, key, filename, value)
+	}
+	return err
 }
 
-func (d *DFS) Delete(key string) error {
-	pi := d.PickPeer(key)
-	if pi == nil {
-		return peers.ErrPeerNotFound
+/*
+Store value on pi itself, as storeTo without a hint,
+a shard must be on the peer its layout names.
+*/
+func (d *DFS) putTo(ctx context.Context, pi peers.PeerInfo, key string, filename string, value []byte) error {
+	if pi.Equal(d.self.Info()) {
+		return d.storeLocally(ctx, key, filename, value)
+	}
+	err := d.self.Put(ctx, pi, key, filename, value).Err
+	if isPeerUnavailable(err) && ctx.Err() == nil {
+		d.detector.MarkOffline(pi)
 	}
+	return err
+}
+
+func (d *DFS) storeHint(owner peers.PeerInfo, key string, filename string, value []byte) error {
+	log.Printf("[DFS] %s is unavailable, store %s as hint", owner.PName(), key)
+	return d.hints.store(owner, key, filename, value)
+}
+
+func (d *DFS) replayHints(owner peers.PeerInfo) {
+	d.hints.replay(owner, func(ht hint) error {
+		return d.self.Put(context.Background(), owner, ht.Key, ht.Filename, ht.Value).Err
+	})
+}
+
+func (d *DFS) deleteFrom(ctx context.Context, pi peers.PeerInfo, key string) error {
 	// delete locally
 	if pi.Equal(d.self.Info()) {
-		return d.deleteLocally(key)
+		return d.deleteLocally(ctx, key)
 	}
 
 	// no peer
@@ -112,11 +297,14 @@ func (d *DFS) Delete(key string) error {
 	}
 
 	// delete remotely
-	return d.self.Delete(pi, key).Err
+	return d.self.Delete(ctx, pi, key).Err
 }
 
-func (d *DFS) getLocally(key string) (DistributeFile, error) {
-	file, err := d.basicFileSystem.Get(key)
+func (d *DFS) getLocally(ctx context.Context, key string) (File, error) {
+	file, err := d.basicFileSystem.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	fi := file.Stat()
 	return DistributeFile{
 			data: file.Data(),
@@ -125,41 +313,85 @@ func (d *DFS) getLocally(key string) (DistributeFile, error) {
 		err
 }
 
-func (d *DFS) storeLocally(key string, filename string, value []byte) error {
-	return d.basicFileSystem.Store(key, filename, value)
+func (d *DFS) storeLocally(ctx context.Context, key string, filename string, value []byte) error {
+	return d.basicFileSystem.Store(ctx, key, filename, value)
+}
+
+func (d *DFS) deleteLocally(ctx context.Context, key string) error {
+	return d.basicFileSystem.Delete(ctx, key)
 }
 
-func (d *DFS) deleteLocally(key string) error {
-	return d.basicFileSystem.Delete(key)
+func (d *DFS) touchLocally(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return d.touch(key)
+}
+
+func (d *DFS) hasLocally(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	_, err := d.getFileInfo(key)
+	if errors.Is(err, ErrFileNotFound) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (d *DFS) Peer() peers.Peer {
 	return d.self
 }
 
+func (d *DFS) Metrics() map[string]int64 {
+	return d.metrics.Snapshot()
+}
+
 /*
-will happen when new peer join the cluster
+will happen when new peer join the cluster,
+the file is still on the peer that owned it before,
+which is the first peer after the replicas in preference order.
+
+The file will be written back to the replicas in background.
 */
-func (d *DFS) recoverFile(key string) (File, error) {
-	nextInfo := d.Peer().PNext(key)
-	if nextInfo == nil {
-		return nil, peers.ErrPeerNotFound
+func (d *DFS) recoverFile(ctx context.Context, key string) (File, error) {
+	replicas := d.PickReplicas(key)
+	var nextInfo peers.PeerInfo
+	for _, pi := range d.self.PickN(key, 0) {
+		if !containsPeer(replicas, pi) {
+			nextInfo = pi
+			break
+		}
 	}
-	if nextInfo.Equal(d.self.Info()) {
+	if nextInfo == nil {
 		return nil, ErrFileNotFound
 	}
-	// Get file info from next peer
-	resp := d.self.Get(nextInfo, key)
-	if resp.Err == nil {
-		// delete the wrong local file
-		return DistributeFile{
-			data: resp.Data,
-			info: resp.Info.(DistributeFileInfo),
-		}, nil
+	// Get file from next peer
+	file, err := d.getFrom(ctx, nextInfo, key)
+	if err != nil {
+		return nil, err
 	}
-	return nil, resp.Err
+	go d.writeBack(key, file, nextInfo, replicas)
+	return file, nil
 }
 
+/*
+Store file to its replicas,
+and delete it from the old owner if all replicas have it.
+*/
+func (d *DFS) writeBack(key string, file File, from peers.PeerInfo, replicas []peers.PeerInfo) {
+	for _, pi := range replicas {
+		if err := d.storeTo(context.Background(), pi, key, file.Stat().Name(), file.Data()); err != nil {
+			log.Printf("[DFS] Write back %s to %s error: %s", key, pi.PName(), err)
+			return
+		}
+	}
+	d.metrics.Inc(METRIC_RECOVER_WRITE_BACK)
+	// delete the file on the old owner
+	if err := d.deleteFrom(context.Background(), from, key); err != nil {
+		log.Printf("[DFS] Delete %s from old owner %s error: %s", key, from.PName(), err)
+	}
+}
 func (df DistributeFile) Data() []byte {
 	return df.data
 }
@@ -178,5 +410,30 @@ func (dfi DistributeFileInfo) SubDir() []SubInfo {
 
 func (d *DFS) Serve() {
 	log.Println("[DFS] Serve on ", d.self.PAddr())
-	newRpcServer(d).run(FILE_STORE_PORT)
+	go d.detector.run()
+	go d.runAntiEntropy()
+	l, err := d.port.listen(d.self.PAddr(), FILE_STORE_PORT)
+	if err != nil {
+		log.Println("[RPC Server] Listen error:", err)
+		return
+	}
+	newRpcServer(d).run(l, d.closing)
+}
+
+// bind the rpc port, so a port in use is known before Serve
+func (d *DFS) Listen() error {
+	_, err := d.port.listen(d.self.PAddr(), FILE_STORE_PORT)
+	return err
+}
+
+func (d *DFS) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closing)
+	})
+	d.detector.Close()
+	d.port.close()
+	if err := d.hints.Close(); err != nil {
+		log.Println("[DFS] Close hints error:", err)
+	}
+	return d.basicFileSystem.Close()
 }
@@ -1,8 +1,11 @@
 package fs_test
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 
@@ -33,10 +36,11 @@ var calcFileHash = func(data []byte) string {
 func TestDFSPut(t *testing.T) {
 	p := fs.NewDPeer("TestServer", "127.0.0.1", replicas, nil)
 	dfs := fs.NewDFS(p, rootPath, capacity, nil)
+	defer dfs.Close()
 	go dfs.Serve()
 	time.Sleep(time.Second)
 	hash := calcFileHash([]byte(testDFileData))
-	err := dfs.Store(hash, testDFileName, []byte(testDFileData))
+	err := dfs.Store(context.Background(), hash, testDFileName, []byte(testDFileData))
 	if err != nil {
 		t.Error(err)
 	}
@@ -46,10 +50,26 @@ func TestDFSPut(t *testing.T) {
 func TestDFSGet(t *testing.T) {
 	p := fs.NewDPeer("TestServer", "127.0.0.1", replicas, nil)
 	dfs := fs.NewDFS(p, rootPath, capacity, nil)
+	defer dfs.Close()
 	go dfs.Serve()
 	time.Sleep(time.Second)
 	hash := calcFileHash([]byte(testDFileData))
-	file, err := dfs.Get(hash)
+	file, err := dfs.Get(context.Background(), hash)
 	t.Logf("[Get Result]Info:%v,Error:%s", file.Stat(), err)
 	time.Sleep(time.Second * 5)
 }
+
+func TestDFSListenPortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+
+	dfs := fs.NewDFS(fs.NewDPeer("TestListen", addr, replicas, nil), t.TempDir(), capacity, nil)
+	defer dfs.Close()
+	if err := dfs.Listen(); err == nil {
+		t.Error("listen on a port in use succeeded")
+	}
+}
@@ -0,0 +1,274 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	DEFAULT_READ_AHEAD = 2
+)
+
+var (
+	ErrReaderClosed = errors.New("file reader is closed")
+)
+
+/*
+DownloadPolicy decides how FileReader fetches blocks.
+
+ReadAhead - blocks after the current one fetched in parallel, 0 disables it.
+
+Use Group.Set(DownloadPolicy{...}) to change it.
+*/
+type DownloadPolicy struct {
+	ReadAhead int
+}
+
+var DefaultDownloadPolicy = DownloadPolicy{
+	ReadAhead: DEFAULT_READ_AHEAD,
+}
+
+/*
+FileReader reads a file stored by Group.StoreFile,
+blocks are fetched when they are reached and verified by their size and checksum,
+inline content by InlineHash.
+
+It is not safe for concurrent use.
+*/
+type FileReader struct {
+	g    *Group
+	ctx  context.Context
+	meta Metadata
+
+	// blocks of the file, an inline file has one that is its content
+	blocks []Fileblock
+	inline []byte
+	// the inline content does not match InlineHash
+	inlineErr error
+
+	// offset of the first byte of each block
+	starts []int64
+	offset int64
+
+	readAhead int
+	fetches   map[int]*blockFetch
+	closed    bool
+}
+
+var _ io.ReadSeekCloser = (*FileReader)(nil)
+
+type blockFetch struct {
+	done  chan struct{}
+	batch *fetchBatch
+	once  sync.Once
+	data  []byte
+	err   error
+}
+
+// blocks fetched together, cancelled once the fetch of every one of them is
+type fetchBatch struct {
+	mu     sync.Mutex
+	left   int
+	cancel context.CancelFunc
+}
+
+func (f *blockFetch) cancel() {
+	f.once.Do(func() {
+		f.batch.mu.Lock()
+		defer f.batch.mu.Unlock()
+		if f.batch.left--; f.batch.left == 0 {
+			f.batch.cancel()
+		}
+	})
+}
+
+/*
+Open a file to read.
+
+fullpath - path of the file in the space, without META_FILE_SUFFIX
+*/
+func (g *Group) OpenFile(ctx context.Context, spaceKey, fullpath string) (*FileReader, error) {
+	meta, err := g.GetMetaData(ctx, filepath.Join(spaceKey, fullpath))
+	if err != nil {
+		return nil, err
+	}
+	return g.newFileReader(ctx, meta), nil
+}
+
+func (g *Group) newFileReader(ctx context.Context, meta Metadata) *FileReader {
+	r := &FileReader{
+		g:         g,
+		ctx:       ctx,
+		meta:      meta,
+		blocks:    meta.Blocks,
+		readAhead: g.download.ReadAhead,
+		fetches:   make(map[int]*blockFetch),
+	}
+	if meta.IsInline() {
+		r.blocks = []Fileblock{{Size: int64(len(meta.Inline)), Hash: meta.InlineHash}}
+		r.inline = meta.Inline
+		if blockChecksum(meta.Inline) != meta.InlineHash {
+			r.inlineErr = fmt.Errorf("%w: inline content", ErrBlockChecksum)
+		}
+	}
+	r.starts = make([]int64, len(r.blocks))
+	var start int64
+	for i, block := range r.blocks {
+		r.starts[i] = start
+		start += block.Size
+	}
+	return r
+}
+
+func (r *FileReader) Metadata() Metadata {
+	return r.meta
+}
+
+// sum of the block sizes
+func (r *FileReader) Size() int64 {
+	if len(r.starts) == 0 {
+		return 0
+	}
+	last := len(r.starts) - 1
+	return r.starts[last] + r.blocks[last].Size
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	if r.offset >= r.Size() {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	i := r.blockAt(r.offset)
+	data, err := r.block(i)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data[r.offset-r.starts[i]:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.Size()
+	default:
+		return 0, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek: negative offset %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// cancel the fetches of blocks
+func (r *FileReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for i, f := range r.fetches {
+		f.cancel()
+		delete(r.fetches, i)
+	}
+	return nil
+}
+
+// index of the block that holds offset, offset is less than Size
+func (r *FileReader) blockAt(offset int64) int {
+	return sort.Search(len(r.starts), func(i int) bool {
+		return r.starts[i] > offset
+	}) - 1
+}
+
+/*
+Data of block i, the next ReadAhead blocks are fetched in background.
+The window is fetched together when block i or the one after it is not fetched yet.
+
+Fetches outside this window are cancelled, so a seek does not keep blocks in memory.
+*/
+func (r *FileReader) block(i int) ([]byte, error) {
+	for j, f := range r.fetches {
+		if j < i || j > i+r.readAhead {
+			f.cancel()
+			delete(r.fetches, j)
+		}
+	}
+	if r.inline != nil {
+		return r.inline, r.inlineErr
+	}
+	_, fetching := r.fetches[i]
+	_, fetchingNext := r.fetches[i+1]
+	if !fetching || !fetchingNext {
+		var window []int
+		for j := i; j <= i+r.readAhead && j < len(r.blocks); j++ {
+			if _, ok := r.fetches[j]; !ok {
+				window = append(window, j)
+			}
+		}
+		r.fetch(window)
+	}
+
+	f := r.fetches[i]
+	select {
+	case <-f.done:
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	}
+	if f.err != nil {
+		// fetch it again on the next read
+		f.cancel()
+		delete(r.fetches, i)
+		return nil, f.err
+	}
+	return f.data, nil
+}
+
+// fetch blocks idx with one Group.getBlocksData
+func (r *FileReader) fetch(idx []int) {
+	if len(idx) == 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	batch := &fetchBatch{left: len(idx), cancel: cancel}
+	blocks := make([]Fileblock, 0, len(idx))
+	fetches := make([]*blockFetch, 0, len(idx))
+	for _, i := range idx {
+		f := &blockFetch{done: make(chan struct{}), batch: batch}
+		r.fetches[i] = f
+		blocks = append(blocks, r.blocks[i])
+		fetches = append(fetches, f)
+	}
+	go func() {
+		data, errs := r.g.getBlocksData(ctx, blocks)
+		for j, f := range fetches {
+			block := blocks[j]
+			err := errs[j]
+			if err == nil && int64(len(data[j])) != block.Size {
+				err = fmt.Errorf("block %d has %d bytes, want %d", block.BlockID, len(data[j]), block.Size)
+			}
+			if err == nil && block.Hash != "" && blockChecksum(data[j]) != block.Hash {
+				err = fmt.Errorf("%w: block %d", ErrBlockChecksum, block.BlockID)
+			}
+			f.data, f.err = data[j], err
+			close(f.done)
+		}
+	}()
+}
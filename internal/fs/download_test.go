@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFileReader(t *testing.T) {
+	g := newUploadGroup(t)
+	ctx := context.Background()
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), []Fileblock{
+		{BlockID: 0, Size: 10}, {BlockID: 1, Size: 16}, {BlockID: 2, Size: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := g.newFileReader(ctx, Metadata{Blocks: blocks, Size: int64(len(data))})
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// seek into the middle of a block and read across blocks
+	for _, offset := range []int64{0, 9, 10, 25, 35} {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		n, err := io.ReadFull(r, buf)
+		want := data[offset:]
+		if len(want) > 4 {
+			want = want[:4]
+		}
+		if !bytes.Equal(buf[:n], want) || (n < 4 && !errors.Is(err, io.ErrUnexpectedEOF)) {
+			t.Errorf("at %d got %q, %v, want %q", offset, buf[:n], err, want)
+		}
+	}
+	if pos, _ := r.Seek(-6, io.SeekEnd); pos != int64(len(data))-6 {
+		t.Errorf("got position %d", pos)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("negative offset accepted")
+	}
+	if len(r.fetches) > 1+DEFAULT_READ_AHEAD {
+		t.Errorf("%d blocks fetched", len(r.fetches))
+	}
+
+	// a block that does not match its checksum is refused
+	d := g.StoreSystems[0].(*DFS)
+	for _, addr := range blocks[1].Locations() {
+		d.deleteFrom(ctx, d.peerAt(addr), blocks[1].Hash)
+		d.storeTo(ctx, d.peerAt(addr), blocks[1].Hash, blocks[1].Hash, bytes.Repeat([]byte("x"), 16))
+	}
+	bad := g.newFileReader(ctx, Metadata{Blocks: blocks})
+	defer bad.Close()
+	bad.Seek(12, io.SeekStart)
+	if _, err := bad.Read(make([]byte, 4)); !errors.Is(err, ErrBlockChecksum) {
+		t.Errorf("got %v, want ErrBlockChecksum", err)
+	}
+}
+
+// blocks and inline content that do not match the metadata are refused
+func TestFileReaderMismatch(t *testing.T) {
+	g := newUploadGroup(t)
+	ctx := context.Background()
+
+	data := []byte("0123456789abcdefghij")
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), []Fileblock{
+		{BlockID: 0, Size: 10}, {BlockID: 1, Size: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{4, 16} {
+		wrong := append([]Fileblock{}, blocks...)
+		wrong[1].Size = size
+		r := g.newFileReader(ctx, Metadata{Blocks: wrong})
+		r.Seek(10+size-1, io.SeekStart)
+		if _, err := r.Read(make([]byte, 4)); err == nil {
+			t.Errorf("block of %d bytes read as %d", 10, size)
+		}
+		r.Close()
+	}
+
+	inline := []byte("inline content")
+	r := g.newFileReader(ctx, Metadata{Inline: inline, InlineHash: blockChecksum([]byte("other")), Size: int64(len(inline))})
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrBlockChecksum) {
+		t.Errorf("got %v, want ErrBlockChecksum", err)
+	}
+	r = g.newFileReader(ctx, Metadata{Inline: inline, InlineHash: blockChecksum(inline), Size: int64(len(inline))})
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, inline) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+// blocks of a file take one batch call per peer, not one call per block
+func TestFileBlocksBatched(t *testing.T) {
+	d, p := newMemDFS(t, "batchpeer", 40, 4)
+	g := NewGroup("batch", nil)
+	g.UseFS(d)
+	g.Set(UploadPolicy{Concurrency: 8, Verify: true})
+	g.Set(DownloadPolicy{ReadAhead: 7})
+	ctx := context.Background()
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJ")
+	var sizes []Fileblock
+	for i := 0; i < 8; i++ {
+		sizes = append(sizes, Fileblock{BlockID: int64(i), Size: 7})
+	}
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.called("Put"); n != 0 {
+		t.Errorf("%d blocks put one by one", n)
+	}
+	if n := p.called("BatchPut"); n == 0 || n > 3 {
+		t.Errorf("%d batch puts for 3 remote peers", n)
+	}
+	for _, block := range blocks {
+		if len(block.Locations()) == 0 {
+			t.Fatalf("block %d has no locations", block.BlockID)
+		}
+	}
+
+	r := g.newFileReader(ctx, Metadata{Blocks: blocks})
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if n := p.called("Get"); n != 0 {
+		t.Errorf("%d blocks got one by one", n)
+	}
+}
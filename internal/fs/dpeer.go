@@ -4,13 +4,21 @@ import (
 	"context"
 	"log"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
+
+	"github.com/ciiim/cloudborad/internal/fs/fspb"
 )
 
 type DPeer struct {
 	info    DPeerInfo
 	hashMap *peers.CMap
+
+	// shared by copies of the peer
+	timeout  *atomic.Pointer[RPCTimeout]
+	breakers *breakerSet
 }
 
 var _ peers.Peer = (*DPeer)(nil)
@@ -19,38 +27,61 @@ type DPeerInfo struct {
 	PeerName string             `json:"peer_name"`
 	PeerAddr string             `json:"peer_addr"` //include port e.g. 10.10.1.5:9631
 	PeerStat peers.PeerStatType `json:"peer_stat"`
+	Topology
 }
 
-func NewDPeerInfo(name, addr string) DPeerInfo {
-	return DPeerInfo{
+/*
+Topology labels of a peer.
+
+Replicas of a block will not be placed in the same failure domain
+if there are enough domains, see ReplicaPolicy.
+*/
+type Topology struct {
+	Zone string `json:"zone,omitempty"`
+	Rack string `json:"rack,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+func NewDPeerInfo(name, addr string, topology ...Topology) DPeerInfo {
+	pi := DPeerInfo{
 		PeerName: name,
 		PeerAddr: addr,
 		PeerStat: peers.P_STAT_ONLINE,
 	}
+	if len(topology) == 1 {
+		pi.Topology = topology[0]
+	}
+	return pi
 }
 
 var _ peers.PeerInfo = (*DPeerInfo)(nil)
 
-func NewDPeer(name, addr string, replicas int, peersHashFn peers.CHash) *DPeer {
+func NewDPeer(name, addr string, replicas int, peersHashFn peers.CHash, topology ...Topology) *DPeer {
 	dlog.debug("NewDPeer", "name: %s, addr: %s", name, addr)
-	info := DPeerInfo{
-		PeerName: name,
-		PeerAddr: addr,
-		PeerStat: peers.P_STAT_ONLINE,
-	}
+	info := NewDPeerInfo(name, addr, topology...)
+	t := DefaultRPCTimeout
+	timeout := &atomic.Pointer[RPCTimeout]{}
+	timeout.Store(&t)
 	p := &DPeer{
-		info:    info,
-		hashMap: peers.NewCMap(replicas, peersHashFn),
+		info:     info,
+		hashMap:  peers.NewCMap(replicas, peersHashFn),
+		timeout:  timeout,
+		breakers: newBreakerSet(),
 	}
 	p.hashMap.Add(info)
 	return p
 }
 
-func (p DPeer) Get(pi peers.PeerInfo, key string) peers.PeerResult {
+func (p DPeer) Get(ctx context.Context, pi peers.PeerInfo, key string) peers.PeerResult {
 	client := newRpcClient(p.info.Port())
-	ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
-	defer cancel()
-	file, err := client.get(ctx, pi, key)
+	var file File
+	err := p.call(ctx, pi, true, p.Timeout().Get, func(ctx context.Context) (err error) {
+		file, err = client.get(ctx, pi, key)
+		return err
+	})
+	if err != nil {
+		return peers.PeerResult{Err: err}
+	}
 	return peers.PeerResult{
 		Err:  err,
 		Data: file.Data(),
@@ -59,26 +90,150 @@ func (p DPeer) Get(pi peers.PeerInfo, key string) peers.PeerResult {
 	}
 }
 
-func (p DPeer) Put(pi peers.PeerInfo, key string, filename string, value []byte) peers.PeerResult {
+func (p DPeer) Put(ctx context.Context, pi peers.PeerInfo, key string, filename string, value []byte) peers.PeerResult {
 	res := peers.PeerResult{}
 	client := newRpcClient(p.info.Port())
 
-	ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
-	defer cancel()
-	res.Err = client.put(ctx, pi, key, filename, value)
+	res.Err = p.call(ctx, pi, false, p.Timeout().forPut(len(value)), func(ctx context.Context) error {
+		return client.put(ctx, pi, key, filename, value)
+	})
 	return res
 }
 
-func (p DPeer) Delete(pi peers.PeerInfo, key string) peers.PeerResult {
+func (p DPeer) Delete(ctx context.Context, pi peers.PeerInfo, key string) peers.PeerResult {
 	res := peers.PeerResult{}
 	client := newRpcClient(p.info.Port())
 
-	ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
-	defer cancel()
-	res.Err = client.delete(ctx, pi, key)
+	res.Err = p.call(ctx, pi, true, p.Timeout().Delete, func(ctx context.Context) error {
+		return client.delete(ctx, pi, key)
+	})
 	return res
 }
 
+func (p DPeer) Has(ctx context.Context, pi peers.PeerInfo, key string) (exists bool, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Stat, func(ctx context.Context) (err error) {
+		exists, err = client.has(ctx, pi, key)
+		return err
+	})
+	return exists, err
+}
+
+func (p DPeer) BatchGet(ctx context.Context, pi peers.PeerInfo, keys []string) (results []BatchResult, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Get, func(ctx context.Context) (err error) {
+		results, err = client.batchGet(ctx, pi, keys)
+		return err
+	})
+	return results, err
+}
+
+func (p DPeer) BatchPut(ctx context.Context, pi peers.PeerInfo, items []BatchItem) (results []BatchResult, err error) {
+	client := newRpcClient(p.info.Port())
+	var size int
+	for _, item := range items {
+		size += len(item.Value)
+	}
+	err = p.call(ctx, pi, false, p.Timeout().forPut(size), func(ctx context.Context) (err error) {
+		results, err = client.batchPut(ctx, pi, items)
+		return err
+	})
+	return results, err
+}
+
+func (p DPeer) BatchDelete(ctx context.Context, pi peers.PeerInfo, keys []string) (results []BatchResult, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Delete, func(ctx context.Context) (err error) {
+		results, err = client.batchDelete(ctx, pi, keys)
+		return err
+	})
+	return results, err
+}
+
+// keys that are stored on pi
+func (p DPeer) BatchHas(ctx context.Context, pi peers.PeerInfo, keys []string) (exists []string, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Stat, func(ctx context.Context) (err error) {
+		exists, err = client.batchHas(ctx, pi, keys)
+		return err
+	})
+	return exists, err
+}
+
+// BatchHas that refreshes the mod time of the keys, see blockToucher
+func (p DPeer) BatchTouch(ctx context.Context, pi peers.PeerInfo, keys []string) (exists []string, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Stat, func(ctx context.Context) (err error) {
+		exists, err = client.batchTouch(ctx, pi, keys)
+		return err
+	})
+	return exists, err
+}
+
+// keys referenced by metadata stored on pi, see refSource
+func (p DPeer) ListRefs(ctx context.Context, pi peers.PeerInfo) (keys []string, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Sync, func(ctx context.Context) (err error) {
+		keys, err = client.listRefs(ctx, pi)
+		return err
+	})
+	return keys, err
+}
+
+/*
+Call fn through the circuit breaker of pi,
+d is the timeout of each attempt.
+
+idempotent - retry unavailable errors, see RetryPolicy
+*/
+func (p DPeer) call(ctx context.Context, pi peers.PeerInfo, idempotent bool, d time.Duration, fn func(ctx context.Context) error) error {
+	if p.breakers == nil {
+		ctx, cancel := withTimeout(ctx, d)
+		defer cancel()
+		return fn(ctx)
+	}
+	return p.breakers.call(ctx, pi, idempotent, d, fn)
+}
+
+// Change breaker policy of this peer and all its copies
+func (p DPeer) SetBreakerPolicy(policy BreakerPolicy) {
+	if p.breakers != nil {
+		p.breakers.setPolicy(policy)
+	}
+}
+
+// Change retry policy of this peer and all its copies
+func (p DPeer) SetRetryPolicy(policy RetryPolicy) {
+	if p.breakers != nil {
+		p.breakers.setRetry(policy)
+	}
+}
+
+// breaker state of every peer this peer has called
+func (p DPeer) BreakerStates() map[string]BreakerState {
+	if p.breakers == nil {
+		return nil
+	}
+	return p.breakers.states()
+}
+
+/*
+Change rpc timeouts of this peer and all its copies,
+a deadline set by the caller's context always wins.
+*/
+func (p DPeer) SetTimeout(t RPCTimeout) {
+	if p.timeout != nil {
+		p.timeout.Store(&t)
+	}
+}
+
+func (p DPeer) Timeout() RPCTimeout {
+	if p.timeout == nil {
+		return DefaultRPCTimeout
+	}
+	return *p.timeout.Load()
+}
+
 func (p DPeer) PName() string {
 	return p.info.PeerName
 }
@@ -91,6 +246,10 @@ func (p DPeer) Pick(key string) peers.PeerInfo {
 	return p.hashMap.Get(key)
 }
 
+func (p DPeer) PickN(key string, n int) []peers.PeerInfo {
+	return p.hashMap.GetN(key, n)
+}
+
 func (p DPeer) PAdd(pis ...peers.PeerInfo) {
 	p.hashMap.Add(pis...)
 }
@@ -114,7 +273,7 @@ func (p DPeer) PSync(pi_in peers.PeerInfo, action peers.PeerActionType) error {
 	case peers.P_ACTION_JOIN:
 		// notify other peers - action P_ACTION_NEW
 		client := newRpcClient(pi_in.Port())
-		ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
+		ctx, cancel := context.WithTimeout(context.Background(), p.Timeout().Sync)
 		defer cancel()
 		list := p.PList()
 		err = client.peerActionTo(ctx, pi_in, peers.P_ACTION_NEW, list...)
@@ -124,6 +283,9 @@ func (p DPeer) PSync(pi_in peers.PeerInfo, action peers.PeerActionType) error {
 	case peers.P_ACTION_NEW:
 		// add peer to hashMap
 		p.PAdd(pi_in)
+	case peers.P_ACTION_UPDATE:
+		// e.g. peer is draining
+		p.hashMap.Update(pi_in)
 	}
 	return err
 }
@@ -136,24 +298,81 @@ pi_to - destination peer
 func (p DPeer) PActionTo(action peers.PeerActionType, pi_to ...peers.PeerInfo) error {
 	dlog.debug("PActionTo", "action: %s, pi_to: %v", action.String(), pi_to)
 	client := newRpcClient(p.info.Port())
-	ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout().Sync)
 	defer cancel()
 	return client.peerActionTo(ctx, p.info, action, pi_to...)
 }
 
-func (p DPeer) GetPeerListFromPeer(pi peers.PeerInfo) []peers.PeerInfo {
+/*
+change the stat of this peer in hash map,
+and notify other peers with P_ACTION_UPDATE.
+*/
+func (p DPeer) PSetStat(stat peers.PeerStatType) error {
+	dlog.debug("PSetStat", "stat: %d", stat)
+	info := p.info
+	info.PeerStat = stat
+	p.hashMap.Update(info)
 	client := newRpcClient(p.info.Port())
-	ctx, cancel := context.WithTimeout(context.Background(), _RPC_TIMEOUT)
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout().Sync)
 	defer cancel()
-	list, err := client.getPeerList(ctx, pi)
+	return client.peerActionTo(ctx, info, peers.P_ACTION_UPDATE, withoutPeer(p.PList(), p.info)...)
+}
+
+func (p DPeer) GetPeerListFromPeer(pi peers.PeerInfo) []peers.PeerInfo {
+	client := newRpcClient(p.info.Port())
+	var list []peers.PeerInfo
+	err := p.call(context.Background(), pi, true, p.Timeout().Sync, func(ctx context.Context) (err error) {
+		list, err = client.getPeerList(ctx, pi)
+		return err
+	})
 	if err != nil {
 		return nil
 	}
-	peerList := make([]peers.PeerInfo, 0, len(list))
-	for _, v := range list {
-		peerList = append(peerList, NewDPeerInfo(v.PName(), v.PAddr()))
+	return list
+}
+
+/*
+Ping is not stopped by the circuit breaker,
+the failure detector uses it to find peers that are back,
+and a successful ping closes the breaker.
+*/
+func (p DPeer) PPing(pi peers.PeerInfo) error {
+	client := newRpcClient(p.info.Port())
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout().Stat)
+	defer cancel()
+	err := client.ping(ctx, pi)
+	if p.breakers != nil {
+		policy, _ := p.breakers.policies()
+		p.breakers.get(pi).record(policy, isPeerUnavailable(err))
 	}
-	return peerList
+	return err
+}
+
+func (p DPeer) Stats(ctx context.Context, pi peers.PeerInfo) (stats NodeStats, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, false, p.Timeout().Stat, func(ctx context.Context) (err error) {
+		stats, err = client.stats(ctx, pi)
+		return err
+	})
+	return stats, err
+}
+
+func (p DPeer) MerkleTree(ctx context.Context, pi peers.PeerInfo) (tree *merkleTree, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Get, func(ctx context.Context) (err error) {
+		tree, err = client.merkleTree(ctx, pi, p.info)
+		return err
+	})
+	return tree, err
+}
+
+func (p DPeer) ListKeys(ctx context.Context, pi peers.PeerInfo, buckets []int) (entries []keyEntry, err error) {
+	client := newRpcClient(p.info.Port())
+	err = p.call(ctx, pi, true, p.Timeout().Get, func(ctx context.Context) (err error) {
+		entries, err = client.listKeys(ctx, pi, p.info, buckets)
+		return err
+	})
+	return entries, err
 }
 
 func (p DPeer) PNext(key string) peers.PeerInfo {
@@ -192,3 +411,34 @@ func (pi DPeerInfo) Port() string {
 	}
 	return t[len(t)-1]
 }
+
+func dPeerInfoToPBPeerInfo(pi peers.PeerInfo, action peers.PeerActionType) *fspb.PeerInfo {
+	pbi := &fspb.PeerInfo{
+		Name:   pi.PName(),
+		Addr:   pi.PAddr(),
+		Stat:   int64(pi.PStat()),
+		Action: int64(action),
+	}
+	if dpi, ok := pi.(DPeerInfo); ok {
+		pbi.Zone = dpi.Zone
+		pbi.Rack = dpi.Rack
+		pbi.Host = dpi.Host
+	}
+	return pbi
+}
+
+func pbPeerInfoToDPeerInfo(pbi *fspb.PeerInfo) DPeerInfo {
+	if pbi == nil {
+		return DPeerInfo{}
+	}
+	return DPeerInfo{
+		PeerName: pbi.Name,
+		PeerAddr: pbi.Addr,
+		PeerStat: peers.PeerStatType(pbi.Stat),
+		Topology: Topology{
+			Zone: pbi.Zone,
+			Rack: pbi.Rack,
+			Host: pbi.Host,
+		},
+	}
+}
@@ -1,9 +1,13 @@
 package fs
 
 import (
+	"context"
 	"errors"
+	"io/fs"
 	"log"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
 )
@@ -17,6 +21,10 @@ const (
 type DTFS struct {
 	*treeFS
 	self DPeer
+
+	port      rpcPort
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 type DTreeFile struct {
@@ -34,8 +42,9 @@ var _ DistributeFileSystem = (*DTFS)(nil)
 
 func NewDTFS(self DPeer, rootPath string) *DTFS {
 	dtfs := &DTFS{
-		self:   self,
-		treeFS: NewTreeFS(rootPath),
+		self:    self,
+		treeFS:  NewTreeFS(rootPath),
+		closing: make(chan struct{}),
 	}
 	return dtfs
 
@@ -45,8 +54,17 @@ func (dt *DTFS) AddPeer(pi ...peers.PeerInfo) {
 	dt.self.PAdd(pi...)
 }
 
-func (dt *DTFS) PickPeer(key string) peers.PeerInfo {
-	return dt.self.Pick(key)
+/*
+The peer that owns the space.
+
+Draining peer is skipped, it will not accept new writes.
+*/
+func (dt *DTFS) PickPeer(spaceKey string) peers.PeerInfo {
+	list := withoutDraining(dt.self.PickN(spaceKey, 0))
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
 }
 
 /*
@@ -60,34 +78,64 @@ if need to create a space, key and name should be the same.
 
 value - file content. dir should be nil.
 */
-func (dt *DTFS) Store(key, name string, value []byte) error {
+func (dt *DTFS) Store(ctx context.Context, key, name string, value []byte) error {
 	pi := dt.PickPeer(key)
 	if pi == nil {
 		return peers.ErrPeerNotFound
 	}
 	if pi.Equal(dt.self.info) {
-		return dt.storeLocally(key, name, value)
+		return dt.storeLocally(ctx, key, name, value)
 	}
 
-	return dt.self.Put(pi, key, name, value).Err
+	return dt.self.Put(ctx, pi, key, name, value).Err
+}
+
+/*
+Peers that may hold a space, the owner Store writes to first,
+then the ring owner if it is draining and its spaces may not be moved yet.
+*/
+func (dt *DTFS) owners(spaceKey string) []peers.PeerInfo {
+	var list []peers.PeerInfo
+	if pi := dt.PickPeer(spaceKey); pi != nil {
+		list = append(list, pi)
+	}
+	if old := dt.self.Pick(spaceKey); old != nil && (len(list) == 0 || !old.Equal(list[0])) {
+		list = append(list, old)
+	}
+	return list
 }
 
 // key - format: spacekey/fullpath
-func (dt *DTFS) Get(key string) (File, error) {
-	spacekey, path := splitKey(key)
-	pi := dt.PickPeer(key)
-	if pi == nil {
+func (dt *DTFS) Get(ctx context.Context, key string) (File, error) {
+	spacekey, _ := splitKey(key)
+	owners := dt.owners(spacekey)
+	if len(owners) == 0 {
 		return nil, peers.ErrPeerNotFound
 	}
+	var err error
+	for _, pi := range owners {
+		df, e := dt.getFrom(ctx, pi, key)
+		if e == nil {
+			return df, nil
+		}
+		// the error of the new owner is kept
+		if err == nil {
+			err = e
+		}
+	}
+	return nil, err
+}
+
+func (dt *DTFS) getFrom(ctx context.Context, pi peers.PeerInfo, key string) (File, error) {
 	if pi.Equal(dt.self.info) {
-		df, err := dt.getLocally(spacekey, path)
+		df, err := dt.getLocally(ctx, key)
 		if errors.Is(err, ErrFileNotFound) {
-			return dt.recoverFile(key)
+			return dt.recoverFile(ctx, key)
 		} else {
 			return df, err
 		}
 	}
-	resp := dt.self.Get(pi, key)
+	resp := dt.self.Get(ctx, pi, key)
 	if resp.Err != nil {
 		return nil, resp.Err
 	}
@@ -99,18 +147,35 @@ func (dt *DTFS) Get(key string) (File, error) {
 	return df, resp.Err
 }
 
-func (dt *DTFS) Delete(key string) error {
-	pi := dt.PickPeer(key)
-	if pi == nil {
+// delete on every owner, Get falls back to the old one
+func (dt *DTFS) Delete(ctx context.Context, key string) error {
+	spacekey, _ := splitKey(key)
+	owners := dt.owners(spacekey)
+	if len(owners) == 0 {
 		return peers.ErrPeerNotFound
 	}
+	err := dt.deleteFrom(ctx, owners[0], key)
+	for _, pi := range owners[1:] {
+		// a space not moved yet is only on the old owner
+		if e := dt.deleteFrom(ctx, pi, key); e == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (dt *DTFS) deleteFrom(ctx context.Context, pi peers.PeerInfo, key string) error {
 	if pi.Equal(dt.self.info) {
-		return dt.deleteLocally(key)
+		return dt.deleteLocally(ctx, key)
 	}
-	return dt.self.Delete(pi, key).Err
+	return dt.self.Delete(ctx, pi, key).Err
 }
 
 func (dt *DTFS) Close() (err error) {
+	dt.closeOnce.Do(func() {
+		close(dt.closing)
+	})
+	dt.port.close()
 	for _, s := range dt.openSpaces {
 		if e := s.Close(); err != nil {
 			err = e
@@ -121,7 +186,10 @@ func (dt *DTFS) Close() (err error) {
 	return err
 }
 
-func (dt *DTFS) storeLocally(spacekey string, fullpath string, data []byte) error {
+func (dt *DTFS) storeLocally(ctx context.Context, spacekey string, fullpath string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if fullpath == NEW_SPACE {
 		_, err := dt.NewSpace(spacekey, SPACE_DEFAULT_CAP)
 		return err
@@ -133,8 +201,13 @@ func (dt *DTFS) storeLocally(spacekey string, fullpath string, data []byte) erro
 	return space.Store(fullpath, data)
 }
 
-func (dt *DTFS) getLocally(key string, fullpath string) (File, error) {
-	space := dt.GetSpace(key)
+// key - format: spacekey/fullpath
+func (dt *DTFS) getLocally(ctx context.Context, key string) (File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	spacekey, fullpath := splitKey(key)
+	space := dt.GetSpace(spacekey)
 	if space == nil {
 		return nil, ErrSpaceNotFound
 	}
@@ -145,13 +218,33 @@ func (dt *DTFS) getLocally(key string, fullpath string) (File, error) {
 	return f, nil
 }
 
+// key - format: spacekey/fullpath
+func (dt *DTFS) hasLocally(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	spacekey, fullpath := splitKey(key)
+	space := dt.GetSpace(spacekey)
+	if space == nil {
+		return false, nil
+	}
+	_, err := os.Stat(space.getFullPath(fullpath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 /*
 key - format: sapcekey/fullpath
 
 e.g. "user/1/2/3" -> "user", "1/2/3",
 will delete "1/2/3" from "user" space.
 */
-func (dt *DTFS) deleteLocally(key string) error {
+func (dt *DTFS) deleteLocally(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	spacekey, path := splitKey(key)
 	space := dt.GetSpace(spacekey)
 	if space == nil {
@@ -161,7 +254,15 @@ func (dt *DTFS) deleteLocally(key string) error {
 }
 
 func (dt *DTFS) Set(opt any) error {
-	//TODO: set options
+	switch o := opt.(type) {
+	case RPCTimeout:
+		dt.self.SetTimeout(o)
+	case BreakerPolicy:
+		dt.self.SetBreakerPolicy(o)
+	case RetryPolicy:
+		dt.self.SetRetryPolicy(o)
+	}
+	//TODO: set other options
 	return nil
 }
 
@@ -169,7 +270,7 @@ func (dt *DTFS) Peer() peers.Peer {
 	return dt.self
 }
 
-func (dt *DTFS) recoverFile(key string) (File, error) {
+func (dt *DTFS) recoverFile(ctx context.Context, key string) (File, error) {
 	nextInfo := dt.Peer().PNext(key)
 	if nextInfo == nil {
 		return nil, peers.ErrPeerNotFound
@@ -178,10 +279,10 @@ func (dt *DTFS) recoverFile(key string) (File, error) {
 		return nil, ErrFileNotFound
 	}
 	// Get file info from next peer
-	resp := dt.self.Get(nextInfo, key)
+	resp := dt.self.Get(ctx, nextInfo, key)
 	if resp.Err == nil {
 		// delete the wrong local file
-		dt.self.Delete(nextInfo, key)
+		dt.self.Delete(ctx, nextInfo, key)
 		return DTreeFile{
 			data: resp.Data,
 			info: resp.Info.(DTreeFileInfo),
@@ -216,5 +317,16 @@ func (dfi DTreeFileInfo) SubDir() []SubInfo {
 
 func (dt *DTFS) Serve() {
 	log.Println("[DTFS] Serve on ", dt.self.PAddr())
-	newRpcServer(dt).run(FRONT_PORT)
+	l, err := dt.port.listen(dt.self.PAddr(), FRONT_PORT)
+	if err != nil {
+		log.Println("[RPC Server] Listen error:", err)
+		return
+	}
+	newRpcServer(dt).run(l, dt.closing)
+}
+
+// bind the rpc port, so a port in use is known before Serve
+func (dt *DTFS) Listen() error {
+	_, err := dt.port.listen(dt.self.PAddr(), FRONT_PORT)
+	return err
 }
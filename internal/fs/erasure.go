@@ -0,0 +1,476 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	DEFAULT_EC_DATA_SHARDS   = 4
+	DEFAULT_EC_PARITY_SHARDS = 2
+
+	// blocks with lost shards waiting for reconstruction
+	SHARD_REPAIR_QUEUE   = 64
+	SHARD_REPAIR_TIMEOUT = time.Minute
+
+	DEFAULT_SHARD_RELOCATE_AFTER = time.Minute * 30
+	// time between two scans for shards of offline peers
+	SHARD_RELOCATE_INTERVAL = time.Minute * 10
+	SHARD_RELOCATE_TIMEOUT  = time.Hour
+)
+
+var (
+	ErrNotEnoughShards = errors.New("not enough shards to rebuild the block")
+	ErrNotEnoughPeers  = errors.New("not enough peers for the shards")
+	ErrShardCorrupted  = errors.New("shard checksum mismatch")
+)
+
+/*
+ErasurePolicy decides how Group stores new blocks.
+
+Each block is split into DataShards data shards and ParityShards parity shards
+with Reed-Solomon, every shard is stored on a distinct peer,
+any DataShards of them rebuild the block.
+
+DataShards <= 0 stores full replicas, see ReplicaPolicy, it is the default.
+
+RelocateAfter - shards of a peer offline for this long are rebuilt on other peers
+in background and the metadata of their files is saved, see Group.RepairFile.
+0 never moves them.
+
+Use Group.Set(DefaultErasurePolicy) to turn it on,
+blocks stored before keep their layout.
+*/
+type ErasurePolicy struct {
+	DataShards    int
+	ParityShards  int
+	RelocateAfter time.Duration
+}
+
+var DefaultErasurePolicy = ErasurePolicy{
+	DataShards:    DEFAULT_EC_DATA_SHARDS,
+	ParityShards:  DEFAULT_EC_PARITY_SHARDS,
+	RelocateAfter: DEFAULT_SHARD_RELOCATE_AFTER,
+}
+
+/*
+ErasureCoder stores blocks as shards, see ErasurePolicy.
+
+GetShards returns the indexes of shards it could not read,
+the block is still returned if enough shards are left.
+
+RepairShards stores lost shards again from the others,
+relocate - move shards of unreachable peers to other peers,
+the returned layout must be saved then.
+
+Implemented by DFS.
+*/
+type ErasureCoder interface {
+	StoreShards(ctx context.Context, key string, value []byte, policy ErasurePolicy) (*ErasureLayout, error)
+	GetShards(ctx context.Context, layout *ErasureLayout, size int64) ([]byte, []int, error)
+	RepairShards(ctx context.Context, key string, layout *ErasureLayout, relocate bool) (*ErasureLayout, error)
+	DeleteShards(ctx context.Context, layout *ErasureLayout) error
+}
+
+var _ ErasureCoder = (*DFS)(nil)
+
+// implemented by DFS, true if a shard of layout is on a peer offline for longer than after
+type shardWatcher interface {
+	shardsOffline(layout *ErasureLayout, after time.Duration, now time.Time) bool
+}
+
+var _ shardWatcher = (*DFS)(nil)
+
+// online peers in preference order of key, skip draining ones and addrs in used
+func (d *DFS) shardPeers(key string, used map[string]bool) []peers.PeerInfo {
+	var list []peers.PeerInfo
+	for _, pi := range withoutDraining(d.self.PickN(key, 0)) {
+		if d.detector.IsOnline(pi) && !used[pi.PAddr()] {
+			list = append(list, pi)
+		}
+	}
+	return list
+}
+
+/*
+Encode value and store every shard on a distinct peer,
+a peer that fails moves its shard to the next spare peer.
+*/
+func (d *DFS) StoreShards(ctx context.Context, key string, value []byte, policy ErasurePolicy) (*ErasureLayout, error) {
+	enc, err := reedsolomon.New(policy.DataShards, policy.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	shards, err := enc.Split(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	candidates := d.shardPeers(key, nil)
+	if len(candidates) < len(shards) {
+		return nil, fmt.Errorf("%w: %d shards, %d peers", ErrNotEnoughPeers, len(shards), len(candidates))
+	}
+
+	layout := &ErasureLayout{
+		DataShards:   policy.DataShards,
+		ParityShards: policy.ParityShards,
+		ShardSize:    int64(len(shards[0])),
+		Shards:       make([]Fileshard, len(shards)),
+	}
+	var mu sync.Mutex
+	spare := candidates[len(shards):]
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i := range shards {
+		go func(i int, pi peers.PeerInfo) {
+			defer wg.Done()
+			shard := Fileshard{Index: i, Hash: blockChecksum(shards[i]), Key: shardKey(key, i)}
+			for {
+				e := d.putTo(ctx, pi, shard.Key, shard.fileName(), shards[i])
+				if e == nil {
+					shard.Location = pi.PAddr()
+					layout.Shards[i] = shard
+					return
+				}
+				log.Printf("[DFS] Store shard %d of %s to %s error: %s", i, key, pi.PName(), e)
+				mu.Lock()
+				if len(spare) == 0 || ctx.Err() != nil {
+					err = e
+					mu.Unlock()
+					return
+				}
+				pi, spare = spare[0], spare[1:]
+				mu.Unlock()
+			}
+		}(i, candidates[i])
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+func (d *DFS) getShard(ctx context.Context, layout *ErasureLayout, i int) ([]byte, error) {
+	shard := layout.Shards[i]
+	file, err := d.getFrom(ctx, d.peerAt(shard.Location), shard.Key)
+	if err != nil {
+		return nil, err
+	}
+	data := file.Data()
+	if int64(len(data)) != layout.ShardSize || blockChecksum(data) != shard.Hash {
+		return nil, ErrShardCorrupted
+	}
+	return data, nil
+}
+
+// read shards of these indexes in parallel into shards, return their errors
+func (d *DFS) getShards(ctx context.Context, layout *ErasureLayout, indexes []int, shards [][]byte) []error {
+	errs := make([]error, len(indexes))
+	var wg sync.WaitGroup
+	wg.Add(len(indexes))
+	for n, i := range indexes {
+		go func(n, i int) {
+			defer wg.Done()
+			shards[i], errs[n] = d.getShard(ctx, layout, i)
+		}(n, i)
+	}
+	wg.Wait()
+	return errs
+}
+
+/*
+Read data shards first, every shard that fails is replaced by a parity shard,
+lost data shards are rebuilt from the parity shards.
+*/
+func (d *DFS) GetShards(ctx context.Context, layout *ErasureLayout, size int64) ([]byte, []int, error) {
+	enc, err := reedsolomon.New(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	shards := make([][]byte, len(layout.Shards))
+	var lost []int
+	good, next := 0, 0
+	for good < layout.DataShards && next < len(shards) {
+		if err := ctx.Err(); err != nil {
+			return nil, lost, err
+		}
+		// ask as many shards as still needed
+		var indexes []int
+		for next < len(shards) && len(indexes) < layout.DataShards-good {
+			indexes = append(indexes, next)
+			next++
+		}
+		for n, e := range d.getShards(ctx, layout, indexes, shards) {
+			if e != nil {
+				log.Printf("[DFS] Get shard %d error: %s", indexes[n], e)
+				lost = append(lost, indexes[n])
+				continue
+			}
+			good++
+		}
+	}
+	if good < layout.DataShards {
+		return nil, lost, fmt.Errorf("%w: %d of %d", ErrNotEnoughShards, good, layout.DataShards)
+	}
+	if len(lost) > 0 {
+		d.metrics.Inc(METRIC_EC_DEGRADED_READ)
+		if err := enc.ReconstructData(shards); err != nil {
+			return nil, lost, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := enc.Join(&buf, shards, int(size)); err != nil {
+		return nil, lost, err
+	}
+	return buf.Bytes(), lost, nil
+}
+
+/*
+Read every shard and store the lost ones again.
+
+A shard whose peer answered is stored back to it,
+a shard whose peer is unreachable is moved only if relocate is set.
+*/
+func (d *DFS) RepairShards(ctx context.Context, key string, layout *ErasureLayout, relocate bool) (*ErasureLayout, error) {
+	enc, err := reedsolomon.New(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return layout, err
+	}
+	indexes := make([]int, len(layout.Shards))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	shards := make([][]byte, len(layout.Shards))
+	errs := d.getShards(ctx, layout, indexes, shards)
+	var lost []int
+	for i, e := range errs {
+		if e != nil {
+			lost = append(lost, i)
+		}
+	}
+	if len(lost) == 0 {
+		return layout, nil
+	}
+	if len(shards)-len(lost) < layout.DataShards {
+		return layout, fmt.Errorf("%w: %d lost of %d", ErrNotEnoughShards, len(lost), len(shards))
+	}
+	if err := enc.Reconstruct(shards); err != nil {
+		return layout, err
+	}
+
+	repaired := *layout
+	repaired.Shards = append([]Fileshard{}, layout.Shards...)
+	used := make(map[string]bool)
+	for _, shard := range layout.Shards {
+		used[shard.Location] = true
+	}
+	moved := false
+	err = nil
+	for _, i := range lost {
+		shard := repaired.Shards[i]
+		pi := d.peerAt(shard.Location)
+		if isPeerUnavailable(errs[i]) {
+			if !relocate {
+				continue
+			}
+			spare := d.shardPeers(key, used)
+			if len(spare) == 0 {
+				err = fmt.Errorf("%w: no spare peer for shard %d", ErrNotEnoughPeers, i)
+				continue
+			}
+			pi = spare[0]
+		}
+		if e := d.putTo(ctx, pi, shard.Key, shard.fileName(), shards[i]); e != nil {
+			log.Printf("[DFS] Repair shard %d of %s on %s error: %s", i, key, pi.PName(), e)
+			err = e
+			continue
+		}
+		if pi.PAddr() != shard.Location {
+			log.Printf("[DFS] Move shard %d of %s from %s to %s", i, key, shard.Location, pi.PAddr())
+			repaired.Shards[i].Location = pi.PAddr()
+			used[pi.PAddr()] = true
+			moved = true
+		}
+		d.metrics.Inc(METRIC_EC_SHARD_REBUILT)
+	}
+	if !moved {
+		return layout, err
+	}
+	return &repaired, err
+}
+
+func (d *DFS) shardsOffline(layout *ErasureLayout, after time.Duration, now time.Time) bool {
+	for _, shard := range layout.Shards {
+		pi := d.peerAt(shard.Location)
+		if !pi.Equal(d.self.Info()) && d.detector.OfflineFor(pi, now) > after {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DFS) DeleteShards(ctx context.Context, layout *ErasureLayout) error {
+	var err error
+	for _, shard := range layout.Shards {
+		e := d.deleteFrom(ctx, d.peerAt(shard.Location), shard.Key)
+		if e != nil && !errors.Is(e, ErrFileNotFound) {
+			log.Printf("[DFS] Delete shard %d at %s error: %s", shard.Index, shard.Location, e)
+			err = e
+		}
+	}
+	return err
+}
+
+// reconstruct lost shards found by reads in background
+func (g *Group) runShardRepair() {
+	for {
+		select {
+		case <-g.closing:
+			return
+		case block := <-g.shardRepairs:
+			ctx, cancel := context.WithTimeout(context.Background(), SHARD_REPAIR_TIMEOUT)
+			for _, fs := range g.StoreSystems {
+				coder, ok := fs.(ErasureCoder)
+				if !ok {
+					continue
+				}
+				if _, err := coder.RepairShards(ctx, block.Hash, block.Erasure, false); err != nil {
+					log.Printf("[Group] Repair shards of %s error: %s", block.Hash, err)
+				}
+			}
+			cancel()
+		}
+	}
+}
+
+// drop the block if the queue is full, the next read finds it again
+func (g *Group) queueShardRepair(block Fileblock) {
+	select {
+	case g.shardRepairs <- block:
+	default:
+	}
+}
+
+/*
+Repair every erasure coded block of a file,
+shards of unreachable peers are moved and the metadata is saved.
+*/
+func (g *Group) RepairFile(ctx context.Context, spaceKey, fullpath string) error {
+	meta, err := g.GetMetaData(ctx, filepath.Join(spaceKey, fullpath))
+	if err != nil {
+		return err
+	}
+	changed := false
+	err = nil
+	for i, block := range meta.Blocks {
+		if block.Erasure == nil {
+			continue
+		}
+		for _, fs := range g.StoreSystems {
+			coder, ok := fs.(ErasureCoder)
+			if !ok {
+				continue
+			}
+			layout, e := coder.RepairShards(ctx, block.Hash, block.Erasure, true)
+			if e != nil {
+				log.Printf("[Group] Repair shards of %s error: %s", block.Hash, e)
+				err = e
+			}
+			if layout != block.Erasure {
+				meta.Blocks[i].Erasure = layout
+				changed = true
+			}
+			break
+		}
+	}
+	if changed {
+		data, e := marshalMetaData(meta)
+		if e == nil {
+			e = g.FrontSystem.Store(ctx, spaceKey, fullpath+META_FILE_SUFFIX, data)
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+// move shards of peers offline for ErasurePolicy.RelocateAfter until Close
+func (g *Group) runShardRelocation() {
+	ticker := time.NewTicker(SHARD_RELOCATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.closing:
+			return
+		case now := <-ticker.C:
+			if g.erasure.RelocateAfter <= 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), SHARD_RELOCATE_TIMEOUT)
+			if _, err := g.RelocateShards(ctx, now); err != nil {
+				log.Println("[Group] Relocate shards error:", err)
+			}
+			cancel()
+		}
+	}
+}
+
+/*
+Repair the files stored on this node that have a shard on a peer
+offline for longer than ErasurePolicy.RelocateAfter at now, see RepairFile.
+
+Return the number of files repaired.
+*/
+func (g *Group) RelocateShards(ctx context.Context, now time.Time) (int, error) {
+	walker, ok := g.FrontSystem.(MetaWalker)
+	if !ok {
+		return 0, ErrNoMetaWalker
+	}
+	after := g.erasure.RelocateAfter
+	var files []string
+	err := walker.WalkMetaData(ctx, func(spaceKey, path string, meta Metadata) error {
+		for _, block := range meta.Blocks {
+			if block.Erasure != nil && g.shardsOffline(block, after, now) {
+				files = append(files, spaceKey+"/"+strings.TrimSuffix(path, META_FILE_SUFFIX))
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, file := range files {
+		spaceKey, fullpath, _ := strings.Cut(file, "/")
+		if e := g.RepairFile(ctx, spaceKey, fullpath); e != nil {
+			log.Printf("[Group] Relocate shards of %s error: %s", file, e)
+			err = e
+			continue
+		}
+		repaired++
+	}
+	return repaired, err
+}
+
+func (g *Group) shardsOffline(block Fileblock, after time.Duration, now time.Time) bool {
+	if block.System < 0 || block.System >= len(g.StoreSystems) {
+		return false
+	}
+	watcher, ok := g.StoreSystems[block.System].(shardWatcher)
+	return ok && watcher.shardsOffline(block.Erasure, after, now)
+}
@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErasureShards(t *testing.T) {
+	d, _ := newMemDFS(t, "peer", 0, 8)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("erasure coded block "), 100)
+
+	layout, err := d.StoreShards(ctx, "ecblock", data, DefaultErasurePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Shards) != DEFAULT_EC_DATA_SHARDS+DEFAULT_EC_PARITY_SHARDS {
+		t.Fatalf("got %d shards", len(layout.Shards))
+	}
+	used := map[string]bool{}
+	for _, shard := range layout.Shards {
+		if used[shard.Location] {
+			t.Fatalf("two shards on %s", shard.Location)
+		}
+		used[shard.Location] = true
+	}
+
+	// lose one data shard and one parity shard
+	for _, i := range []int{1, DEFAULT_EC_DATA_SHARDS} {
+		shard := layout.Shards[i]
+		d.deleteFrom(ctx, d.peerAt(shard.Location), shard.Key)
+	}
+	got, lost, err := d.GetShards(ctx, layout, int64(len(data)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("degraded read got %d bytes, %v", len(got), err)
+	}
+	if len(lost) != 2 || d.metrics.Get(METRIC_EC_DEGRADED_READ) != 1 {
+		t.Errorf("got lost %v, metrics %v", lost, d.metrics.Snapshot())
+	}
+
+	repaired, err := d.RepairShards(ctx, "ecblock", layout, false)
+	if err != nil || repaired != layout {
+		t.Fatalf("repair got %v, %v", repaired, err)
+	}
+	if _, lost, _ = d.GetShards(ctx, layout, int64(len(data))); len(lost) != 0 {
+		t.Errorf("shards %v still lost after repair", lost)
+	}
+
+	// too many lost shards
+	for _, shard := range layout.Shards[:DEFAULT_EC_PARITY_SHARDS+1] {
+		d.deleteFrom(ctx, d.peerAt(shard.Location), shard.Key)
+	}
+	if _, _, err := d.GetShards(ctx, layout, int64(len(data))); !errors.Is(err, ErrNotEnoughShards) {
+		t.Errorf("got %v, want ErrNotEnoughShards", err)
+	}
+}
+
+func TestErasureSharedShards(t *testing.T) {
+	d, _ := newMemDFS(t, "peer", 0, 8)
+	ctx := context.Background()
+	// the data shards of both blocks are all zero but the last one
+	first := append(make([]byte, 4096), 'a')
+	second := append(make([]byte, 4096), 'b')
+
+	layout1, err := d.StoreShards(ctx, blockChecksum(first), first, DefaultErasurePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout2, err := d.StoreShards(ctx, blockChecksum(second), second, DefaultErasurePolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout1.Shards[0].Hash != layout2.Shards[0].Hash || layout1.Shards[0].Key == layout2.Shards[0].Key {
+		t.Fatalf("shard 0 of the blocks has hash %s, %s and key %s, %s",
+			layout1.Shards[0].Hash, layout2.Shards[0].Hash, layout1.Shards[0].Key, layout2.Shards[0].Key)
+	}
+	if err := d.DeleteShards(ctx, layout1); err != nil {
+		t.Fatal(err)
+	}
+	got, lost, err := d.GetShards(ctx, layout2, int64(len(second)))
+	if err != nil || len(lost) != 0 || !bytes.Equal(got, second) {
+		t.Errorf("read after deleting the other block got lost %v, %v", lost, err)
+	}
+}
+
+func TestErasureRelocate(t *testing.T) {
+	d, p := newMemDFS(t, "peer", 0, 8)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("relocate"), 64)
+
+	layout, err := d.StoreShards(ctx, "ecmove", data, ErasurePolicy{DataShards: 2, ParityShards: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downAt int
+	for i, shard := range layout.Shards {
+		if shard.Location != d.self.PAddr() {
+			downAt = i
+			break
+		}
+	}
+	down := d.peerAt(layout.Shards[downAt].Location)
+	p.mu.Lock()
+	p.down[down.PName()] = true
+	p.mu.Unlock()
+
+	// the holder may come back, it is not moved
+	if repaired, _ := d.RepairShards(ctx, "ecmove", layout, false); repaired != layout {
+		t.Fatal("shard moved without relocate")
+	}
+	repaired, err := d.RepairShards(ctx, "ecmove", layout, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := repaired.Shards[downAt].Location
+	if moved == down.PAddr() {
+		t.Fatalf("shard %d was not moved from %s", downAt, moved)
+	}
+	for i, shard := range repaired.Shards {
+		if i != downAt && shard.Location == moved {
+			t.Fatalf("shard %d moved onto shard %d's peer %s", downAt, i, moved)
+		}
+	}
+	got, lost, err := d.GetShards(ctx, repaired, int64(len(data)))
+	if err != nil || len(lost) != 0 || !bytes.Equal(got, data) {
+		t.Errorf("read after relocate got lost %v, %v", lost, err)
+	}
+}
+
+func TestErasureSparePeer(t *testing.T) {
+	d, p := newMemDFS(t, "peer", 0, 8)
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("spare"), 64)
+	policy := ErasurePolicy{DataShards: 2, ParityShards: 1}
+
+	// down but not detected yet, its shard goes to a spare peer and is not a hint
+	var down string
+	for _, pi := range d.shardPeers("ecspare", nil)[:3] {
+		if !pi.Equal(d.self.Info()) {
+			down = pi.PAddr()
+			p.mu.Lock()
+			p.down[pi.PName()] = true
+			p.mu.Unlock()
+			break
+		}
+	}
+	layout, err := d.StoreShards(ctx, "ecspare", data, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range layout.Shards {
+		if shard.Location == down {
+			t.Errorf("shard %d is on the down peer %s", shard.Index, down)
+		}
+		if _, ok := d.hints.get(shard.Key); ok {
+			t.Errorf("shard %d is left as a hint", shard.Index)
+		}
+	}
+	got, lost, err := d.GetShards(ctx, layout, int64(len(data)))
+	if err != nil || len(lost) != 0 || !bytes.Equal(got, data) {
+		t.Errorf("read got lost %v, %v", lost, err)
+	}
+}
+
+func TestRelocateShards(t *testing.T) {
+	front := NewDTFS(*NewDPeer("front0", "10.0.0.0:9631", 20, nil), t.TempDir())
+	t.Cleanup(func() { front.Close() })
+	g := NewGroup("erasure", front)
+	d, p := newMemDFS(t, "ec", 3, 8)
+	g.UseFS(d)
+	ctx := context.Background()
+	if err := g.NewBorad(ctx, "ecspace"); err != nil {
+		t.Fatal(err)
+	}
+	g.Set(InlinePolicy{})
+	if err := g.Set(ErasurePolicy{DataShards: 2, ParityShards: 1, RelocateAfter: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("relocated shards ", 64)
+	if err := g.StoreFile(ctx, "ecspace", "", ".", "file", io.NopCloser(strings.NewReader(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := g.GetMetaData(ctx, "ecspace/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := meta.Blocks[0].Erasure
+	if layout == nil {
+		t.Fatal("block is not erasure coded")
+	}
+	var downAt int
+	for i, shard := range layout.Shards {
+		if shard.Location != d.self.PAddr() {
+			downAt = i
+			break
+		}
+	}
+	down := d.peerAt(layout.Shards[downAt].Location)
+	p.mu.Lock()
+	p.down[down.PName()] = true
+	p.mu.Unlock()
+	d.detector.MarkOffline(down)
+
+	// not offline for long enough
+	if n, err := g.RelocateShards(ctx, time.Now()); n != 0 || err != nil {
+		t.Fatalf("relocated %d files, %v", n, err)
+	}
+	n, err := g.RelocateShards(ctx, time.Now().Add(2*time.Hour))
+	if n != 1 || err != nil {
+		t.Fatalf("relocated %d files, %v", n, err)
+	}
+	if meta, err = g.GetMetaData(ctx, "ecspace/file"); err != nil {
+		t.Fatal(err)
+	}
+	if moved := meta.Blocks[0].Erasure.Shards[downAt].Location; moved == down.PAddr() {
+		t.Fatalf("shard %d is still on %s in the metadata", downAt, moved)
+	}
+	r, err := g.OpenFile(ctx, "ecspace", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("read %d bytes, %v after relocate", len(data), err)
+	}
+}
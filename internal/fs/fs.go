@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -19,11 +20,11 @@ var (
 )
 
 type FileSystem interface {
-	Store(key, name string, value []byte) error
+	Store(ctx context.Context, key, name string, value []byte) error
 
-	Get(key string) (File, error)
+	Get(ctx context.Context, key string) (File, error)
 
-	Delete(key string) error
+	Delete(ctx context.Context, key string) error
 
 	Set(opt any) error
 
@@ -0,0 +1,305 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	// longer than DEFAULT_SESSION_TTL, an idle upload session on another node
+	// touched its blocks last when it was used
+	DEFAULT_GC_GRACE = time.Hour * 48
+
+	DEFAULT_GC_INTERVAL = time.Hour * 24
+
+	// time of one collection
+	GC_TIMEOUT = time.Hour
+)
+
+var (
+	ErrGCRunning = errors.New("garbage collection is running")
+)
+
+/*
+GCPolicy decides how unreferenced blocks are collected.
+
+Interval - time between two collections, 0 disables them,
+Group.CollectGarbage still runs one.
+
+Grace - a block is deleted only if it is stored or touched this long ago,
+and it has been unreferenced in every collection for this long.
+Storing a block again and instant upload touch it, see Group.CheckBlocks,
+so it is kept until the file that references it is committed.
+
+Use Group.Set(GCPolicy{...}) to change it.
+*/
+type GCPolicy struct {
+	Interval time.Duration
+	Grace    time.Duration
+}
+
+var DefaultGCPolicy = GCPolicy{
+	Interval: DEFAULT_GC_INTERVAL,
+	Grace:    DEFAULT_GC_GRACE,
+}
+
+/*
+implemented by DTFS, blocks and shards its metadata references, see refKey.
+
+A block is referenced on the store systems that have a copy of it,
+a copy on another system is garbage, like the one left by tiering.
+*/
+type refSource interface {
+	referencedKeys(ctx context.Context) ([]string, error)
+}
+
+var _ refSource = (*DTFS)(nil)
+
+// implemented by DPeer
+type refPeer interface {
+	ListRefs(ctx context.Context, pi peers.PeerInfo) ([]string, error)
+}
+
+// implemented by DFS, blocks stored on this node
+type gcStore interface {
+	rangeFileInfo(fn func(key string, bfi BasicFileInfo) bool) error
+	deleteIfOlder(ctx context.Context, key string, before time.Time) (bool, error)
+}
+
+var _ gcStore = (*DFS)(nil)
+
+// implemented by DFS, refresh the mod time of a block stored on this node
+type blockToucher interface {
+	touchLocally(ctx context.Context, key string) (bool, error)
+}
+
+var _ blockToucher = (*DFS)(nil)
+
+type GCReport struct {
+	DryRun bool `json:"dry_run"`
+
+	// blocks and shards stored on this node
+	Scanned    int64 `json:"scanned"`
+	Referenced int64 `json:"referenced"`
+
+	// unreferenced, but in the grace period or held by an upload
+	Pending int64 `json:"pending"`
+
+	// deleted, or to delete in a dry run
+	Deleted      int64    `json:"deleted"`
+	DeletedBytes int64    `json:"deleted_bytes"`
+	Keys         []string `json:"keys,omitempty"`
+
+	Failed int64 `json:"failed"`
+}
+
+// state kept between collections
+type gcState struct {
+	mu      sync.Mutex
+	running bool
+
+	// when a key was first found unreferenced, by refKey
+	unreferenced map[string]time.Time
+}
+
+// key on store system i, store systems of a group are in the same order on every node
+func refKey(i int, key string) string {
+	return strconv.Itoa(i) + ":" + key
+}
+
+func (dt *DTFS) referencedKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+	// a record skipped would leave its blocks unreferenced
+	err := dt.walkMetaData(ctx, true, func(spaceKey, path string, meta Metadata) error {
+		for _, block := range meta.Blocks {
+			for _, i := range block.systems() {
+				keys = append(keys, refKey(i, block.Hash))
+			}
+			if block.Erasure != nil {
+				for _, shard := range block.Erasure.Shards {
+					keys = append(keys, refKey(block.System, shard.Key))
+				}
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+/*
+Mark: keys referenced by metadata on every peer of the front system.
+
+It fails if any peer can not answer, a block it references could be deleted otherwise.
+*/
+func (g *Group) markReferenced(ctx context.Context) (map[string]bool, error) {
+	local, ok := g.FrontSystem.(refSource)
+	if !ok {
+		return nil, ErrNoMetaWalker
+	}
+	self := g.FrontSystem.Peer()
+	rp, _ := self.(refPeer)
+	referenced := make(map[string]bool)
+	for _, pi := range self.PList() {
+		var keys []string
+		var err error
+		if pi.Equal(self.Info()) {
+			keys, err = local.referencedKeys(ctx)
+		} else if rp != nil {
+			keys, err = rp.ListRefs(ctx, pi)
+		} else {
+			err = ErrInternal
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mark references on %s: %w", pi.PName(), err)
+		}
+		for _, key := range keys {
+			referenced[key] = true
+		}
+	}
+	return referenced, nil
+}
+
+/*
+Collect blocks no metadata references, from the store systems on this node.
+
+Every peer of the front system is asked for its references first.
+A block is deleted if it is unreferenced and past the grace period, see GCPolicy,
+blocks held by uploads on this node are kept.
+Every node collects its own copies, so replicas elsewhere go on their next collection.
+
+dryRun - report what would be deleted, nothing is deleted or remembered.
+*/
+func (g *Group) CollectGarbage(ctx context.Context, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun}
+	g.gc.mu.Lock()
+	if g.gc.running {
+		g.gc.mu.Unlock()
+		return report, ErrGCRunning
+	}
+	g.gc.running = true
+	g.gc.mu.Unlock()
+	defer func() {
+		g.gc.mu.Lock()
+		g.gc.running = false
+		g.gc.mu.Unlock()
+	}()
+
+	// blocks stored or touched after before are not collected,
+	// so listing them after the mark is safe
+	now := time.Now()
+	before := now.Add(-g.gcPolicy.Grace)
+	referenced, err := g.markReferenced(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	g.gc.mu.Lock()
+	firstSeen := make(map[string]time.Time, len(g.gc.unreferenced))
+	for key, t := range g.gc.unreferenced {
+		firstSeen[key] = t
+	}
+	g.gc.mu.Unlock()
+	unreferenced := make(map[string]time.Time)
+
+	for i, fs := range g.StoreSystems {
+		store, ok := fs.(gcStore)
+		if !ok {
+			continue
+		}
+		var garbage []string
+		sizes := make(map[string]int64)
+		err := store.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+			report.Scanned++
+			if referenced[refKey(i, key)] {
+				report.Referenced++
+				return true
+			}
+			seen, ok := firstSeen[refKey(i, key)]
+			if !ok {
+				seen = now
+			}
+			unreferenced[refKey(i, key)] = seen
+			if now.Sub(seen) < g.gcPolicy.Grace || bfi.ModTime_.After(before) || g.uploading(key) {
+				report.Pending++
+				return true
+			}
+			garbage = append(garbage, key)
+			sizes[key] = bfi.Size_
+			return true
+		})
+		if err != nil {
+			return report, err
+		}
+
+		for _, key := range garbage {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			if !dryRun {
+				// checked again, it may be touched since it was listed
+				deleted, err := store.deleteIfOlder(ctx, key, before)
+				if err != nil {
+					report.Failed++
+					log.Printf("[Group] GC delete %s error: %s", key, err)
+					continue
+				}
+				if !deleted {
+					report.Pending++
+					continue
+				}
+			}
+			delete(unreferenced, refKey(i, key))
+			report.Deleted++
+			report.DeletedBytes += sizes[key]
+			report.Keys = append(report.Keys, key)
+		}
+	}
+	sort.Strings(report.Keys)
+
+	if !dryRun {
+		g.gc.mu.Lock()
+		g.gc.unreferenced = unreferenced
+		g.gc.mu.Unlock()
+	}
+	log.Printf("[Group] GC: %d scanned, %d referenced, %d pending, %d deleted (%d bytes), %d failed, dry run %v",
+		report.Scanned, report.Referenced, report.Pending, report.Deleted, report.DeletedBytes, report.Failed, dryRun)
+	return report, nil
+}
+
+// true if an upload on this node holds the block
+func (g *Group) uploading(hash string) bool {
+	g.uploadMu.Lock()
+	defer g.uploadMu.Unlock()
+	return g.inflight[hash] > 0
+}
+
+// collect garbage every GCPolicy.Interval until Close
+func (g *Group) runGC() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-g.closing:
+			return
+		case now := <-ticker.C:
+			if g.gcPolicy.Interval <= 0 || now.Sub(last) < g.gcPolicy.Interval {
+				continue
+			}
+			last = now
+			ctx, cancel := context.WithTimeout(context.Background(), GC_TIMEOUT)
+			if _, err := g.CollectGarbage(ctx, false); err != nil {
+				log.Println("[Group] GC error:", err)
+			}
+			cancel()
+		}
+	}
+}
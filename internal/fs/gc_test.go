@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	g, fast, capacity := newStoreGroup(t)
+	ctx := context.Background()
+
+	content := "referenced block"
+	if err := g.StoreFile(ctx, "storespace", "", ".", "file", io.NopCloser(strings.NewReader(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	referenced := blockChecksum([]byte(content))
+	orphan := blockChecksum([]byte("orphan block"))
+	held := blockChecksum([]byte("held block"))
+	// the peer of a key may be remote, keep them on this node
+	for _, b := range []struct {
+		d    *DFS
+		key  string
+		data string
+	}{{fast, referenced, content}, {fast, orphan, "orphan block"}, {capacity, held, "held block"}} {
+		if err := b.d.storeLocally(ctx, b.key, b.key, []byte(b.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g.uploadMu.Lock()
+	g.inflight[held]++
+	g.uploadMu.Unlock()
+
+	// a dry run reports the orphan and keeps it
+	if err := g.Set(GCPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	report, err := g.CollectGarbage(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 || len(report.Keys) != 1 || report.Keys[0] != orphan {
+		t.Fatalf("dry run report %+v", report)
+	}
+	if report.Referenced != 1 || report.Pending != 1 {
+		t.Errorf("dry run report %+v", report)
+	}
+	if ok, _ := fast.hasLocally(ctx, orphan); !ok {
+		t.Fatal("dry run deleted the orphan")
+	}
+
+	// the first collection only marks the orphan
+	grace := 50 * time.Millisecond
+	if err := g.Set(GCPolicy{Grace: grace}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = g.CollectGarbage(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 0 || report.Pending != 2 {
+		t.Fatalf("first collection report %+v", report)
+	}
+
+	time.Sleep(grace)
+	if report, err = g.CollectGarbage(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 1 || report.DeletedBytes != int64(len("orphan block")) {
+		t.Fatalf("second collection report %+v", report)
+	}
+	if ok, _ := fast.hasLocally(ctx, orphan); ok {
+		t.Error("orphan is not deleted")
+	}
+	if ok, _ := fast.hasLocally(ctx, referenced); !ok {
+		t.Error("referenced block is deleted")
+	}
+	if ok, _ := capacity.hasLocally(ctx, held); !ok {
+		t.Error("block held by an upload is deleted")
+	}
+	r, err := g.OpenFile(ctx, "storespace", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != content {
+		t.Errorf("read %q, %v, want %q", data, err, content)
+	}
+
+	// a block touched after it was listed is kept, like one an instant upload found
+	listed := time.Now()
+	time.Sleep(time.Millisecond)
+	if ok, err := capacity.touchLocally(ctx, held); !ok || err != nil {
+		t.Fatalf("touch got %v, %v", ok, err)
+	}
+	if deleted, err := capacity.deleteIfOlder(ctx, held, listed); deleted || err != nil {
+		t.Errorf("touched block deleted: %v, %v", deleted, err)
+	}
+
+	if err := g.Set(GCPolicy{Grace: -1}); err == nil {
+		t.Error("negative grace accepted")
+	}
+}
+
+func TestCollectGarbageUnreadableMetadata(t *testing.T) {
+	g, fast, _ := newStoreGroup(t)
+	ctx := context.Background()
+
+	content := "block of a broken record"
+	if err := g.StoreFile(ctx, "storespace", "", ".", "file", io.NopCloser(strings.NewReader(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	key := blockChecksum([]byte(content))
+	if err := fast.storeLocally(ctx, key, key, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the record can not be decoded, its block looks unreferenced
+	metaKey := "storespace/file" + META_FILE_SUFFIX
+	meta, err := g.FrontSystem.Get(ctx, metaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{}, meta.Data()...)
+	data[len(data)-1] ^= 0xff
+	if err := g.FrontSystem.Store(ctx, "storespace", "file"+META_FILE_SUFFIX, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Set(GCPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := g.CollectGarbage(ctx, false); err == nil {
+			t.Fatal("collection with an unreadable record succeeded")
+		}
+	}
+	if ok, _ := fast.hasLocally(ctx, key); !ok {
+		t.Error("block of an unreadable record is deleted")
+	}
+}
@@ -1,7 +1,9 @@
 package fs
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"path/filepath"
@@ -9,10 +11,11 @@ import (
 	"time"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
+	"github.com/klauspost/reedsolomon"
 )
 
 const (
-	GroupFSLimit int  = 1
+	GroupFSLimit int  = 8
 	BLOCK_SIZE   Byte = 1024 * 1024 * 4 // 4MB
 )
 
@@ -40,6 +43,29 @@ type Group struct {
 		XXX: support redundancy in the future.
 	*/
 	StoreSystems []DistributeFileSystem
+
+	decomMu sync.Mutex
+	decom   *decommission
+
+	erasure      ErasurePolicy
+	upload       UploadPolicy
+	download     DownloadPolicy
+	chunk        ChunkPolicy
+	inline       InlinePolicy
+	store        StorePolicy
+	gcPolicy     GCPolicy
+	shardRepairs chan Fileblock
+
+	// blocks held by running uploads, see uploadTx
+	uploadMu sync.Mutex
+	inflight map[string]int
+	// blocks held by more than one upload, rollback keeps them
+	shared map[string]bool
+
+	gc gcState
+
+	closing   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewGroup(groupName string, frontSystem DistributeFileSystem) *Group {
@@ -47,6 +73,71 @@ func NewGroup(groupName string, frontSystem DistributeFileSystem) *Group {
 		groupName:    groupName,
 		StoreSystems: make([]DistributeFileSystem, 0, 10),
 		FrontSystem:  frontSystem,
+		upload:       DefaultUploadPolicy,
+		download:     DefaultDownloadPolicy,
+		chunk:        DefaultChunkPolicy,
+		inline:       DefaultInlinePolicy,
+		store:        DefaultStorePolicy,
+		erasure:      ErasurePolicy{RelocateAfter: DEFAULT_SHARD_RELOCATE_AFTER},
+		gcPolicy:     DefaultGCPolicy,
+		inflight:     make(map[string]int),
+		shared:       make(map[string]bool),
+		shardRepairs: make(chan Fileblock, SHARD_REPAIR_QUEUE),
+		closing:      make(chan struct{}),
+	}
+}
+
+/*
+Set options of the group, other options are passed to every file system.
+*/
+func (g *Group) Set(opt any) error {
+	switch o := opt.(type) {
+	case ErasurePolicy:
+		if o.RelocateAfter < 0 {
+			return errors.New("negative shard relocate time")
+		}
+		if o.DataShards > 0 {
+			if _, err := reedsolomon.New(o.DataShards, o.ParityShards); err != nil {
+				return err
+			}
+		}
+		g.erasure = o
+		return nil
+	case UploadPolicy:
+		g.upload = o
+		return nil
+	case DownloadPolicy:
+		g.download = o
+		return nil
+	case ChunkPolicy:
+		if err := o.check(); err != nil {
+			return err
+		}
+		g.chunk = o
+		return nil
+	case InlinePolicy:
+		g.inline = o
+		return nil
+	case StorePolicy:
+		if err := o.check(); err != nil {
+			return err
+		}
+		g.store = o
+		return nil
+	case GCPolicy:
+		if o.Interval < 0 || o.Grace < 0 {
+			return errors.New("negative gc interval or grace")
+		}
+		g.gcPolicy = o
+		return nil
+	default:
+		systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+		for _, fs := range systems {
+			if err := fs.Set(opt); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 }
 
@@ -66,82 +157,130 @@ func (g *Group) UseFS(fs ...DistributeFileSystem) {
 	g.StoreSystems = append(g.StoreSystems, fs...)
 }
 
+// implemented by DFS and DTFS, binds the rpc port before Serve
+type portListener interface {
+	Listen() error
+}
+
+var _ portListener = (*DFS)(nil)
+var _ portListener = (*DTFS)(nil)
+
+/*
+Bind the ports of every system, so a port in use fails here and not in Serve.
+Close releases them.
+*/
+func (g *Group) Listen() error {
+	systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+	for _, fs := range systems {
+		if l, ok := fs.(portListener); ok {
+			if err := l.Listen(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (g *Group) Serve() {
 	for _, fs := range g.StoreSystems {
 		go fs.Serve()
 	}
+	go g.runShardRepair()
+	go g.runShardRelocation()
+	go g.runTiering()
+	go g.runGC()
 	g.FrontSystem.Serve()
 }
 
 //User method field
 
-func (g *Group) NewBorad(spaceKey string) error {
-	return g.FrontSystem.Store(spaceKey, NEW_SPACE, nil)
+func (g *Group) NewBorad(ctx context.Context, spaceKey string) error {
+	return g.FrontSystem.Store(ctx, spaceKey, NEW_SPACE, nil)
 }
 
-func (g *Group) StoreFile(spaceKey, filehash, basePath, filename string, blocksStream io.ReadCloser, blocks []Fileblock) error {
+/*
+Store the blocks in blocksStream, then the metadata of the file.
+
+blocks - boundaries of the blocks, nil to split the stream by the ChunkPolicy.
+
+The upload is a transaction, the metadata is written only after every block is stored,
+if anything fails or it times out, its blocks are left to garbage collection.
+
+A file that fits the InlinePolicy has no blocks, it is stored in its metadata.
+*/
+func (g *Group) StoreFile(ctx context.Context, spaceKey, filehash, basePath, filename string, blocksStream io.ReadCloser, blocks []Fileblock) error {
 	if blocksStream == nil {
 		return errors.New("blocksStream is nil")
 	}
 
-	//calculate the file size
-	var filesize int64
-	for _, block := range blocks {
-		filesize += block.Size
+	if g.upload.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.upload.Timeout)
+		defer cancel()
 	}
 
-	// generate the metadata
-	metadata := newMetaData(filename, filehash, filesize, time.Now(), blocks)
-	metadataBytes := marshalMetaData(metadata)
-
-	//save metadata
-	err := g.FrontSystem.Store(spaceKey, filepath.Join(basePath, filename+META_FILE_SUFFIX), metadataBytes)
+	defer blocksStream.Close()
+	for _, block := range blocks {
+		if err := checkBlockSize(block); err != nil {
+			return err
+		}
+	}
+	stream, data, inline, err := g.readInline(blocksStream, blocks)
 	if err != nil {
 		return err
 	}
+	tx := g.beginUpload()
+	if inline {
+		return g.commitMetaData(ctx, tx, spaceKey, basePath, newInlineMetaData(filename, filehash, time.Now(), data))
+	}
 
-	//save blocks
-	var wg sync.WaitGroup
-	wg.Add(len(g.StoreSystems))
-	defer blocksStream.Close()
+	//save blocks, record where each block landed, see UploadPolicy
 	log.Println("[Group] Start to store blocks")
-	//TODO
-	wg.Wait()
+	blocks, err = g.storeBlocks(ctx, tx, stream, blocks)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	//save metadata, it commits the upload
+	if err := g.commitUpload(ctx, tx, spaceKey, filehash, basePath, filename, blocks); err != nil {
+		tx.rollback()
+		return err
+	}
 	return nil
 }
 
-func (g *Group) Delete(spaceKey, fullpath string) error {
+/*
+Delete the metadata of a file.
+
+Its blocks are kept, other files may share them by dedup or instant upload,
+blocks no file references are reclaimed by CollectGarbage.
+*/
+func (g *Group) Delete(ctx context.Context, spaceKey, fullpath string) error {
 
 	// You can see the format definition in dtreefs.go -> Delete Function
 	delString := filepath.Join(spaceKey, fullpath)
-	meta, err := g.GetMetaData(delString)
-	if err != nil {
+	if _, err := g.GetMetaData(ctx, delString); err != nil {
 		return err
 	}
-	var wg sync.WaitGroup
-	wg.Add(len(meta.Blocks))
-	for _, block := range meta.Blocks {
-		go g.DeleteBlock(block, &wg)
-	}
-	wg.Wait()
-	return g.DeleteMetaData(delString)
+	return g.DeleteMetaData(ctx, delString)
 }
 
-func (g *Group) Mkdir(spaceKey, basePath, dirName string) error {
+func (g *Group) Mkdir(ctx context.Context, spaceKey, basePath, dirName string) error {
 
 	//Add DIR_PERFIX for FileSystem to Specify the dir
 	//But the real dir name that store in the front system is the dirName.
 	realDirString := filepath.Join(basePath, DIR_PERFIX+dirName)
 	log.Println("[Group] Mkdir:", realDirString)
-	return g.FrontSystem.Store(spaceKey, realDirString, nil)
+	return g.FrontSystem.Store(ctx, spaceKey, realDirString, nil)
 }
 
-func (g *Group) GetDir(spaceKey, basePath, dirName string) (File, error) {
+func (g *Group) GetDir(ctx context.Context, spaceKey, basePath, dirName string) (File, error) {
 
 	// You can see the format definition in dtreefs.go -> Get Function
 	getString := filepath.Join(spaceKey, basePath, dirName)
 	log.Printf("[Group] Get dir:%s\n", getString)
-	return g.FrontSystem.Get(getString)
+	return g.FrontSystem.Get(ctx, getString)
 }
 
 /*
@@ -152,6 +291,9 @@ Return the last error,
 other error will be logged.
 */
 func (g *Group) Close() error {
+	g.closeOnce.Do(func() {
+		close(g.closing)
+	})
 	err := g.FrontSystem.Close()
 	if err != nil {
 		log.Println("[Group] Close front system error:", err)
@@ -168,9 +310,9 @@ func (g *Group) Close() error {
 /*
 key - format: <spaceKey>/<filefullpath>
 */
-func (g *Group) GetMetaData(key string) (Metadata, error) {
+func (g *Group) GetMetaData(ctx context.Context, key string) (Metadata, error) {
 	//get metadata
-	metadataFile, err := g.FrontSystem.Get(key + META_FILE_SUFFIX)
+	metadataFile, err := g.FrontSystem.Get(ctx, key+META_FILE_SUFFIX)
 	if err != nil {
 		return Metadata{}, err
 	}
@@ -178,38 +320,163 @@ func (g *Group) GetMetaData(key string) (Metadata, error) {
 
 	//read metadata
 	var meta Metadata
-	readMetaDataByBytes(metadataBytes, &meta)
-
+	if err := readMetaDataByBytes(metadataBytes, &meta); err != nil {
+		return Metadata{}, fmt.Errorf("read metadata %s: %w", key, err)
+	}
 	return meta, nil
 }
 
-func (g *Group) DeleteMetaData(key string) error {
-	return g.FrontSystem.Delete(key + META_FILE_SUFFIX)
+func (g *Group) DeleteMetaData(ctx context.Context, key string) error {
+	return g.FrontSystem.Delete(ctx, key+META_FILE_SUFFIX)
 }
 
-func (g *Group) GetBlockData(blockInfo Fileblock) ([]byte, error) {
+/*
+Store a block to the store systems by the StorePolicy,
+and record where it landed in blockInfo.FullPath,
+or in blockInfo.Erasure if it is erasure coded, see ErasurePolicy.
+*/
+func (g *Group) StoreBlock(ctx context.Context, blockInfo *Fileblock, data []byte) error {
+	if len(g.StoreSystems) == 0 {
+		return ErrNoStoreSystem
+	}
+	if g.store.Mode == STORE_MIRROR {
+		return g.mirrorBlock(ctx, blockInfo, data)
+	}
 	var err error
-	for _, fs := range g.StoreSystems {
-		file, err := fs.Get(blockInfo.Hash)
-		if err == nil && int64(len(file.Data())) == blockInfo.Size {
-			return file.Data(), nil
+	for i := range g.StoreSystems {
+		if err = g.storeBlockTo(ctx, i, blockInfo, data, true); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/*
+Read from the store system that took the block, then from the others,
+where the block landed is tried first, see Fileblock.FullPath.
+
+An erasure coded block is rebuilt if some shards are lost,
+and the lost shards are reconstructed in background.
+*/
+func (g *Group) GetBlockData(ctx context.Context, blockInfo Fileblock) ([]byte, error) {
+	err := ErrNoStoreSystem
+	for _, i := range g.readOrder(blockInfo.System) {
+		var data []byte
+		if data, err = g.getBlockFrom(ctx, i, blockInfo); err == nil {
+			return data, nil
 		}
 	}
 	return nil, err
 }
 
-func (g *Group) DeleteBlock(blockInfo Fileblock, wg *sync.WaitGroup) error {
-	var err error
-	for _, fs := range g.StoreSystems {
-		err = fs.Delete(blockInfo.Hash)
-		if err == nil {
-			return nil
+/*
+Read many blocks like GetBlockData,
+full copies on a BlockBatcher are read with one call per peer.
+An erasure coded block, or one that fails there, is read by GetBlockData.
+
+Data and errors are in the same order as blocks.
+*/
+func (g *Group) getBlocksData(ctx context.Context, blocks []Fileblock) ([][]byte, []error) {
+	data := make([][]byte, len(blocks))
+	errs := make([]error, len(blocks))
+	batches := make(map[int][]int) // store system -> indexes of its blocks
+	for i, block := range blocks {
+		if block.System >= 0 && block.System < len(g.StoreSystems) && block.Erasure == nil {
+			batches[block.System] = append(batches[block.System], i)
+		}
+	}
+	fetched := make([]bool, len(blocks))
+	for system, idx := range batches {
+		batcher, ok := g.StoreSystems[system].(BlockBatcher)
+		if !ok {
+			continue
+		}
+		keys := make([]string, 0, len(idx))
+		locations := make([][]string, 0, len(idx))
+		for _, i := range idx {
+			keys = append(keys, blocks[i].Hash)
+			locations = append(locations, blocks[i].Locations())
+		}
+		for j, r := range batcher.BatchGetAt(ctx, keys, locations) {
+			i := idx[j]
+			if r.Err == nil && int64(len(r.File.Data())) == blocks[i].Size {
+				data[i], fetched[i] = r.File.Data(), true
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range blocks {
+		if fetched[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data[i], errs[i] = g.GetBlockData(ctx, blocks[i])
+		}(i)
+	}
+	wg.Wait()
+	return data, errs
+}
+
+func (g *Group) DeleteBlock(ctx context.Context, blockInfo Fileblock, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	return g.deleteBlock(ctx, blockInfo)
+}
+
+// delete from every store system, it fails only if none of them succeeds
+func (g *Group) deleteBlock(ctx context.Context, blockInfo Fileblock) error {
+	err := ErrNoStoreSystem
+	deleted := false
+	for i := range g.StoreSystems {
+		if e := g.deleteBlockFrom(ctx, i, blockInfo); e != nil {
+			err = e
+		} else {
+			deleted = true
 		}
 	}
-	wg.Done()
+	if deleted {
+		return nil
+	}
 	return err
 }
 
+/*
+Sum up the metrics of the front system and store systems.
+*/
+func (g *Group) Metrics() map[string]int64 {
+	metrics := make(map[string]int64)
+	systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+	for _, fs := range systems {
+		reporter, ok := fs.(MetricsReporter)
+		if !ok {
+			continue
+		}
+		for name, v := range reporter.Metrics() {
+			metrics[name] += v
+		}
+	}
+	return metrics
+}
+
+/*
+Stats of every peer of the front system and store systems,
+and their sum.
+*/
+func (g *Group) ClusterStats(ctx context.Context) ClusterStats {
+	var nodes []NodeStats
+	systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+	for _, fs := range systems {
+		reporter, ok := fs.(StatsReporter)
+		if !ok {
+			continue
+		}
+		nodes = append(nodes, reporter.Stats(ctx)...)
+	}
+	return sumStats(nodes)
+}
+
 func (g *Group) PeerList() []DPeerInfo {
 	peers := make([]DPeerInfo, len(g.FrontSystem.Peer().PList()))
 
@@ -236,10 +503,18 @@ func (g *Group) Join(pi peers.PeerInfo) error {
 	return nil
 }
 
+/*
+Leave the ring, other peers will remove this node.
+
+Data is not moved, use Decommission to move it first.
+*/
 func (g *Group) Quit() {
-	g.FrontSystem.Peer().PSync(g.FrontSystem.Peer().Info(), peers.P_ACTION_QUIT)
-	for _, fs := range g.StoreSystems {
-		fs.Peer().PSync(g.FrontSystem.Peer().Info(), peers.P_ACTION_QUIT)
+	systems := append([]DistributeFileSystem{g.FrontSystem}, g.StoreSystems...)
+	for _, fs := range systems {
+		p := fs.Peer()
+		if err := p.PActionTo(peers.P_ACTION_QUIT, withoutPeer(p.PList(), p.Info())...); err != nil {
+			log.Println("[Group] Quit error:", err)
+		}
 	}
 }
 
@@ -0,0 +1,214 @@
+package fs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	// latencies kept for each peer
+	LATENCY_WINDOW = 128
+
+	DEFAULT_HEDGE_PERCENTILE  = 0.95
+	DEFAULT_HEDGE_MIN_SAMPLES = 16
+	DEFAULT_HEDGE_MIN_DELAY   = time.Millisecond * 5
+)
+
+/*
+HedgePolicy decides when a read is also sent to the next replica.
+
+If a peer has not answered within the Percentile of its observed latency,
+the next replica is asked too, the first answer wins
+and the other request is cancelled.
+
+A peer with less than MinSamples reads is never hedged,
+Percentile <= 0 disables hedging.
+
+Use DFS.Set(HedgePolicy{...}) to change it.
+*/
+type HedgePolicy struct {
+	Percentile float64
+	MinSamples int
+
+	// never hedge sooner than this
+	MinDelay time.Duration
+}
+
+var DefaultHedgePolicy = HedgePolicy{
+	Percentile: DEFAULT_HEDGE_PERCENTILE,
+	MinSamples: DEFAULT_HEDGE_MIN_SAMPLES,
+	MinDelay:   DEFAULT_HEDGE_MIN_DELAY,
+}
+
+// latencies of the last LATENCY_WINDOW successful reads of each peer
+type latencyTracker struct {
+	mu    sync.Mutex
+	peers map[string]*latencyWindow
+}
+
+type latencyWindow struct {
+	samples [LATENCY_WINDOW]time.Duration
+	n       int // samples seen, may be more than LATENCY_WINDOW
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{peers: make(map[string]*latencyWindow)}
+}
+
+func (t *latencyTracker) observe(pi peers.PeerInfo, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.peers[pi.PName()]
+	if !ok {
+		w = &latencyWindow{}
+		t.peers[pi.PName()] = w
+	}
+	w.samples[w.n%LATENCY_WINDOW] = d
+	w.n++
+}
+
+// p in (0, 1], false if there are less than minSamples samples
+func (t *latencyTracker) percentile(pi peers.PeerInfo, p float64, minSamples int) (time.Duration, bool) {
+	t.mu.Lock()
+	w, ok := t.peers[pi.PName()]
+	if !ok || w.n == 0 || w.n < minSamples {
+		t.mu.Unlock()
+		return 0, false
+	}
+	n := w.n
+	if n > LATENCY_WINDOW {
+		n = LATENCY_WINDOW
+	}
+	samples := append([]time.Duration{}, w.samples[:n]...)
+	t.mu.Unlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(float64(len(samples))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(samples) {
+		i = len(samples) - 1
+	}
+	return samples[i], true
+}
+
+// p95 latency of every peer with enough samples
+func (d *DFS) PeerLatency() map[string]time.Duration {
+	latency := make(map[string]time.Duration)
+	for _, pi := range d.self.PList() {
+		if p95, ok := d.latency.percentile(pi, DEFAULT_HEDGE_PERCENTILE, 1); ok {
+			latency[pi.PName()] = p95
+		}
+	}
+	return latency
+}
+
+// how long to wait for pi before asking another replica
+func (d *DFS) hedgeDelay(pi peers.PeerInfo) (time.Duration, bool) {
+	if d.hedgePolicy.Percentile <= 0 || pi.Equal(d.self.Info()) {
+		return 0, false
+	}
+	delay, ok := d.latency.percentile(pi, d.hedgePolicy.Percentile, d.hedgePolicy.MinSamples)
+	if !ok {
+		return 0, false
+	}
+	if delay < d.hedgePolicy.MinDelay {
+		delay = d.hedgePolicy.MinDelay
+	}
+	return delay, true
+}
+
+// a finished read from one replica
+type replicaRead struct {
+	pi   peers.PeerInfo
+	file File
+	err  error
+}
+
+/*
+Read from candidates in order, each read is hedged with the next candidate.
+
+Return the file if any candidate has it, and every finished read.
+*/
+func (d *DFS) readReplicas(ctx context.Context, key string, candidates []peers.PeerInfo) (File, []replicaRead) {
+	var reads []replicaRead
+	done := make(map[string]bool)
+	for i, pi := range candidates {
+		if done[pi.PName()] {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		var alt peers.PeerInfo
+		if i+1 < len(candidates) {
+			alt = candidates[i+1]
+		}
+		for _, r := range d.hedgedGet(ctx, key, pi, alt) {
+			done[r.pi.PName()] = true
+			reads = append(reads, r)
+			if r.err == nil {
+				return r.file, reads
+			}
+		}
+	}
+	return nil, reads
+}
+
+/*
+Read from pi, and from alt too if pi has not answered within its hedge delay.
+
+Return the reads that finished, the last one is the successful one if any.
+The slower request is cancelled and not returned.
+*/
+func (d *DFS) hedgedGet(ctx context.Context, key string, pi, alt peers.PeerInfo) []replicaRead {
+	delay, ok := d.hedgeDelay(pi)
+	if alt == nil || !ok {
+		file, err := d.getFrom(ctx, pi, key)
+		return []replicaRead{{pi: pi, file: file, err: err}}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan replicaRead, 2)
+	read := func(pi peers.PeerInfo) {
+		file, err := d.getFrom(ctx, pi, key)
+		results <- replicaRead{pi: pi, file: file, err: err}
+	}
+	go read(pi)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var reads []replicaRead
+	pending, hedged := 1, false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				d.metrics.Inc(METRIC_HEDGED_READ)
+				go read(alt)
+			}
+		case r := <-results:
+			pending--
+			reads = append(reads, r)
+			if r.err == nil {
+				if r.pi.Equal(alt) {
+					d.metrics.Inc(METRIC_HEDGE_WON)
+				}
+				return reads
+			}
+			if !hedged {
+				// failed before the hedge, the caller tries alt next
+				return reads
+			}
+		}
+	}
+	return reads
+}
@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+// answers every Get after the delay of the peer
+type delayPeer struct {
+	*DPeer
+	delay map[string]time.Duration
+}
+
+func (p delayPeer) Get(ctx context.Context, pi peers.PeerInfo, key string) peers.PeerResult {
+	select {
+	case <-time.After(p.delay[pi.PName()]):
+	case <-ctx.Done():
+		return peers.PeerResult{Err: ctx.Err()}
+	}
+	return peers.PeerResult{
+		Data: []byte(pi.PName()),
+		Info: DistributeFileInfo{BasicFileInfo: NewFileInfo(key, key, "", 1, false), DPeerInfo: pi.(DPeerInfo)},
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	lt := newLatencyTracker()
+	pi := NewDPeerInfo("peer", "10.0.0.1:9632")
+	if _, ok := lt.percentile(pi, 0.95, 1); ok {
+		t.Fatal("percentile without samples")
+	}
+	for i := 1; i <= 2*LATENCY_WINDOW; i++ {
+		lt.observe(pi, time.Duration(i)*time.Millisecond)
+	}
+	// only the last LATENCY_WINDOW samples are kept
+	p := 0.95
+	p95, ok := lt.percentile(pi, p, 1)
+	rank := int(float64(LATENCY_WINDOW)*p + 0.5)
+	want := time.Duration(LATENCY_WINDOW+rank) * time.Millisecond
+	if !ok || p95 != want {
+		t.Errorf("got p95 %s, want %s", p95, want)
+	}
+}
+
+func TestHedgedGet(t *testing.T) {
+	slow := NewDPeerInfo("slow", "10.0.0.1:9632")
+	fast := NewDPeerInfo("fast", "10.0.0.2:9632")
+	p := delayPeer{
+		DPeer: NewDPeer("self", "10.0.0.0:9632", 20, nil),
+		delay: map[string]time.Duration{"slow": time.Second, "fast": 0},
+	}
+	p.PAdd(slow, fast)
+	d := NewDFS(p, t.TempDir(), 1024, nil)
+	defer d.Close()
+
+	// not enough samples, no hedge
+	reads := d.hedgedGet(context.Background(), "hedgekey", fast, slow)
+	if len(reads) != 1 || reads[0].err != nil || !reads[0].pi.Equal(fast) {
+		t.Fatalf("got reads %v", reads)
+	}
+
+	for i := 0; i < DEFAULT_HEDGE_MIN_SAMPLES; i++ {
+		d.latency.observe(slow, time.Millisecond)
+	}
+	start := time.Now()
+	reads = d.hedgedGet(context.Background(), "hedgekey", slow, fast)
+	if elapsed := time.Since(start); elapsed > time.Second/2 {
+		t.Errorf("hedged read took %s", elapsed)
+	}
+	if len(reads) != 1 || reads[0].err != nil || !reads[0].pi.Equal(fast) {
+		t.Fatalf("got reads %v, want one read from fast", reads)
+	}
+	if d.metrics.Get(METRIC_HEDGED_READ) != 1 || d.metrics.Get(METRIC_HEDGE_WON) != 1 {
+		t.Errorf("got metrics %v", d.metrics.Snapshot())
+	}
+}
@@ -0,0 +1,150 @@
+package fs
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/ciiim/cloudborad/internal/database"
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	HINT_DB_NAME = "hints"
+
+	// peer names do not start with it, so the index is apart from the hints
+	HINT_INDEX_PREFIX = "\x00key/"
+)
+
+/*
+Hinted handoff.
+
+When the owner of a block is unavailable, the coordinating peer
+stores the block locally as a hint tagged with the intended owner,
+and replays it once the owner is back online.
+
+key format in levelDB: <owner name>/<block key>,
+reads find the owners of a key by the index <HINT_INDEX_PREFIX><block key>\x00<owner name>
+*/
+type hintStore struct {
+	levelDB *leveldb.DB
+
+	// one replay per owner at the same time
+	replaying sync.Map
+}
+
+type hint struct {
+	Owner    DPeerInfo `json:"owner"`
+	Key      string    `json:"key"`
+	Filename string    `json:"filename"`
+	Value    []byte    `json:"value"`
+}
+
+func newHintStore(rootPath string) *hintStore {
+	db, err := database.NewLevelDB(rootPath + "/" + HINT_DB_NAME)
+	if err != nil {
+		panic("leveldb init error:" + err.Error())
+	}
+	return &hintStore{
+		levelDB: db,
+	}
+}
+
+func hintKey(owner peers.PeerInfo, key string) []byte {
+	return []byte(owner.PName() + "/" + key)
+}
+
+// prefix of the index entries of key, block keys have no \x00
+func hintIndexPrefix(key string) []byte {
+	return []byte(HINT_INDEX_PREFIX + key + "\x00")
+}
+
+func hintIndexKey(ownerName, key string) []byte {
+	return append(hintIndexPrefix(key), ownerName...)
+}
+
+func (h *hintStore) store(owner peers.PeerInfo, key, filename string, value []byte) error {
+	dpi, _ := owner.(DPeerInfo)
+	data, err := json.Marshal(hint{
+		Owner:    dpi,
+		Key:      key,
+		Filename: filename,
+		Value:    value,
+	})
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(hintKey(owner, key), data)
+	batch.Put(hintIndexKey(owner.PName(), key), nil)
+	return h.levelDB.Write(batch, nil)
+}
+
+// find a hint of key for any owner
+func (h *hintStore) get(key string) (hint, bool) {
+	prefix := hintIndexPrefix(key)
+	iter := h.levelDB.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		owner := string(iter.Key()[len(prefix):])
+		data, err := h.levelDB.Get([]byte(owner+"/"+key), nil)
+		if err != nil {
+			continue
+		}
+		var ht hint
+		if err := json.Unmarshal(data, &ht); err != nil {
+			continue
+		}
+		return ht, true
+	}
+	return hint{}, false
+}
+
+func (h *hintStore) delete(owner peers.PeerInfo, key string) error {
+	batch := new(leveldb.Batch)
+	batch.Delete(hintKey(owner, key))
+	batch.Delete(hintIndexKey(owner.PName(), key))
+	return h.levelDB.Write(batch, nil)
+}
+
+/*
+Send every hint of owner by put,
+
+hints that are sent successfully will be deleted.
+*/
+func (h *hintStore) replay(owner peers.PeerInfo, put func(ht hint) error) {
+	if _, loaded := h.replaying.LoadOrStore(owner.PName(), struct{}{}); loaded {
+		return
+	}
+	defer h.replaying.Delete(owner.PName())
+
+	iter := h.levelDB.NewIterator(util.BytesPrefix([]byte(owner.PName()+"/")), nil)
+	defer iter.Release()
+	var sent, failed int
+	for iter.Next() {
+		var ht hint
+		if err := json.Unmarshal(iter.Value(), &ht); err != nil {
+			log.Println("[Hint] Broken hint:", string(iter.Key()), err)
+			continue
+		}
+		if err := put(ht); err != nil {
+			log.Printf("[Hint] Replay %s to %s error: %s", ht.Key, owner.PName(), err)
+			failed++
+			continue
+		}
+		if err := h.delete(owner, ht.Key); err != nil {
+			log.Println("[Hint] Delete hint error:", err)
+		}
+		sent++
+	}
+	if sent+failed > 0 {
+		log.Printf("[Hint] Replay to %s, sent: %d, failed: %d", owner.PName(), sent, failed)
+	}
+}
+
+func (h *hintStore) Close() error {
+	return h.levelDB.Close()
+}
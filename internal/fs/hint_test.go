@@ -0,0 +1,52 @@
+package fs
+
+import (
+	"testing"
+)
+
+func TestHintReplay(t *testing.T) {
+	h := newHintStore(t.TempDir())
+	defer h.Close()
+
+	owner := NewDPeerInfo("owner", "10.0.0.1")
+	other := NewDPeerInfo("other", "10.0.0.2")
+	if err := h.store(owner, "k1", "f1", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.store(other, "k2", "f2", []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if ht, ok := h.get("k1"); !ok || string(ht.Value) != "v1" || ht.Owner.PeerName != "owner" {
+		t.Errorf("get hint k1: %v, %v", ht, ok)
+	}
+
+	var sent []string
+	h.replay(owner, func(ht hint) error {
+		sent = append(sent, ht.Key)
+		return nil
+	})
+	if len(sent) != 1 || sent[0] != "k1" {
+		t.Errorf("replay sent %v, want [k1]", sent)
+	}
+	if _, ok := h.get("k1"); ok {
+		t.Error("hint k1 should be deleted after replay")
+	}
+	if _, ok := h.get("k2"); !ok {
+		t.Error("hint k2 of other owner should be kept")
+	}
+}
+
+func TestHintIndex(t *testing.T) {
+	h := newHintStore(t.TempDir())
+	defer h.Close()
+	owner := NewDPeerInfo("owner", "10.0.0.1")
+	if err := h.store(owner, "block/1", "f", []byte("shard")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.get("block"); ok {
+		t.Error("got a hint of block/1 for block")
+	}
+	if ht, ok := h.get("block/1"); !ok || string(ht.Value) != "shard" {
+		t.Errorf("get hint block/1: %v, %v", ht, ok)
+	}
+}
@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DEFAULT_INLINE_THRESHOLD = 4 * 1024
+)
+
+/*
+InlinePolicy decides which files are kept in their metadata.
+
+Threshold - a file of at most this many bytes is stored inline,
+it costs one write to the front system instead of a block on another peer.
+0 disables it.
+
+Files uploaded by UploadSessions are not inlined, their blocks are stored already.
+
+Use Group.Set(InlinePolicy{...}) to change it.
+*/
+type InlinePolicy struct {
+	Threshold int
+}
+
+var DefaultInlinePolicy = InlinePolicy{
+	Threshold: DEFAULT_INLINE_THRESHOLD,
+}
+
+func newInlineMetaData(filename string, hash string, modTime time.Time, data []byte) Metadata {
+	return Metadata{
+		Filename:   filename,
+		Hash:       hash,
+		Size:       int64(len(data)),
+		ModTime:    modTime,
+		Blocks:     []Fileblock{},
+		Inline:     data,
+		InlineHash: blockChecksum(data),
+	}
+}
+
+/*
+Read the head of stream to find if it fits the InlinePolicy.
+
+Return the whole content and true if it fits,
+otherwise a reader of the whole stream.
+blocks - boundaries given by the client, they must match the content.
+*/
+func (g *Group) readInline(stream io.Reader, blocks []Fileblock) (io.Reader, []byte, bool, error) {
+	threshold := g.inline.Threshold
+	if threshold <= 0 {
+		return stream, nil, false, nil
+	}
+	head := make([]byte, threshold+1)
+	n, err := io.ReadFull(stream, head)
+	if err == nil {
+		return io.MultiReader(bytes.NewReader(head), stream), nil, false, nil
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, false, err
+	}
+	data := head[:n:n]
+
+	var offset int64
+	for i, block := range blocks {
+		if offset+block.Size > int64(n) {
+			return nil, nil, false, fmt.Errorf("read block %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		if block.Hash != "" && block.Hash != blockChecksum(data[offset:offset+block.Size]) {
+			return nil, nil, false, fmt.Errorf("%w: block %d", ErrBlockChecksum, block.BlockID)
+		}
+		offset += block.Size
+	}
+	if len(blocks) > 0 && offset != int64(n) {
+		return nil, nil, false, fmt.Errorf("blocks add up to %d bytes, file has %d", offset, n)
+	}
+	return nil, data, true, nil
+}
+
+/*
+Append stream to a file.
+
+An inline file stays inline while it fits the InlinePolicy,
+once it grows past it the content is promoted to blocks.
+Blocks of a file are kept, the appended data gets new blocks.
+*/
+func (g *Group) AppendFile(ctx context.Context, spaceKey, basePath, filename string, stream io.Reader) error {
+	meta, err := g.GetMetaData(ctx, filepath.Join(spaceKey, basePath, filename))
+	if err != nil {
+		return err
+	}
+	if g.upload.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.upload.Timeout)
+		defer cancel()
+	}
+
+	// the file hash given at upload does not match anymore
+	meta.Hash = ""
+	meta.ModTime = time.Now()
+	tx := g.beginUpload()
+	if len(meta.Blocks) == 0 {
+		rest, data, inline, err := g.readInline(io.MultiReader(bytes.NewReader(meta.Inline), stream), nil)
+		if err != nil {
+			return err
+		}
+		if inline {
+			return g.commitMetaData(ctx, tx, spaceKey, basePath, newInlineMetaData(filename, "", meta.ModTime, data))
+		}
+		stream = rest
+		meta.Inline, meta.InlineHash, meta.Size = nil, "", 0
+	}
+
+	blocks, err := g.storeBlocks(ctx, tx, stream, nil)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	for _, block := range blocks {
+		block.BlockID = int64(len(meta.Blocks))
+		meta.Blocks = append(meta.Blocks, block)
+		meta.Size += block.Size
+	}
+	if err := g.commitMetaData(ctx, tx, spaceKey, basePath, meta); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
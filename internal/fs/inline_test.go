@@ -0,0 +1,83 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func readFile(t *testing.T, g *Group, fullpath string) ([]byte, Metadata) {
+	t.Helper()
+	r, err := g.OpenFile(context.Background(), "sessionspace", fullpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, r.Metadata()
+}
+
+func TestInlineFile(t *testing.T) {
+	g := newSessionGroup(t)
+	g.Set(InlinePolicy{Threshold: 16})
+	ctx := context.Background()
+
+	small := "small file"
+	if err := g.StoreFile(ctx, "sessionspace", "", ".", "small", io.NopCloser(strings.NewReader(small)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, meta := readFile(t, g, "small")
+	if string(data) != small || !meta.IsInline() || len(meta.Blocks) != 0 {
+		t.Fatalf("got %q, %+v", data, meta)
+	}
+	if ok, _ := g.StoreSystems[0].(*DFS).HasBlock(ctx, meta.InlineHash); ok {
+		t.Error("inline file stored a block")
+	}
+
+	// still fits
+	if err := g.AppendFile(ctx, "sessionspace", ".", "small", strings.NewReader("+")); err != nil {
+		t.Fatal(err)
+	}
+	if data, meta = readFile(t, g, "small"); string(data) != small+"+" || !meta.IsInline() {
+		t.Fatalf("got %q, %+v", data, meta)
+	}
+
+	// grows past the threshold
+	more := " grown past the threshold"
+	if err := g.AppendFile(ctx, "sessionspace", ".", "small", strings.NewReader(more)); err != nil {
+		t.Fatal(err)
+	}
+	data, meta = readFile(t, g, "small")
+	if string(data) != small+"+"+more || meta.IsInline() || len(meta.Blocks) != 1 || meta.Size != int64(len(data)) {
+		t.Fatalf("got %q, %+v", data, meta)
+	}
+
+	// a file with blocks gets new blocks
+	if err := g.AppendFile(ctx, "sessionspace", ".", "small", strings.NewReader("tail")); err != nil {
+		t.Fatal(err)
+	}
+	data, meta = readFile(t, g, "small")
+	if string(data) != small+"+"+more+"tail" || len(meta.Blocks) != 2 || meta.Blocks[1].BlockID != 1 {
+		t.Fatalf("got %q, %+v", data, meta)
+	}
+}
+
+func TestInlineFileBoundaries(t *testing.T) {
+	g := newSessionGroup(t)
+	ctx := context.Background()
+
+	data := []byte("client blocks")
+	bad := []Fileblock{{Size: int64(len(data)), Hash: blockChecksum([]byte("other"))}}
+	if err := g.StoreFile(ctx, "sessionspace", "", ".", "bad", io.NopCloser(bytes.NewReader(data)), bad); err == nil {
+		t.Error("inline file with a wrong block hash stored")
+	}
+	short := []Fileblock{{Size: 4}}
+	if err := g.StoreFile(ctx, "sessionspace", "", ".", "short", io.NopCloser(bytes.NewReader(data)), short); err == nil {
+		t.Error("inline file longer than its blocks stored")
+	}
+}
@@ -0,0 +1,173 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps files of remote peers in memory, a down peer is unavailable
+type memPeer struct {
+	*DPeer
+	mu    *sync.Mutex
+	files map[string]map[string][]byte
+	down  map[string]bool
+	// calls by method name
+	calls map[string]int
+}
+
+func newMemPeer(self *DPeer) memPeer {
+	return memPeer{DPeer: self, mu: &sync.Mutex{}, files: map[string]map[string][]byte{}, down: map[string]bool{}, calls: map[string]int{}}
+}
+
+func (p memPeer) called(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[method]
+}
+
+func (p memPeer) Get(ctx context.Context, pi peers.PeerInfo, key string) peers.PeerResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["Get"]++
+	return p.get(pi, key)
+}
+
+// p.mu must be held
+func (p memPeer) get(pi peers.PeerInfo, key string) peers.PeerResult {
+	if p.down[pi.PName()] {
+		return peers.PeerResult{Err: status.Error(codes.Unavailable, "down")}
+	}
+	data, ok := p.files[pi.PName()][key]
+	if !ok {
+		return peers.PeerResult{Err: ErrFileNotFound}
+	}
+	return peers.PeerResult{
+		Data: data,
+		Info: DistributeFileInfo{BasicFileInfo: NewFileInfo(key, key, "", int64(len(data)), false), DPeerInfo: pi.(DPeerInfo)},
+	}
+}
+
+func (p memPeer) Put(ctx context.Context, pi peers.PeerInfo, key string, filename string, value []byte) peers.PeerResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["Put"]++
+	return p.put(pi, key, value)
+}
+
+// p.mu must be held
+func (p memPeer) put(pi peers.PeerInfo, key string, value []byte) peers.PeerResult {
+	if p.down[pi.PName()] {
+		return peers.PeerResult{Err: status.Error(codes.Unavailable, "down")}
+	}
+	if p.files[pi.PName()] == nil {
+		p.files[pi.PName()] = map[string][]byte{}
+	}
+	p.files[pi.PName()][key] = append([]byte{}, value...)
+	return peers.PeerResult{}
+}
+
+func (p memPeer) BatchGet(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["BatchGet"]++
+	if p.down[pi.PName()] {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	results := make([]BatchResult, 0, len(keys))
+	for _, key := range keys {
+		r := p.get(pi, key)
+		result := BatchResult{Key: key, Err: r.Err}
+		if r.Err == nil {
+			result.File = DistributeFile{data: r.Data, info: r.Info.(DistributeFileInfo)}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (p memPeer) BatchPut(ctx context.Context, pi peers.PeerInfo, items []BatchItem) ([]BatchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls["BatchPut"]++
+	if p.down[pi.PName()] {
+		return nil, status.Error(codes.Unavailable, "down")
+	}
+	results := make([]BatchResult, 0, len(items))
+	for _, item := range items {
+		results = append(results, BatchResult{Key: item.Key, Err: p.put(pi, item.Key, item.Value).Err})
+	}
+	return results, nil
+}
+
+func (p memPeer) BatchDelete(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error) {
+	results := make([]BatchResult, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, BatchResult{Key: key, Err: p.Delete(ctx, pi, key).Err})
+	}
+	return results, nil
+}
+
+func (p memPeer) Has(ctx context.Context, pi peers.PeerInfo, key string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[pi.PName()] {
+		return false, status.Error(codes.Unavailable, "down")
+	}
+	_, ok := p.files[pi.PName()][key]
+	return ok, nil
+}
+
+func (p memPeer) BatchHas(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error) {
+	var exists []string
+	for _, key := range keys {
+		ok, err := p.Has(ctx, pi, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			exists = append(exists, key)
+		}
+	}
+	return exists, nil
+}
+
+// files in memory have no mod time
+func (p memPeer) BatchTouch(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error) {
+	return p.BatchHas(ctx, pi, keys)
+}
+
+func (p memPeer) Delete(ctx context.Context, pi peers.PeerInfo, key string) peers.PeerResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.files[pi.PName()], key)
+	return peers.PeerResult{}
+}
+
+func (p memPeer) PSetStat(stat peers.PeerStatType) error {
+	setLocalStat(*p.DPeer, stat)
+	return nil
+}
+
+// change the stat of p in its hash map only, there is no peer to notify
+func setLocalStat(p DPeer, stat peers.PeerStatType) {
+	info := p.info
+	info.PeerStat = stat
+	p.hashMap.Update(info)
+}
+
+// a DFS on peers name0 to name<n-1> at 10.0.<net>.<i>, files of the others are in memPeer
+func newMemDFS(t *testing.T, name string, net, n int) (*DFS, memPeer) {
+	p := newMemPeer(NewDPeer(name+"0", fmt.Sprintf("10.0.%d.0:9632", net), 20, nil))
+	for i := 1; i < n; i++ {
+		p.PAdd(NewDPeerInfo(fmt.Sprintf("%s%d", name, i), fmt.Sprintf("10.0.%d.%d:9632", net, i)))
+	}
+	d := NewDFS(p, t.TempDir(), 1<<30, nil)
+	t.Cleanup(func() { d.Close() })
+	return d, p
+}
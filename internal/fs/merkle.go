@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const (
+	// number of leaves, must be a power of 2
+	MERKLE_LEAVES = 256
+)
+
+type keyEntry struct {
+	Key  string
+	Size int64
+	// checksum of the stored content
+	Hash string
+}
+
+/*
+Merkle tree over a key range.
+
+Keys are put into MERKLE_LEAVES buckets by bucketOf,
+a leaf is the hash of the sorted entries in its bucket,
+so a copy with other content differs even with the same size.
+
+nodes is a complete binary tree in heap layout,
+nodes[0] is the root, leaves are nodes[MERKLE_LEAVES-1:].
+*/
+type merkleTree struct {
+	nodes [][]byte
+}
+
+func bucketOf(key string) int {
+	return int(crc32.ChecksumIEEE([]byte(key)) % MERKLE_LEAVES)
+}
+
+func newMerkleTree(entries []keyEntry) *merkleTree {
+	buckets := make([][]keyEntry, MERKLE_LEAVES)
+	for _, e := range entries {
+		b := bucketOf(e.Key)
+		buckets[b] = append(buckets[b], e)
+	}
+
+	nodes := make([][]byte, 2*MERKLE_LEAVES-1)
+	for i, bucket := range buckets {
+		sort.Slice(bucket, func(a, b int) bool { return bucket[a].Key < bucket[b].Key })
+		h := md5.New()
+		for _, e := range bucket {
+			h.Write([]byte(e.Key + ":" + strconv.FormatInt(e.Size, 10) + ":" + e.Hash + "\n"))
+		}
+		nodes[MERKLE_LEAVES-1+i] = h.Sum(nil)
+	}
+	for i := MERKLE_LEAVES - 2; i >= 0; i-- {
+		h := md5.New()
+		h.Write(nodes[2*i+1])
+		h.Write(nodes[2*i+2])
+		nodes[i] = h.Sum(nil)
+	}
+	return &merkleTree{nodes: nodes}
+}
+
+func (t *merkleTree) Root() []byte {
+	return t.nodes[0]
+}
+
+/*
+Buckets whose leaves differ, found by descending from the root
+only into subtrees that differ.
+*/
+func (t *merkleTree) Diff(other *merkleTree) []int {
+	if other == nil || len(other.nodes) != len(t.nodes) {
+		all := make([]int, MERKLE_LEAVES)
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+	var diff []int
+	var walk func(i int)
+	walk = func(i int) {
+		if bytes.Equal(t.nodes[i], other.nodes[i]) {
+			return
+		}
+		if i >= MERKLE_LEAVES-1 {
+			diff = append(diff, i-(MERKLE_LEAVES-1))
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return diff
+}
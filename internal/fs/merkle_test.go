@@ -0,0 +1,33 @@
+package fs
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTreeDiff(t *testing.T) {
+	var entries []keyEntry
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, keyEntry{Key: fmt.Sprintf("key%d", i), Size: int64(i), Hash: fmt.Sprint(i)})
+	}
+	a := newMerkleTree(entries)
+	if diff := a.Diff(newMerkleTree(entries)); len(diff) != 0 {
+		t.Errorf("same entries, got diff %v", diff)
+	}
+
+	// missing one key, one key with another size and one with other content
+	changed := append([]keyEntry{}, entries[1:]...)
+	changed[10].Size = -1
+	changed[20].Hash = "corrupted"
+	b := newMerkleTree(changed)
+	diff := b.Diff(a)
+	want := map[int]bool{bucketOf(entries[0].Key): true, bucketOf(changed[10].Key): true, bucketOf(changed[20].Key): true}
+	if len(diff) != len(want) {
+		t.Fatalf("got diff %v, want buckets %v", diff, want)
+	}
+	for _, bucket := range diff {
+		if !want[bucket] {
+			t.Errorf("unexpected bucket %d", bucket)
+		}
+	}
+}
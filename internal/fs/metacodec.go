@@ -0,0 +1,171 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/ciiim/cloudborad/internal/fs/fspb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// a record starts with it, a legacy JSON record starts with '{'
+	META_MAGIC = "CBMETA"
+
+	// version of the body written by marshalMetaData
+	METADATA_VERSION = 1
+)
+
+var (
+	ErrMetaFormat   = errors.New("unknown metadata format")
+	ErrMetaVersion  = errors.New("metadata written by a newer version")
+	ErrMetaChecksum = errors.New("metadata checksum mismatch")
+)
+
+var metaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+Metadata is stored as META_MAGIC followed by a fspb.MetadataRecord.
+
+The record has the version of its body and a checksum over the body.
+A field added to fspb.Metadata keeps the version, old readers skip it,
+a change old readers can not skip needs a new version.
+*/
+func marshalMetaData(meta Metadata) ([]byte, error) {
+	body, err := proto.Marshal(metaDataToPB(meta))
+	if err != nil {
+		return nil, err
+	}
+	record, err := proto.Marshal(&fspb.MetadataRecord{
+		Version:  METADATA_VERSION,
+		Body:     body,
+		Checksum: crc32.Checksum(body, metaCRCTable),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(META_MAGIC), record...), nil
+}
+
+// read a record, a legacy JSON record is read too
+func readMetaDataByBytes(data []byte, metadata *Metadata) error {
+	_, err := decodeMetaData(data, metadata)
+	return err
+}
+
+// true if the record is legacy JSON, it should be migrated
+func decodeMetaData(data []byte, metadata *Metadata) (legacy bool, err error) {
+	if !bytes.HasPrefix(data, []byte(META_MAGIC)) {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+			return false, ErrMetaFormat
+		}
+		return true, json.Unmarshal(data, metadata)
+	}
+
+	var record fspb.MetadataRecord
+	if err := proto.Unmarshal(data[len(META_MAGIC):], &record); err != nil {
+		return false, fmt.Errorf("%w: %s", ErrMetaFormat, err)
+	}
+	if crc32.Checksum(record.Body, metaCRCTable) != record.Checksum {
+		return false, ErrMetaChecksum
+	}
+	switch record.Version {
+	case 1:
+		var pb fspb.Metadata
+		if err := proto.Unmarshal(record.Body, &pb); err != nil {
+			return false, fmt.Errorf("%w: %s", ErrMetaFormat, err)
+		}
+		*metadata = metaDataFromPB(&pb)
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %d", ErrMetaVersion, record.Version)
+	}
+}
+
+func metaDataToPB(meta Metadata) *fspb.Metadata {
+	pb := &fspb.Metadata{
+		Filename:   meta.Filename,
+		Hash:       meta.Hash,
+		Size:       meta.Size,
+		ModTime:    timestamppb.New(meta.ModTime),
+		Blocks:     make([]*fspb.MetaBlock, 0, len(meta.Blocks)),
+		Inline:     meta.Inline,
+		InlineHash: meta.InlineHash,
+	}
+	for _, block := range meta.Blocks {
+		pbBlock := &fspb.MetaBlock{
+			BlockId:  block.BlockID,
+			FullPath: block.FullPath,
+			Size:     block.Size,
+			Hash:     block.Hash,
+			System:   int32(block.System),
+		}
+		for _, c := range block.Mirrors {
+			pbBlock.Mirrors = append(pbBlock.Mirrors, &fspb.MetaCopy{System: int32(c.System), FullPath: c.FullPath})
+		}
+		if layout := block.Erasure; layout != nil {
+			pbBlock.Erasure = &fspb.MetaErasure{
+				DataShards:   int32(layout.DataShards),
+				ParityShards: int32(layout.ParityShards),
+				ShardSize:    layout.ShardSize,
+				Shards:       make([]*fspb.MetaShard, 0, len(layout.Shards)),
+			}
+			for _, shard := range layout.Shards {
+				pbBlock.Erasure.Shards = append(pbBlock.Erasure.Shards, &fspb.MetaShard{
+					Index:    int32(shard.Index),
+					Hash:     shard.Hash,
+					Location: shard.Location,
+					Key:      shard.Key,
+				})
+			}
+		}
+		pb.Blocks = append(pb.Blocks, pbBlock)
+	}
+	return pb
+}
+
+func metaDataFromPB(pb *fspb.Metadata) Metadata {
+	meta := Metadata{
+		Filename:   pb.Filename,
+		Hash:       pb.Hash,
+		Size:       pb.Size,
+		ModTime:    pb.ModTime.AsTime(),
+		Blocks:     make([]Fileblock, 0, len(pb.Blocks)),
+		Inline:     pb.Inline,
+		InlineHash: pb.InlineHash,
+	}
+	for _, pbBlock := range pb.Blocks {
+		block := Fileblock{
+			BlockID:  pbBlock.BlockId,
+			FullPath: pbBlock.FullPath,
+			Size:     pbBlock.Size,
+			Hash:     pbBlock.Hash,
+			System:   int(pbBlock.System),
+		}
+		for _, c := range pbBlock.Mirrors {
+			block.Mirrors = append(block.Mirrors, BlockCopy{System: int(c.System), FullPath: c.FullPath})
+		}
+		if e := pbBlock.Erasure; e != nil {
+			block.Erasure = &ErasureLayout{
+				DataShards:   int(e.DataShards),
+				ParityShards: int(e.ParityShards),
+				ShardSize:    e.ShardSize,
+				Shards:       make([]Fileshard, 0, len(e.Shards)),
+			}
+			for _, shard := range e.Shards {
+				block.Erasure.Shards = append(block.Erasure.Shards, Fileshard{
+					Index:    int(shard.Index),
+					Hash:     shard.Hash,
+					Location: shard.Location,
+					Key:      shard.Key,
+				})
+			}
+		}
+		meta.Blocks = append(meta.Blocks, block)
+	}
+	return meta
+}
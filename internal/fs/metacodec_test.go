@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/fspb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMetaDataCodec(t *testing.T) {
+	meta := Metadata{
+		Filename: "file",
+		Hash:     "filehash",
+		Size:     30,
+		ModTime:  time.Unix(1700000000, 5).UTC(),
+		Blocks: []Fileblock{
+			{BlockID: 0, FullPath: "10.0.0.1:9632@aaa", Size: 10, Hash: "aaa"},
+			{BlockID: 1, Size: 20, Hash: "bbb", Erasure: &ErasureLayout{
+				DataShards: 1, ParityShards: 1, ShardSize: 20,
+				Shards: []Fileshard{{Index: 0, Hash: "s0", Location: "10.0.0.1:9632"}, {Index: 1, Hash: "s1", Location: "10.0.0.2:9632"}},
+			}},
+		},
+	}
+	data, err := marshalMetaData(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Metadata
+	if legacy, err := decodeMetaData(data, &got); err != nil || legacy || !reflect.DeepEqual(got, meta) {
+		t.Fatalf("got %+v, %v, %v", got, legacy, err)
+	}
+
+	// legacy JSON is still read
+	old, _ := json.Marshal(meta)
+	got = Metadata{}
+	if legacy, err := decodeMetaData(old, &got); err != nil || !legacy || got.Blocks[1].Erasure.Shards[1].Hash != "s1" {
+		t.Fatalf("got %+v, %v, %v", got, legacy, err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-10] ^= 0xff
+	if err := readMetaDataByBytes(corrupted, &got); err == nil {
+		t.Error("corrupted metadata read")
+	}
+	if err := readMetaDataByBytes([]byte("garbage"), &got); !errors.Is(err, ErrMetaFormat) {
+		t.Errorf("got %v, want ErrMetaFormat", err)
+	}
+
+	body, _ := proto.Marshal(metaDataToPB(meta))
+	record, _ := proto.Marshal(&fspb.MetadataRecord{Version: METADATA_VERSION + 1, Body: body, Checksum: 0})
+	if err := readMetaDataByBytes(append([]byte(META_MAGIC), record...), &got); !errors.Is(err, ErrMetaChecksum) {
+		t.Errorf("got %v, want ErrMetaChecksum", err)
+	}
+	record, _ = proto.Marshal(&fspb.MetadataRecord{Version: METADATA_VERSION + 1, Body: body, Checksum: crc32.Checksum(body, metaCRCTable)})
+	if err := readMetaDataByBytes(append([]byte(META_MAGIC), record...), &got); !errors.Is(err, ErrMetaVersion) {
+		t.Errorf("got %v, want ErrMetaVersion", err)
+	}
+}
+
+func TestMigrateMetaData(t *testing.T) {
+	g := newSessionGroup(t)
+	ctx := context.Background()
+	front := g.FrontSystem.(*DTFS)
+
+	meta := Metadata{Filename: "old", Size: 3, InlineHash: blockChecksum([]byte("old")), Inline: []byte("old")}
+	old, _ := json.Marshal(meta)
+	if err := front.Store(ctx, "sessionspace", "old"+META_FILE_SUFFIX, old); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := marshalMetaData(Metadata{Filename: "new"})
+	if err := front.Store(ctx, "sessionspace", "new"+META_FILE_SUFFIX, current); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := g.MigrateMetaData(ctx, true)
+	if err != nil || result != (MigrateResult{Scanned: 2, Legacy: 1}) {
+		t.Fatalf("dry run got %+v, %v", result, err)
+	}
+	if result, err = g.MigrateMetaData(ctx, false); err != nil || result.Migrated != 1 {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+	if result, _ = g.MigrateMetaData(ctx, false); result.Legacy != 0 {
+		t.Errorf("legacy metadata left: %+v", result)
+	}
+	if data, _ := readFile(t, g, "old"); string(data) != "old" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -1,8 +1,11 @@
 package fs
 
 import (
-	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
 )
 
 const (
@@ -15,6 +18,15 @@ type Metadata struct {
 	Size     int64       `json:"size"`
 	ModTime  time.Time   `json:"mod_time"`
 	Blocks   []Fileblock `json:"blocks"`
+
+	// content of a small file, it has no blocks then, see InlinePolicy
+	Inline     []byte `json:"inline,omitempty"`
+	InlineHash string `json:"inline_hash,omitempty"`
+}
+
+// true if the content is in the metadata
+func (m Metadata) IsInline() bool {
+	return m.InlineHash != ""
 }
 
 type Fileblock struct {
@@ -26,10 +38,73 @@ type Fileblock struct {
 	 format: <hostip>@<block_path>
 
 	 block_path : <block_dir>/<block_name>
+
+	 a block on several peers: <hostip>@<block_path>;<hostip>@<block_path>...
+
+	 blocks stored by BlockPlacer use the block hash as block_path,
+	 hostip is the addr of the peer it landed on.
 	*/
 	FullPath string `json:"fullpath"`
 	Size     int64  `json:"size"`
 	Hash     string `json:"hash"`
+
+	// nil if the block is stored as full replicas, see ErasurePolicy
+	Erasure *ErasureLayout `json:"erasure,omitempty"`
+
+	// index of the store system that took it, reads try it first, see StorePolicy
+	System int `json:"system,omitempty"`
+
+	// full copies on the other store systems, STORE_MIRROR
+	Mirrors []BlockCopy `json:"mirrors,omitempty"`
+}
+
+// a copy of a block on store system System, FullPath is where it landed there
+type BlockCopy struct {
+	System   int    `json:"system"`
+	FullPath string `json:"fullpath,omitempty"`
+}
+
+/*
+ErasureLayout is where the shards of an erasure coded block are.
+
+Shards are ordered by index, data shards first,
+any DataShards of them rebuild the block.
+*/
+type ErasureLayout struct {
+	DataShards   int         `json:"data"`
+	ParityShards int         `json:"parity"`
+	ShardSize    int64       `json:"shard_size"`
+	Shards       []Fileshard `json:"shards"`
+}
+
+type Fileshard struct {
+	Index int `json:"index"`
+
+	// checksum of the shard
+	Hash string `json:"hash"`
+
+	/*
+	 key the shard is stored under, <block_hash>/<index>,
+	 shards of different blocks may have the same content but never share a key.
+	*/
+	Key string `json:"key,omitempty"`
+
+	// addr of the peer it is on
+	Location string `json:"location"`
+}
+
+func shardKey(blockKey string, index int) string {
+	return blockKey + "/" + strconv.Itoa(index)
+}
+
+// a block key is its checksum, only a shard key has a '/'
+func isShardKey(key string) bool {
+	return strings.Contains(key, "/")
+}
+
+// the file name of a shard on disk, a key has a '/'
+func (s Fileshard) fileName() string {
+	return strings.ReplaceAll(s.Key, "/", "_")
 }
 
 func newMetaData(filename string, hash string, size int64, modTime time.Time, blocks []Fileblock) Metadata {
@@ -50,17 +125,51 @@ func newFileBlock(fullPath string, size int64, hash string) Fileblock {
 	}
 }
 
-func readMetaDataByBytes(data []byte, metadata *Metadata) error {
-	if err := json.Unmarshal(data, metadata); err != nil {
-		return err
+// FullPath of a block that landed on these peers
+func blockFullPath(key string, locations []peers.PeerInfo) string {
+	paths := make([]string, 0, len(locations))
+	for _, pi := range locations {
+		paths = append(paths, pi.PAddr()+"@"+key)
+	}
+	return strings.Join(paths, ";")
+}
+
+// hostips in FullPath
+func (fb Fileblock) Locations() []string {
+	return fullPathLocations(fb.FullPath)
+}
+
+// hostips of the copy on store system i, nil if none is recorded there
+func (fb Fileblock) locationsOn(i int) []string {
+	if i == fb.System {
+		return fb.Locations()
+	}
+	for _, c := range fb.Mirrors {
+		if c.System == i {
+			return fullPathLocations(c.FullPath)
+		}
 	}
 	return nil
 }
 
-func marshalMetaData(meta Metadata) []byte {
-	data, err := json.Marshal(meta)
-	if err != nil {
+// store systems with a copy, see StorePolicy
+func (fb Fileblock) systems() []int {
+	systems := []int{fb.System}
+	for _, c := range fb.Mirrors {
+		systems = append(systems, c.System)
+	}
+	return systems
+}
+
+func fullPathLocations(fullPath string) []string {
+	if fullPath == "" {
 		return nil
 	}
-	return data
+	var addrs []string
+	for _, path := range strings.Split(fullPath, ";") {
+		if addr, _, ok := strings.Cut(path, "@"); ok && addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
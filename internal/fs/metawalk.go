@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+MetaWalker reads every metadata record stored on this node.
+
+Implemented by DTFS.
+*/
+type MetaWalker interface {
+	WalkMetaData(ctx context.Context, fn func(spaceKey, path string, meta Metadata) error) error
+}
+
+var _ MetaWalker = (*DTFS)(nil)
+
+var ErrNoMetaWalker = errors.New("front system can not walk metadata")
+
+/*
+Call fn with every metadata record of the spaces stored here.
+
+path - of the record in the space, with META_FILE_SUFFIX.
+A record that can not be read is logged and skipped, an error of fn stops the walk.
+*/
+func (dt *DTFS) WalkMetaData(ctx context.Context, fn func(spaceKey, path string, meta Metadata) error) error {
+	return dt.walkMetaData(ctx, false, fn)
+}
+
+// strict - a record that can not be read stops the walk, e.g. garbage collection must see every reference
+func (dt *DTFS) walkMetaData(ctx context.Context, strict bool, fn func(spaceKey, path string, meta Metadata) error) error {
+	spaces, err := dt.ListSpaces()
+	if err != nil {
+		return err
+	}
+	for _, spaceKey := range spaces {
+		err := dt.walkSpace(spaceKey, func(path string, isDir bool) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if isDir || !strings.HasSuffix(path, META_FILE_SUFFIX) {
+				return nil
+			}
+			file, err := dt.getLocally(ctx, spaceKey+"/"+path)
+			var meta Metadata
+			if err == nil {
+				err = readMetaDataByBytes(file.Data(), &meta)
+			}
+			if err != nil {
+				if strict {
+					return fmt.Errorf("read metadata %s/%s: %w", spaceKey, path, err)
+				}
+				log.Printf("[DTFS] Walk metadata %s/%s error: %s", spaceKey, path, err)
+				return nil
+			}
+			return fn(spaceKey, path, meta)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
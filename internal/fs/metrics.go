@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Metrics is a set of named counters.
+
+Each file system owns one, Group merges them for reporting.
+*/
+type Metrics struct {
+	counters sync.Map // name -> *atomic.Int64
+}
+
+type MetricsReporter interface {
+	Metrics() map[string]int64
+}
+
+const (
+	METRIC_READ_REPAIR_CHECK     = "read_repair_check"
+	METRIC_READ_REPAIR_MISSING   = "read_repair_missing"
+	METRIC_READ_REPAIR_DIVERGENT = "read_repair_divergent"
+	METRIC_READ_REPAIR_FAILED    = "read_repair_failed"
+	METRIC_RECOVER_WRITE_BACK    = "recover_write_back"
+	METRIC_SPILL_OVER            = "spill_over"
+
+	// reads served by a holder recorded in metadata, or not
+	METRIC_LOCATION_HIT  = "location_hit"
+	METRIC_LOCATION_MISS = "location_miss"
+
+	// reads sent to a second replica, and how often it answered first
+	METRIC_HEDGED_READ = "hedged_read"
+	METRIC_HEDGE_WON   = "hedge_won"
+
+	// erasure coded reads that rebuilt lost shards, and shards stored again
+	METRIC_EC_DEGRADED_READ = "ec_degraded_read"
+	METRIC_EC_SHARD_REBUILT = "ec_shard_rebuilt"
+
+	METRIC_ANTI_ENTROPY_ROUND     = "anti_entropy_round"
+	METRIC_ANTI_ENTROPY_PULLED    = "anti_entropy_pulled"
+	METRIC_ANTI_ENTROPY_PUSHED    = "anti_entropy_pushed"
+	METRIC_ANTI_ENTROPY_DIVERGENT = "anti_entropy_divergent"
+	METRIC_ANTI_ENTROPY_FAILED    = "anti_entropy_failed"
+)
+
+func (m *Metrics) counter(name string) *atomic.Int64 {
+	c, _ := m.counters.LoadOrStore(name, new(atomic.Int64))
+	return c.(*atomic.Int64)
+}
+
+func (m *Metrics) Add(name string, delta int64) {
+	m.counter(name).Add(delta)
+}
+
+func (m *Metrics) Inc(name string) {
+	m.Add(name, 1)
+}
+
+func (m *Metrics) Get(name string) int64 {
+	return m.counter(name).Load()
+}
+
+func (m *Metrics) Snapshot() map[string]int64 {
+	snap := make(map[string]int64)
+	m.counters.Range(func(key, value any) bool {
+		snap[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return snap
+}
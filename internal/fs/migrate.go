@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+)
+
+/*
+MetaMigrator rewrites legacy JSON metadata in the current format.
+
+Implemented by DTFS.
+*/
+type MetaMigrator interface {
+	MigrateMetaData(ctx context.Context, dryRun bool) (MigrateResult, error)
+}
+
+var _ MetaMigrator = (*DTFS)(nil)
+
+type MigrateResult struct {
+	// metadata files read
+	Scanned int64 `json:"scanned"`
+
+	// legacy records found, and rewritten unless it is a dry run
+	Legacy   int64 `json:"legacy"`
+	Migrated int64 `json:"migrated"`
+
+	// records that can not be read or written
+	Failed int64 `json:"failed"`
+}
+
+/*
+Rewrite legacy metadata of the spaces stored on this node.
+
+dryRun - only count the legacy records.
+
+A record that fails is logged and skipped, the last error is returned.
+It is safe to run again, records in the current format are left as they are.
+*/
+func (dt *DTFS) MigrateMetaData(ctx context.Context, dryRun bool) (MigrateResult, error) {
+	var result MigrateResult
+	spaces, err := dt.ListSpaces()
+	if err != nil {
+		return result, err
+	}
+	for _, spaceKey := range spaces {
+		e := dt.walkSpace(spaceKey, func(path string, isDir bool) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if isDir || !strings.HasSuffix(path, META_FILE_SUFFIX) {
+				return nil
+			}
+			result.Scanned++
+			if e := dt.migrateMetaFile(ctx, spaceKey, path, dryRun, &result); e != nil {
+				err = e
+				result.Failed++
+				log.Printf("[DTFS] Migrate metadata %s/%s error: %s", spaceKey, path, e)
+			}
+			return nil
+		})
+		if e != nil {
+			return result, e
+		}
+	}
+	log.Printf("[DTFS] Migrate metadata: %d scanned, %d legacy, %d migrated, %d failed",
+		result.Scanned, result.Legacy, result.Migrated, result.Failed)
+	return result, err
+}
+
+func (dt *DTFS) migrateMetaFile(ctx context.Context, spaceKey, path string, dryRun bool, result *MigrateResult) error {
+	file, err := dt.getLocally(ctx, spaceKey+"/"+path)
+	if err != nil {
+		return err
+	}
+	var meta Metadata
+	legacy, err := decodeMetaData(file.Data(), &meta)
+	if err != nil || !legacy {
+		return err
+	}
+	result.Legacy++
+	if dryRun {
+		return nil
+	}
+	data, err := marshalMetaData(meta)
+	if err != nil {
+		return err
+	}
+	if err := dt.storeLocally(ctx, spaceKey, path, data); err != nil {
+		return err
+	}
+	result.Migrated++
+	return nil
+}
+
+// migrate metadata stored on this node by the front system
+func (g *Group) MigrateMetaData(ctx context.Context, dryRun bool) (MigrateResult, error) {
+	m, ok := g.FrontSystem.(MetaMigrator)
+	if !ok {
+		return MigrateResult{}, errors.New("front system can not migrate metadata")
+	}
+	return m.MigrateMetaData(ctx, dryRun)
+}
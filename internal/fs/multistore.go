@@ -0,0 +1,315 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a block goes to the first store system that accepts it
+	STORE_FIRST = iota
+
+	// a block goes to every store system
+	STORE_MIRROR
+
+	// a block goes to the first store system,
+	// and moves to the last one when its file gets old
+	STORE_TIER
+)
+
+const (
+	DEFAULT_TIER_AFTER    = time.Hour * 24 * 7
+	DEFAULT_TIER_INTERVAL = time.Hour
+
+	// time of one tiering sweep
+	TIER_SWEEP_TIMEOUT = time.Hour
+)
+
+var (
+	ErrNoStoreSystem = errors.New("no store system")
+	ErrMirrorCopies  = errors.New("not enough mirror copies")
+)
+
+/*
+StorePolicy decides how blocks are spread over the store systems of a group.
+
+Mode - STORE_FIRST, STORE_MIRROR or STORE_TIER.
+Reads try the system a block was stored to, then the others in order.
+
+MinCopies - STORE_MIRROR: systems that must take a block, 0 means all.
+
+TierAfter - STORE_TIER: blocks of a file not modified for this long
+move to the last store system.
+The copy on the first system is left to garbage collection,
+it is collected once no file references it on that system.
+
+TierInterval - STORE_TIER: time between two tiering sweeps.
+
+Use Group.Set(StorePolicy{...}) to change it.
+*/
+type StorePolicy struct {
+	Mode         int
+	MinCopies    int
+	TierAfter    time.Duration
+	TierInterval time.Duration
+}
+
+var DefaultStorePolicy = StorePolicy{
+	Mode:         STORE_FIRST,
+	TierAfter:    DEFAULT_TIER_AFTER,
+	TierInterval: DEFAULT_TIER_INTERVAL,
+}
+
+func (p StorePolicy) check() error {
+	if p.Mode != STORE_FIRST && p.Mode != STORE_MIRROR && p.Mode != STORE_TIER {
+		return fmt.Errorf("unknown store mode %d", p.Mode)
+	}
+	if p.MinCopies < 0 {
+		return fmt.Errorf("negative mirror copies %d", p.MinCopies)
+	}
+	if p.Mode == STORE_TIER && (p.TierAfter <= 0 || p.TierInterval <= 0) {
+		return errors.New("tier policy needs TierAfter and TierInterval")
+	}
+	return nil
+}
+
+/*
+Store a block to store system i, record where it landed.
+
+erasure - erasure code it if the system can and ErasurePolicy asks for it.
+*/
+func (g *Group) storeBlockTo(ctx context.Context, i int, blockInfo *Fileblock, data []byte, erasure bool) error {
+	fs := g.StoreSystems[i]
+	blockInfo.System = i
+	if coder, ok := fs.(ErasureCoder); ok && erasure && g.erasure.DataShards > 0 && len(data) > 0 {
+		layout, err := coder.StoreShards(ctx, blockInfo.Hash, data, g.erasure)
+		if err == nil {
+			blockInfo.Erasure = layout
+		}
+		return err
+	}
+	placer, ok := fs.(BlockPlacer)
+	if !ok {
+		return fs.Store(ctx, blockInfo.Hash, blockInfo.Hash, data)
+	}
+	landed, err := placer.StoreBlock(ctx, blockInfo.Hash, blockInfo.Hash, data)
+	if len(landed) > 0 {
+		blockInfo.FullPath = blockFullPath(blockInfo.Hash, landed)
+	}
+	return err
+}
+
+/*
+Store a block to every store system in parallel.
+
+Only the first system that can erasure codes it, the others keep full copies,
+so the block can be read from any of them by its hash.
+The copy of blockInfo.System is in FullPath or Erasure, the others in Mirrors.
+*/
+func (g *Group) mirrorBlock(ctx context.Context, blockInfo *Fileblock, data []byte) error {
+	coder := -1
+	for i, fs := range g.StoreSystems {
+		if _, ok := fs.(ErasureCoder); ok {
+			coder = i
+			break
+		}
+	}
+	copies := make([]Fileblock, len(g.StoreSystems))
+	errs := make([]error, len(g.StoreSystems))
+	var wg sync.WaitGroup
+	for i := range g.StoreSystems {
+		copies[i] = *blockInfo
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = g.storeBlockTo(ctx, i, &copies[i], data, i == coder)
+		}(i)
+	}
+	wg.Wait()
+
+	// the erasure coded copy is the main one, or the first stored
+	main := -1
+	var err error
+	stored := 0
+	for i := range copies {
+		if errs[i] != nil {
+			err = errs[i]
+			log.Printf("[Group] Mirror block %s to system %d error: %s", blockInfo.Hash, i, errs[i])
+			continue
+		}
+		stored++
+		if main < 0 || copies[i].Erasure != nil {
+			main = i
+		}
+	}
+	if main >= 0 {
+		result := copies[main]
+		for i, c := range copies {
+			if errs[i] == nil && i != main {
+				result.Mirrors = append(result.Mirrors, BlockCopy{System: i, FullPath: c.FullPath})
+			}
+		}
+		*blockInfo = result
+	}
+
+	need := g.store.MinCopies
+	if need <= 0 || need > len(g.StoreSystems) {
+		need = len(g.StoreSystems)
+	}
+	if stored < need {
+		return fmt.Errorf("%w: %d of %d: %s", ErrMirrorCopies, stored, need, err)
+	}
+	return nil
+}
+
+// indexes of the store systems, first comes first
+func (g *Group) readOrder(first int) []int {
+	order := make([]int, 0, len(g.StoreSystems))
+	if first >= 0 && first < len(g.StoreSystems) {
+		order = append(order, first)
+	}
+	for i := range g.StoreSystems {
+		if i != first {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func (g *Group) getBlockFrom(ctx context.Context, i int, blockInfo Fileblock) ([]byte, error) {
+	fs := g.StoreSystems[i]
+	if coder, ok := fs.(ErasureCoder); ok && blockInfo.Erasure != nil && i == blockInfo.System {
+		data, lost, err := coder.GetShards(ctx, blockInfo.Erasure, blockInfo.Size)
+		if len(lost) > 0 {
+			g.queueShardRepair(blockInfo)
+		}
+		return data, err
+	}
+	var file File
+	var err error
+	if placer, ok := fs.(BlockPlacer); ok {
+		file, err = placer.GetAt(ctx, blockInfo.Hash, blockInfo.locationsOn(i))
+	} else {
+		file, err = fs.Get(ctx, blockInfo.Hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(file.Data())) != blockInfo.Size {
+		return nil, fmt.Errorf("block %s has %d bytes, want %d", blockInfo.Hash, len(file.Data()), blockInfo.Size)
+	}
+	return file.Data(), nil
+}
+
+func (g *Group) deleteBlockFrom(ctx context.Context, i int, blockInfo Fileblock) error {
+	fs := g.StoreSystems[i]
+	if coder, ok := fs.(ErasureCoder); ok && blockInfo.Erasure != nil && i == blockInfo.System {
+		return coder.DeleteShards(ctx, blockInfo.Erasure)
+	}
+	if placer, ok := fs.(BlockPlacer); ok {
+		return placer.DeleteAt(ctx, blockInfo.Hash, blockInfo.locationsOn(i))
+	}
+	return fs.Delete(ctx, blockInfo.Hash)
+}
+
+/*
+move old blocks to the last store system until Close,
+the policy is read on every tick, so a group set to STORE_TIER later is swept too.
+*/
+func (g *Group) runTiering() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-g.closing:
+			return
+		case now := <-ticker.C:
+			policy := g.store
+			if policy.Mode != STORE_TIER || policy.TierInterval <= 0 || now.Sub(last) < policy.TierInterval {
+				continue
+			}
+			last = now
+			ctx, cancel := context.WithTimeout(context.Background(), TIER_SWEEP_TIMEOUT)
+			if _, err := g.TierBlocks(ctx, time.Now()); err != nil {
+				log.Println("[Group] Tiering error:", err)
+			}
+			cancel()
+		}
+	}
+}
+
+/*
+Move blocks of files stored on this node and not modified since now - TierAfter
+to the last store system, and rewrite their metadata.
+
+Return the number of blocks moved.
+*/
+func (g *Group) TierBlocks(ctx context.Context, now time.Time) (int, error) {
+	walker, ok := g.FrontSystem.(MetaWalker)
+	if !ok {
+		return 0, ErrNoMetaWalker
+	}
+	last := len(g.StoreSystems) - 1
+	if last <= 0 {
+		return 0, nil
+	}
+	moved := 0
+	err := walker.WalkMetaData(ctx, func(spaceKey, path string, meta Metadata) error {
+		if now.Sub(meta.ModTime) < g.store.TierAfter {
+			return nil
+		}
+		n, err := g.tierFile(ctx, spaceKey, path, meta, last)
+		moved += n
+		if err != nil {
+			log.Printf("[Group] Tier %s/%s error: %s", spaceKey, path, err)
+		}
+		return ctx.Err()
+	})
+	return moved, err
+}
+
+func (g *Group) tierFile(ctx context.Context, spaceKey, path string, meta Metadata, last int) (int, error) {
+	moved := make(map[int64]Fileblock)
+	for _, block := range meta.Blocks {
+		if block.System >= last {
+			continue
+		}
+		data, err := g.GetBlockData(ctx, block)
+		if err != nil {
+			return 0, err
+		}
+		to := Fileblock{BlockID: block.BlockID, Size: block.Size, Hash: block.Hash}
+		if err := g.storeBlockTo(ctx, last, &to, data, true); err != nil {
+			return 0, err
+		}
+		moved[block.BlockID] = to
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	}
+
+	// read it again, so a file rewritten while its blocks moved is kept
+	current, err := g.GetMetaData(ctx, filepath.Join(spaceKey, strings.TrimSuffix(path, META_FILE_SUFFIX)))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, block := range current.Blocks {
+		if to, ok := moved[block.BlockID]; ok && block.Hash == to.Hash && block.System < last {
+			current.Blocks[i] = to
+			n++
+		}
+	}
+	data, err := marshalMetaData(current)
+	if err != nil {
+		return 0, err
+	}
+	return n, g.FrontSystem.Store(ctx, spaceKey, path, data)
+}
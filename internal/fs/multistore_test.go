@@ -0,0 +1,141 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a group with a fast and a capacity store system
+func newStoreGroup(t *testing.T) (*Group, *DFS, *DFS) {
+	front := NewDTFS(*NewDPeer("front0", "10.0.0.0:9631", 20, nil), t.TempDir())
+	t.Cleanup(func() { front.Close() })
+	g := NewGroup("store", front)
+	fast, _ := newMemDFS(t, "fast", 1, 3)
+	capacity, _ := newMemDFS(t, "cap", 2, 3)
+	g.UseFS(fast, capacity)
+	if len(g.StoreSystems) != 2 {
+		t.Fatalf("got %d store systems", len(g.StoreSystems))
+	}
+	if err := g.NewBorad(context.Background(), "storespace"); err != nil {
+		t.Fatal(err)
+	}
+	g.Set(InlinePolicy{})
+	return g, fast, capacity
+}
+
+func TestStoreMirror(t *testing.T) {
+	g, fast, capacity := newStoreGroup(t)
+	if err := g.Set(StorePolicy{Mode: STORE_MIRROR}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	data := []byte("mirrored block")
+	block := Fileblock{Size: int64(len(data)), Hash: blockChecksum(data)}
+	if err := g.StoreBlock(ctx, &block, data); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []*DFS{fast, capacity} {
+		if ok, _ := d.HasBlock(ctx, block.Hash); !ok {
+			t.Fatal("block is not mirrored")
+		}
+	}
+	// each copy records the peers of its own system
+	if len(block.Mirrors) != 1 || block.Mirrors[0].System != 1 {
+		t.Fatalf("got mirrors %+v", block.Mirrors)
+	}
+	for i, prefix := range []string{"10.0.1.", "10.0.2."} {
+		for _, addr := range block.locationsOn(i) {
+			if !strings.HasPrefix(addr, prefix) {
+				t.Errorf("system %d has location %s", i, addr)
+			}
+		}
+	}
+	if stored := g.CheckBlocks(ctx, []string{block.Hash}); !stored[block.Hash] {
+		t.Error("mirrored block reported missing")
+	}
+
+	// the other copy is read if the first is lost
+	if err := g.deleteBlockFrom(ctx, 0, block); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := g.GetBlockData(ctx, block); err != nil || string(got) != string(data) {
+		t.Errorf("got %q, %v", got, err)
+	}
+	if stored := g.CheckBlocks(ctx, []string{block.Hash}); stored[block.Hash] {
+		t.Error("block with one copy reported mirrored")
+	}
+
+	if err := g.deleteBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := capacity.HasBlock(ctx, block.Hash); ok {
+		t.Error("mirror copy is left after delete")
+	}
+}
+
+func TestStoreTier(t *testing.T) {
+	g, fast, capacity := newStoreGroup(t)
+	if err := g.Set(StorePolicy{Mode: STORE_TIER}); err == nil {
+		t.Error("tier policy without TierAfter accepted")
+	}
+	if err := g.Set(StorePolicy{Mode: STORE_TIER, TierAfter: time.Hour, TierInterval: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	content := strings.Repeat("tiered file ", 100)
+	if err := g.StoreFile(ctx, "storespace", "", ".", "tiered", io.NopCloser(strings.NewReader(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := g.GetMetaData(ctx, "storespace/tiered")
+	if err != nil || meta.Blocks[0].System != 0 {
+		t.Fatalf("got %+v, %v", meta, err)
+	}
+	if ok, _ := capacity.HasBlock(ctx, meta.Blocks[0].Hash); ok {
+		t.Fatal("new block is on the capacity tier")
+	}
+
+	if n, err := g.TierBlocks(ctx, time.Now()); err != nil || n != 0 {
+		t.Fatalf("new file moved %d blocks, %v", n, err)
+	}
+	if n, err := g.TierBlocks(ctx, time.Now().Add(time.Hour*2)); err != nil || n != 1 {
+		t.Fatalf("moved %d blocks, %v", n, err)
+	}
+	meta, _ = g.GetMetaData(ctx, "storespace/tiered")
+	if meta.Blocks[0].System != 1 {
+		t.Fatalf("got block %+v", meta.Blocks[0])
+	}
+	if ok, _ := capacity.HasBlock(ctx, meta.Blocks[0].Hash); !ok {
+		t.Fatal("block is not on the capacity tier")
+	}
+
+	// the copy on the fast tier is not referenced there anymore
+	hash := meta.Blocks[0].Hash
+	if err := fast.storeLocally(ctx, hash, hash, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	g.Set(GCPolicy{})
+	if _, err := g.CollectGarbage(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := fast.hasLocally(ctx, hash); ok {
+		t.Fatal("block is left on the fast tier")
+	}
+	if data, _ := readStoreFile(t, g, "tiered"); data != content {
+		t.Errorf("got %q", data)
+	}
+}
+
+func readStoreFile(t *testing.T, g *Group, fullpath string) (string, error) {
+	r, err := g.OpenFile(context.Background(), "storespace", fullpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
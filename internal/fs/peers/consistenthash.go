@@ -82,6 +82,33 @@ func (m *CMap) Del(infos ...PeerInfo) {
 	wg.Wait()
 }
 
+/*
+Replace the info of peers already in the map, e.g. stat changed.
+
+Peers are matched by name, unknown peers are ignored.
+*/
+func (m *CMap) Update(infos ...PeerInfo) {
+	m.rwmu.Lock()
+	defer m.rwmu.Unlock()
+	for _, pi := range infos {
+		found := false
+		for i, v := range m.realPeerInfos {
+			if v.PName() == pi.PName() {
+				m.realPeerInfos[i] = pi
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		for i := 0; i < m.replicas; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + pi.PName())))
+			m.hashMap.Store(hash, pi)
+		}
+	}
+}
+
 func (m *CMap) Get(key string) PeerInfo {
 	if len(m.peerInfosHash) == 0 {
 		return nil
@@ -130,6 +157,42 @@ func (m *CMap) GetPeerNext(key string, next int) PeerInfo {
 	index := sort.Search(len(m.peerInfosHash), func(i int) bool { return m.peerInfosHash[i] >= hash })
 	m.rwmu.Lock()
 	defer m.rwmu.Unlock()
-	info, _ := m.hashMap.Load(m.peerInfosHash[index+next%len(m.peerInfosHash)])
+	info, _ := m.hashMap.Load(m.peerInfosHash[(index+next)%len(m.peerInfosHash)])
 	return info.(PeerInfo)
 }
+
+/*
+Walk the ring clockwise from key and return distinct real peers
+in preference order.
+
+The first one is the same as Get(key).
+
+n <= 0 means return all real peers.
+*/
+func (m *CMap) GetN(key string, n int) []PeerInfo {
+	m.rwmu.RLock()
+	defer m.rwmu.RUnlock()
+	if len(m.peerInfosHash) == 0 {
+		return nil
+	}
+	if n <= 0 || n > len(m.realPeerInfos) {
+		n = len(m.realPeerInfos)
+	}
+	hash := int(m.hash([]byte(key)))
+	index := sort.Search(len(m.peerInfosHash), func(i int) bool { return m.peerInfosHash[i] >= hash })
+	seen := make(map[string]struct{}, n)
+	list := make([]PeerInfo, 0, n)
+	for i := 0; i < len(m.peerInfosHash) && len(list) < n; i++ {
+		info, ok := m.hashMap.Load(m.peerInfosHash[(index+i)%len(m.peerInfosHash)])
+		if !ok {
+			continue
+		}
+		pi := info.(PeerInfo)
+		if _, ok := seen[pi.PName()]; ok {
+			continue
+		}
+		seen[pi.PName()] = struct{}{}
+		list = append(list, pi)
+	}
+	return list
+}
@@ -15,3 +15,18 @@ func TestCMap(t *testing.T) {
 	}
 	// add
 }
+
+func TestCMapGetN(t *testing.T) {
+	m := peers.NewCMap(10, nil)
+	m.Add(fs.NewDPeerInfo("a", "http://a"), fs.NewDPeerInfo("b", "http://b"), fs.NewDPeerInfo("c", "http://c"))
+	list := m.GetN("key", 0)
+	if len(list) != 3 {
+		t.Fatalf("got %d peers, want 3", len(list))
+	}
+	if !list[0].Equal(m.Get("key")) {
+		t.Errorf("first peer %s is not the owner %s", list[0].PName(), m.Get("key").PName())
+	}
+	if len(m.GetN("key", 2)) != 2 {
+		t.Errorf("GetN(key, 2) should return 2 peers")
+	}
+}
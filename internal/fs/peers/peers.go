@@ -1,7 +1,10 @@
 // about peers
 package peers
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var (
 	ErrPeerNotFound = errors.New("peer not found")
@@ -21,6 +24,8 @@ func (a PeerActionType) String() string {
 		return "new"
 	case P_ACTION_QUIT:
 		return "quit"
+	case P_ACTION_UPDATE:
+		return "update"
 	default:
 		return "unknown"
 	}
@@ -30,6 +35,9 @@ const (
 	P_STAT_ONLINE PeerStatType = iota
 	P_STAT_OFFLINE
 	P_STAT_REMOVED
+
+	// 节点正在退役, 不再接收新的写入
+	P_STAT_DRAINING
 )
 const (
 	P_ACTION_NONE PeerActionType = iota
@@ -42,12 +50,18 @@ const (
 
 	// 节点退出集群 (主动退出)
 	P_ACTION_QUIT
+
+	// 节点信息更新 (例如状态变为 P_STAT_DRAINING)
+	P_ACTION_UPDATE
 )
 
 type Peer interface {
 	PName() string
 	PAddr() string
 	Pick(key string) PeerInfo
+
+	// distinct peers in preference order, n <= 0 means all
+	PickN(key string, n int) []PeerInfo
 	Info() PeerInfo
 	PeerGetSetDeleter
 	PeerOperator
@@ -69,9 +83,9 @@ type PeerResult struct {
 }
 
 type PeerGetSetDeleter interface {
-	Get(pi PeerInfo, key string) PeerResult
-	Put(pi PeerInfo, key string, filename string, value []byte) PeerResult
-	Delete(pi PeerInfo, key string) PeerResult
+	Get(ctx context.Context, pi PeerInfo, key string) PeerResult
+	Put(ctx context.Context, pi PeerInfo, key string, filename string, value []byte) PeerResult
+	Delete(ctx context.Context, pi PeerInfo, key string) PeerResult
 }
 
 type PeerOperator interface {
@@ -81,6 +95,12 @@ type PeerOperator interface {
 	PSync(pi PeerInfo, action PeerActionType) error
 	PActionTo(action PeerActionType, pi_to ...PeerInfo) error
 	PList() []PeerInfo
+
+	// check if pi is reachable
+	PPing(pi PeerInfo) error
+
+	// change the stat of this peer and notify other peers
+	PSetStat(stat PeerStatType) error
 }
 
 type LocalPeer struct {
@@ -99,6 +119,10 @@ func (lp LocalPeer) Pick(key string) PeerInfo {
 	return lp.Info()
 }
 
+func (lp LocalPeer) PickN(key string, n int) []PeerInfo {
+	return []PeerInfo{lp.Info()}
+}
+
 func (lp LocalPeer) Info() PeerInfo {
 	return LocalPeerInfo{
 		name: "local",
@@ -106,15 +130,15 @@ func (lp LocalPeer) Info() PeerInfo {
 	}
 }
 
-func (lp LocalPeer) Get(pi PeerInfo, key string) PeerResult {
+func (lp LocalPeer) Get(ctx context.Context, pi PeerInfo, key string) PeerResult {
 	return PeerResult{Err: errors.New("not support")}
 }
 
-func (lp LocalPeer) Put(pi PeerInfo, key string, filename string, value []byte) PeerResult {
+func (lp LocalPeer) Put(ctx context.Context, pi PeerInfo, key string, filename string, value []byte) PeerResult {
 	return PeerResult{Err: errors.New("not support")}
 }
 
-func (lp LocalPeer) Delete(pi PeerInfo, key string) PeerResult {
+func (lp LocalPeer) Delete(ctx context.Context, pi PeerInfo, key string) PeerResult {
 	return PeerResult{Err: errors.New("not support")}
 }
 
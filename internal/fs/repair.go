@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/rand"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	DEFAULT_READ_REPAIR_CHANCE = 0.1
+)
+
+/*
+ReadRepairPolicy decides how often a successful read
+also checks the replicas it did not consult.
+
+Replicas that failed before the successful one are always repaired.
+
+Use DFS.Set(ReadRepairPolicy{...}) to change it.
+*/
+type ReadRepairPolicy struct {
+	// 0 - never, 1 - every read
+	Chance float64
+}
+
+var DefaultReadRepairPolicy = ReadRepairPolicy{
+	Chance: DEFAULT_READ_REPAIR_CHANCE,
+}
+
+type replicaCopy struct {
+	pi       peers.PeerInfo
+	size     int64
+	checksum string
+}
+
+func blockChecksum(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DFS) shouldCheckReplicas() bool {
+	return d.repairPolicy.Chance > 0 && rand.Float64() < d.repairPolicy.Chance
+}
+
+/*
+Repair replicas of key in background.
+
+got - the file returned to the reader
+
+missed - replicas that did not have the file
+
+unchecked - replicas that were not consulted
+
+Blocks are keyed by their checksum, a copy is correct only if it matches the key,
+nothing is repaired if no copy does.
+A shard is not, it is checked against its layout, see Group.RepairFile.
+*/
+func (d *DFS) readRepair(ctx context.Context, key string, got File, missed []peers.PeerInfo, unchecked []peers.PeerInfo) {
+	if isShardKey(key) {
+		return
+	}
+	d.metrics.Inc(METRIC_READ_REPAIR_CHECK)
+
+	var file File
+	copies := []replicaCopy{{
+		pi:       got.Stat().PeerInfo(),
+		size:     int64(len(got.Data())),
+		checksum: blockChecksum(got.Data()),
+	}}
+	if copies[0].checksum == key {
+		file = got
+	}
+
+	for _, pi := range unchecked {
+		f, err := d.getFrom(ctx, pi, key)
+		if err != nil {
+			if !isPeerUnavailable(err) {
+				missed = append(missed, pi)
+			}
+			continue
+		}
+		c := replicaCopy{pi: pi, size: int64(len(f.Data())), checksum: blockChecksum(f.Data())}
+		copies = append(copies, c)
+		if file == nil && c.checksum == key {
+			file = f
+		}
+	}
+	if file == nil {
+		d.metrics.Inc(METRIC_READ_REPAIR_FAILED)
+		log.Printf("[DFS] Read repair: no copy of %s matches its checksum", key)
+		return
+	}
+
+	for _, pi := range missed {
+		d.metrics.Inc(METRIC_READ_REPAIR_MISSING)
+		log.Printf("[DFS] Read repair: %s missing on %s", key, pi.PName())
+		d.repairReplica(ctx, pi, key, file, false)
+	}
+	for _, c := range copies {
+		if c.checksum == key {
+			continue
+		}
+		d.metrics.Inc(METRIC_READ_REPAIR_DIVERGENT)
+		log.Printf("[DFS] Read repair: %s diverges on %s, size %d, want %d", key, c.pi.PName(), c.size, len(file.Data()))
+		d.repairReplica(ctx, c.pi, key, file, true)
+	}
+}
+
+/*
+Write file to pi.
+
+divergent - the wrong copy must be deleted first, Store will not overwrite it
+*/
+func (d *DFS) repairReplica(ctx context.Context, pi peers.PeerInfo, key string, file File, divergent bool) {
+	if divergent {
+		if err := d.deleteFrom(ctx, pi, key); err != nil && !errors.Is(err, ErrFileNotFound) {
+			d.metrics.Inc(METRIC_READ_REPAIR_FAILED)
+			log.Printf("[DFS] Read repair: delete %s on %s error: %s", key, pi.PName(), err)
+			return
+		}
+	}
+	if err := d.storeTo(ctx, pi, key, file.Stat().Name(), file.Data()); err != nil {
+		d.metrics.Inc(METRIC_READ_REPAIR_FAILED)
+		log.Printf("[DFS] Read repair: store %s to %s error: %s", key, pi.PName(), err)
+	}
+}
@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+func TestReadRepairChecksum(t *testing.T) {
+	d, p := newMemDFS(t, "peer", 0, 4)
+	ctx := context.Background()
+	good, bad := []byte("correct block"), []byte("corrupted block")
+	key := blockChecksum(good)
+
+	// most replicas agree on the corrupted copy
+	var replicas []peers.PeerInfo
+	for i, data := range [][]byte{bad, good, bad} {
+		pi := d.peerAt(fmt.Sprintf("10.0.0.%d:9632", i+1))
+		p.files[pi.PName()] = map[string][]byte{key: data}
+		replicas = append(replicas, pi)
+	}
+	got, err := d.getFrom(ctx, replicas[0], key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.readRepair(ctx, key, got, nil, replicas[1:])
+	for _, pi := range replicas {
+		if data := p.files[pi.PName()][key]; !bytes.Equal(data, good) {
+			t.Errorf("%s has %q after repair", pi.PName(), data)
+		}
+	}
+
+	// no copy to trust, nothing is overwritten
+	for _, pi := range replicas {
+		p.files[pi.PName()][key] = bad
+	}
+	d.readRepair(ctx, key, got, nil, replicas[1:])
+	for _, pi := range replicas {
+		if data := p.files[pi.PName()][key]; !bytes.Equal(data, bad) {
+			t.Errorf("%s has %q without a verified copy", pi.PName(), data)
+		}
+	}
+}
+
+func TestReadRepairSkipsShards(t *testing.T) {
+	d, p := newMemDFS(t, "peer", 0, 4)
+	ctx := context.Background()
+	shard := []byte("shard of a block")
+	key := shardKey(blockChecksum([]byte("block")), 0)
+
+	pi := d.peerAt("10.0.0.1:9632")
+	p.files[pi.PName()] = map[string][]byte{key: shard}
+	got, err := d.getFrom(ctx, pi, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.readRepair(ctx, key, got, nil, nil)
+	if n := d.metrics.Get(METRIC_READ_REPAIR_FAILED); n != 0 {
+		t.Errorf("shard counted as a failed repair %d times", n)
+	}
+}
@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+type FailureDomain int
+type DomainFallback int
+
+const (
+	// every peer is its own failure domain
+	DOMAIN_NONE FailureDomain = iota
+	DOMAIN_HOST
+	DOMAIN_RACK
+	DOMAIN_ZONE
+)
+
+const (
+	// not enough domains at the configured level,
+	// try the next smaller domain, and at last any peer.
+	FALLBACK_RELAX DomainFallback = iota
+
+	// not enough domains, place fewer replicas.
+	FALLBACK_STRICT
+)
+
+const (
+	DEFAULT_REPLICAS = 1
+)
+
+/*
+ReplicaPolicy decides how many copies of a block are stored
+and where they are placed.
+
+Use DFS.Set(ReplicaPolicy{...}) to change it.
+*/
+type ReplicaPolicy struct {
+	Replicas int
+	Domain   FailureDomain
+	Fallback DomainFallback
+}
+
+var DefaultReplicaPolicy = ReplicaPolicy{
+	Replicas: DEFAULT_REPLICAS,
+	Domain:   DOMAIN_ZONE,
+	Fallback: FALLBACK_RELAX,
+}
+
+func (d FailureDomain) String() string {
+	switch d {
+	case DOMAIN_NONE:
+		return "none"
+	case DOMAIN_HOST:
+		return "host"
+	case DOMAIN_RACK:
+		return "rack"
+	case DOMAIN_ZONE:
+		return "zone"
+	default:
+		return "unknown"
+	}
+}
+
+/*
+The failure domain of peer at level.
+
+Peer without the topology label is in its own domain,
+so a cluster without topology behaves like DOMAIN_NONE.
+*/
+func domainOf(pi peers.PeerInfo, level FailureDomain) string {
+	dpi, ok := pi.(DPeerInfo)
+	if !ok {
+		return pi.PName()
+	}
+	var label string
+	switch level {
+	case DOMAIN_ZONE:
+		label = dpi.Zone
+	case DOMAIN_RACK:
+		if dpi.Rack != "" {
+			label = dpi.Zone + "/" + dpi.Rack
+		}
+	case DOMAIN_HOST:
+		if dpi.Host != "" {
+			label = dpi.Zone + "/" + dpi.Rack + "/" + dpi.Host
+		}
+	}
+	if label == "" {
+		return "peer:" + pi.PName()
+	}
+	return label
+}
+
+/*
+Choose replicas from candidates.
+
+candidates - peers in ring preference order, the first one is the owner.
+
+A candidate is skipped if it shares a failure domain with an already-chosen replica.
+*/
+func pickReplicas(candidates []peers.PeerInfo, policy ReplicaPolicy) []peers.PeerInfo {
+	n := policy.Replicas
+	if n <= 0 {
+		n = DEFAULT_REPLICAS
+	}
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	chosen := make([]peers.PeerInfo, 0, n)
+	picked := make([]bool, len(candidates))
+
+	for level := policy.Domain; len(chosen) < n; level-- {
+		used := make(map[string]struct{}, n)
+		for _, pi := range chosen {
+			used[domainOf(pi, level)] = struct{}{}
+		}
+		for i, pi := range candidates {
+			if len(chosen) == n {
+				break
+			}
+			if picked[i] {
+				continue
+			}
+			domain := domainOf(pi, level)
+			if _, ok := used[domain]; ok && level != DOMAIN_NONE {
+				continue
+			}
+			used[domain] = struct{}{}
+			picked[i] = true
+			chosen = append(chosen, pi)
+		}
+		if policy.Fallback == FALLBACK_STRICT || level == DOMAIN_NONE {
+			break
+		}
+	}
+	return chosen
+}
+
+func containsPeer(list []peers.PeerInfo, pi peers.PeerInfo) bool {
+	for _, v := range list {
+		if v.PName() == pi.PName() {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutPeer(list []peers.PeerInfo, pi peers.PeerInfo) []peers.PeerInfo {
+	res := make([]peers.PeerInfo, 0, len(list))
+	for _, v := range list {
+		if v.PName() != pi.PName() {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func withoutDraining(list []peers.PeerInfo) []peers.PeerInfo {
+	res := make([]peers.PeerInfo, 0, len(list))
+	for _, v := range list {
+		if v.PStat() != peers.P_STAT_DRAINING {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,55 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+func testTopologyPeers() []peers.PeerInfo {
+	return []peers.PeerInfo{
+		NewDPeerInfo("a", "10.0.0.1", Topology{Zone: "z1", Rack: "r1", Host: "h1"}),
+		NewDPeerInfo("b", "10.0.0.2", Topology{Zone: "z1", Rack: "r1", Host: "h2"}),
+		NewDPeerInfo("c", "10.0.0.3", Topology{Zone: "z1", Rack: "r2", Host: "h3"}),
+		NewDPeerInfo("d", "10.0.0.4", Topology{Zone: "z2", Rack: "r3", Host: "h4"}),
+	}
+}
+
+func TestPickReplicas(t *testing.T) {
+	candidates := testTopologyPeers()
+	tests := []struct {
+		name   string
+		policy ReplicaPolicy
+		want   []string
+	}{
+		{name: "zone", policy: ReplicaPolicy{Replicas: 2, Domain: DOMAIN_ZONE}, want: []string{"a", "d"}},
+		{name: "rack", policy: ReplicaPolicy{Replicas: 3, Domain: DOMAIN_RACK}, want: []string{"a", "c", "d"}},
+		{name: "relax", policy: ReplicaPolicy{Replicas: 3, Domain: DOMAIN_ZONE}, want: []string{"a", "d", "c"}},
+		{name: "strict", policy: ReplicaPolicy{Replicas: 3, Domain: DOMAIN_ZONE, Fallback: FALLBACK_STRICT}, want: []string{"a", "d"}},
+		{name: "none", policy: ReplicaPolicy{Replicas: 2, Domain: DOMAIN_NONE}, want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickReplicas(candidates, tt.policy)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d replicas, want %d", len(got), len(tt.want))
+			}
+			for i, pi := range got {
+				if pi.PName() != tt.want[i] {
+					t.Errorf("replica %d is %s, want %s", i, pi.PName(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPickReplicasWithoutTopology(t *testing.T) {
+	candidates := []peers.PeerInfo{
+		NewDPeerInfo("a", "10.0.0.1"),
+		NewDPeerInfo("b", "10.0.0.2"),
+	}
+	got := pickReplicas(candidates, ReplicaPolicy{Replicas: 2, Domain: DOMAIN_ZONE, Fallback: FALLBACK_STRICT})
+	if len(got) != 2 {
+		t.Errorf("got %d replicas, want 2", len(got))
+	}
+}
@@ -3,6 +3,7 @@ package fs
 import (
 	"context"
 	"log"
+	"net"
 	"time"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
@@ -18,8 +19,54 @@ const (
 	FRONT_PORT      = "9631"
 	FILE_STORE_PORT = "9632"
 	_RPC_TIMEOUT    = time.Second * 5
+	_PING_TIMEOUT   = time.Second * 1
 )
 
+/*
+RPCTimeout is the deadline of each kind of rpc.
+
+It is used only when the caller's context has no deadline,
+so a caller can always set a longer or shorter one itself.
+
+Use DFS.Set(RPCTimeout{...}) or DTFS.Set before Serve to change it.
+*/
+type RPCTimeout struct {
+	Get time.Duration
+	Put time.Duration
+
+	// extra time for every MB of value to put
+	PutPerMB time.Duration
+
+	Delete time.Duration
+
+	// peer sync and peer list
+	Sync time.Duration
+
+	// small requests, e.g. ping
+	Stat time.Duration
+}
+
+var DefaultRPCTimeout = RPCTimeout{
+	Get:      _RPC_TIMEOUT,
+	Put:      _RPC_TIMEOUT,
+	PutPerMB: time.Second,
+	Delete:   _RPC_TIMEOUT,
+	Sync:     _RPC_TIMEOUT,
+	Stat:     _PING_TIMEOUT,
+}
+
+func (t RPCTimeout) forPut(size int) time.Duration {
+	return t.Put + t.PutPerMB*time.Duration(size/(1024*1024))
+}
+
+// ctx with timeout d, if ctx has no deadline yet
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
 type rpcClient struct {
 	port string
 }
@@ -30,9 +77,22 @@ func newRpcClient(port string) *rpcClient {
 	}
 }
 
+// addr of a peer includes its port, c.port is used only if it does not
+func (c *rpcClient) dial(pi peers.PeerInfo) (*grpc.ClientConn, error) {
+	addr := pi.PAddr()
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, c.port)
+	}
+	return grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(errorClientInterceptor),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(RPC_MAX_MSG_SIZE), grpc.MaxCallSendMsgSize(RPC_MAX_MSG_SIZE)),
+	)
+}
+
 func (c *rpcClient) get(ctx context.Context, pi peers.PeerInfo, key string) (File, error) {
 	log.Printf("[RPC Client] Get from %s", pi.PAddr())
-	conn, err := grpc.Dial(pi.PAddr()+":"+c.port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := c.dial(pi)
 	if err != nil {
 		return nil, err
 	}
@@ -43,40 +103,34 @@ func (c *rpcClient) get(ctx context.Context, pi peers.PeerInfo, key string) (Fil
 	if err != nil {
 		return nil, err
 	}
+	return pbGetResponseToFile(resp), nil
+}
 
+func pbGetResponseToFile(resp *fspb.GetResponse) File {
 	if resp.FileInfo.IsDir {
 		tfi := pbFileInfoToTreeFileInfo(resp.FileInfo)
 		return DTreeFile{
 			data: resp.Data,
 			info: DTreeFileInfo{
 				TreeFileInfo: tfi,
-				DPeerInfo: DPeerInfo{
-					PeerName: resp.PeerInfo.Name,
-					PeerAddr: resp.PeerInfo.Addr,
-					PeerStat: peers.PeerStatType(resp.PeerInfo.Stat),
-				},
+				DPeerInfo:    pbPeerInfoToDPeerInfo(resp.PeerInfo),
 			},
-		}, nil
+		}
 	} else {
 		bfi := pBFileInfoToBasicFileInfo(resp.FileInfo)
 		return DistributeFile{
 			data: resp.Data,
 			info: DistributeFileInfo{
 				BasicFileInfo: bfi,
-				DPeerInfo: DPeerInfo{
-					PeerName: resp.PeerInfo.Name,
-					PeerAddr: resp.PeerInfo.Addr,
-					PeerStat: peers.PeerStatType(resp.PeerInfo.Stat),
-				},
+				DPeerInfo:     pbPeerInfoToDPeerInfo(resp.PeerInfo),
 			},
-		}, nil
+		}
 	}
-
 }
 
 func (c *rpcClient) put(ctx context.Context, pi peers.PeerInfo, key string, filename string, value []byte) error {
 	log.Printf("[RPC Client] Put to %s", pi.PAddr())
-	conn, err := grpc.Dial(pi.PAddr()+":"+c.port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := c.dial(pi)
 	if err != nil {
 		return err
 	}
@@ -93,7 +147,7 @@ func (c *rpcClient) put(ctx context.Context, pi peers.PeerInfo, key string, file
 
 func (c *rpcClient) delete(ctx context.Context, pi peers.PeerInfo, key string) error {
 	log.Printf("[RPC Client] Delete file in %s", pi.PAddr())
-	conn, err := grpc.Dial(pi.PAddr()+":"+c.port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := c.dial(pi)
 	if err != nil {
 		return err
 	}
@@ -107,22 +161,153 @@ func (c *rpcClient) delete(ctx context.Context, pi peers.PeerInfo, key string) e
 	return nil
 }
 
+func (c *rpcClient) has(ctx context.Context, pi peers.PeerInfo, key string) (bool, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.Has(ctx, &fspb.Key{Key: key})
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
+
+func (c *rpcClient) batchGet(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error) {
+	log.Printf("[RPC Client] BatchGet %d keys from %s", len(keys), pi.PAddr())
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.BatchGet(ctx, toPBBatchKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]BatchResult, 0, len(resp.Results))
+	for _, r := range resp.Results {
+		result := BatchResult{Key: r.Key, Err: fromKeyError(r.Error)}
+		if result.Err == nil {
+			result.File = pbGetResponseToFile(r.File)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *rpcClient) batchPut(ctx context.Context, pi peers.PeerInfo, items []BatchItem) ([]BatchResult, error) {
+	log.Printf("[RPC Client] BatchPut %d keys to %s", len(items), pi.PAddr())
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	req := &fspb.BatchPutRequest{Items: make([]*fspb.PutRequest, 0, len(items))}
+	for _, item := range items {
+		req.Items = append(req.Items, &fspb.PutRequest{Key: &fspb.Key{Key: item.Key}, Filename: item.Filename, Value: item.Value})
+	}
+	resp, err := client.BatchPut(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return pbBatchResponseToResults(resp), nil
+}
+
+func (c *rpcClient) batchDelete(ctx context.Context, pi peers.PeerInfo, keys []string) ([]BatchResult, error) {
+	log.Printf("[RPC Client] BatchDelete %d keys in %s", len(keys), pi.PAddr())
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.BatchDelete(ctx, toPBBatchKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	return pbBatchResponseToResults(resp), nil
+}
+
+func (c *rpcClient) batchHas(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.BatchHas(ctx, toPBBatchKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Exists, nil
+}
+
+func (c *rpcClient) batchTouch(ctx context.Context, pi peers.PeerInfo, keys []string) ([]string, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.BatchTouch(ctx, toPBBatchKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Exists, nil
+}
+
+func (c *rpcClient) listRefs(ctx context.Context, pi peers.PeerInfo) ([]string, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.ListRefs(ctx, &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func toPBBatchKeys(keys []string) *fspb.BatchKeys {
+	req := &fspb.BatchKeys{Keys: make([]*fspb.Key, 0, len(keys))}
+	for _, key := range keys {
+		req.Keys = append(req.Keys, &fspb.Key{Key: key})
+	}
+	return req
+}
+
+func pbBatchResponseToResults(resp *fspb.BatchResponse) []BatchResult {
+	results := make([]BatchResult, 0, len(resp.Results))
+	for _, r := range resp.Results {
+		results = append(results, BatchResult{Key: r.Key, Err: fromKeyError(r.Error)})
+	}
+	return results
+}
+
 func (c *rpcClient) peerActionTo(ctx context.Context, target peers.PeerInfo, action peers.PeerActionType, pis ...peers.PeerInfo) error {
 	for _, pi := range pis {
 		log.Printf("[RPC Client] PeerAction: %d to %s\n", action, pi.PAddr())
-		conn, err := grpc.Dial(pi.PAddr()+":"+c.port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := c.dial(pi)
 		if err != nil {
 			log.Printf("[RPC Client] Dial %s error: %s", pi.PAddr(), err.Error())
 			continue
 		}
 
 		client := fspb.NewPeerServiceClient(conn)
-		_, err = client.PeerSync(ctx, &fspb.PeerInfo{
-			Name:   target.PName(),
-			Addr:   target.PAddr(),
-			Stat:   int64(target.PStat()),
-			Action: int64(action),
-		})
+		_, err = client.PeerSync(ctx, dPeerInfoToPBPeerInfo(target, action))
 		conn.Close()
 		if err != nil {
 			log.Printf("[RPC Client] PeerAction %d to %s error: %s", action, pi.PAddr(), err.Error())
@@ -134,7 +319,7 @@ func (c *rpcClient) peerActionTo(ctx context.Context, target peers.PeerInfo, act
 
 func (c *rpcClient) getPeerList(ctx context.Context, pi peers.PeerInfo) ([]peers.PeerInfo, error) {
 	log.Printf("[RPC Client] GetPeerList from %s", pi.PAddr())
-	conn, err := grpc.Dial(pi.PAddr()+":"+c.port, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := c.dial(pi)
 	if err != nil {
 		return nil, err
 	}
@@ -147,7 +332,80 @@ func (c *rpcClient) getPeerList(ctx context.Context, pi peers.PeerInfo) ([]peers
 	}
 	var pis []peers.PeerInfo
 	for _, pi := range resp.Peers {
-		pis = append(pis, NewDPeerInfo(pi.Name, pi.Addr))
+		pis = append(pis, pbPeerInfoToDPeerInfo(pi))
 	}
 	return pis, nil
 }
+
+func (c *rpcClient) ping(ctx context.Context, pi peers.PeerInfo) error {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	_, err = client.Ping(ctx, &emptypb.Empty{})
+	return err
+}
+
+func (c *rpcClient) stats(ctx context.Context, pi peers.PeerInfo) (NodeStats, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return NodeStats{}, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.Stats(ctx, &emptypb.Empty{})
+	if err != nil {
+		return NodeStats{}, err
+	}
+	return NodeStats{
+		Peer:     pbPeerInfoToDPeerInfo(resp.Peer),
+		Capacity: resp.Capacity,
+		Occupy:   resp.Occupy,
+		Blocks:   resp.Blocks,
+		Spaces:   resp.Spaces,
+		Load:     resp.Load,
+	}, nil
+}
+
+// self - the requesting peer
+func (c *rpcClient) merkleTree(ctx context.Context, pi peers.PeerInfo, self peers.PeerInfo) (*merkleTree, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	resp, err := client.MerkleTree(ctx, &fspb.MerkleRequest{Peer: dPeerInfoToPBPeerInfo(self, peers.P_ACTION_NONE)})
+	if err != nil {
+		return nil, err
+	}
+	return &merkleTree{nodes: resp.Nodes}, nil
+}
+
+func (c *rpcClient) listKeys(ctx context.Context, pi peers.PeerInfo, self peers.PeerInfo, buckets []int) ([]keyEntry, error) {
+	conn, err := c.dial(pi)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := fspb.NewPeerServiceClient(conn)
+	req := &fspb.ListKeysRequest{Peer: dPeerInfoToPBPeerInfo(self, peers.P_ACTION_NONE)}
+	for _, b := range buckets {
+		req.Buckets = append(req.Buckets, int32(b))
+	}
+	resp, err := client.ListKeys(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]keyEntry, 0, len(resp.Keys))
+	for _, e := range resp.Keys {
+		entries = append(entries, keyEntry{Key: e.Key, Size: e.Size, Hash: e.Hash})
+	}
+	return entries, nil
+}
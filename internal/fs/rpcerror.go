@@ -0,0 +1,160 @@
+package fs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ciiim/cloudborad/internal/fs/fspb"
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// domain of the ErrorInfo detail attached by rpc server
+	RPC_ERROR_DOMAIN = "cloudborad.fs"
+)
+
+/*
+Sentinel errors that keep their identity across the rpc boundary.
+
+The server sends code and reason, the client turns the reason
+back into the same sentinel, so errors.Is works for remote errors too.
+*/
+type rpcErrorEntry struct {
+	err    error
+	code   codes.Code
+	reason string
+}
+
+var rpcErrors = []rpcErrorEntry{
+	{ErrFileNotFound, codes.NotFound, "FILE_NOT_FOUND"},
+	{ErrSpaceNotFound, codes.NotFound, "SPACE_NOT_FOUND"},
+	{ErrFileExist, codes.AlreadyExists, "FILE_EXIST"},
+	{ErrSpaceExist, codes.AlreadyExists, "SPACE_EXIST"},
+	{ErrFull, codes.ResourceExhausted, "FULL"},
+	{ErrSpaceFull, codes.ResourceExhausted, "SPACE_FULL"},
+	{ErrFileInvalidName, codes.InvalidArgument, "INVALID_NAME"},
+	{ErrNotDir, codes.FailedPrecondition, "NOT_DIR"},
+	{ErrNoPeerToTakeOver, codes.FailedPrecondition, "NO_PEER_TO_TAKE_OVER"},
+	// not Unavailable, the peer itself is reachable
+	{peers.ErrPeerNotFound, codes.FailedPrecondition, "PEER_NOT_FOUND"},
+	{ErrInternal, codes.Internal, "INTERNAL"},
+	{ErrSpaceInternal, codes.Internal, "SPACE_INTERNAL"},
+}
+
+/*
+remoteError is an error returned by another peer.
+
+Error() is the message from the server,
+errors.Is matches the sentinel and status.Code still works.
+*/
+type remoteError struct {
+	sentinel error
+	st       *status.Status
+}
+
+func (e *remoteError) Error() string {
+	return e.st.Message()
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.sentinel
+}
+
+func (e *remoteError) GRPCStatus() *status.Status {
+	return e.st
+}
+
+// convert err to a grpc status error, used by rpc server
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	for _, e := range rpcErrors {
+		if !errors.Is(err, e.err) {
+			continue
+		}
+		st, derr := status.New(e.code, err.Error()).WithDetails(&errdetails.ErrorInfo{
+			Reason: e.reason,
+			Domain: RPC_ERROR_DOMAIN,
+		})
+		if derr != nil {
+			return status.Error(e.code, err.Error())
+		}
+		return st.Err()
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// convert a grpc status error back to the sentinel, used by rpc client
+func fromStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != RPC_ERROR_DOMAIN {
+			continue
+		}
+		for _, e := range rpcErrors {
+			if e.reason == info.Reason {
+				return &remoteError{sentinel: e.err, st: st}
+			}
+		}
+	}
+	return err
+}
+
+// error of one key in a batch response
+func toKeyError(err error) *fspb.KeyError {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(toStatusError(err))
+	ke := &fspb.KeyError{Code: int32(st.Code()), Message: st.Message()}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == RPC_ERROR_DOMAIN {
+			ke.Reason = info.Reason
+		}
+	}
+	return ke
+}
+
+func fromKeyError(ke *fspb.KeyError) error {
+	if ke == nil {
+		return nil
+	}
+	st := status.New(codes.Code(ke.Code), ke.Message)
+	if ke.Reason != "" {
+		if withInfo, err := st.WithDetails(&errdetails.ErrorInfo{Reason: ke.Reason, Domain: RPC_ERROR_DOMAIN}); err == nil {
+			st = withInfo
+		}
+	}
+	return fromStatusError(st.Err())
+}
+
+func errorServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	return resp, toStatusError(err)
+}
+
+func errorClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return fromStatusError(invoker(ctx, method, req, reply, cc, opts...))
+}
@@ -0,0 +1,42 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRPCErrorRoundTrip(t *testing.T) {
+	for _, e := range rpcErrors {
+		wrapped := fmt.Errorf("get key: %w", e.err)
+		err := fromStatusError(toStatusError(wrapped))
+		if !errors.Is(err, e.err) {
+			t.Errorf("%s: got %v, want errors.Is %v", e.reason, err, e.err)
+		}
+		if code := status.Code(err); code != e.code {
+			t.Errorf("%s: got code %s, want %s", e.reason, code, e.code)
+		}
+		if err.Error() != wrapped.Error() {
+			t.Errorf("%s: got message %q, want %q", e.reason, err.Error(), wrapped.Error())
+		}
+	}
+
+	err := fromStatusError(toStatusError(errors.New("boom")))
+	if status.Code(err) != codes.Unknown {
+		t.Errorf("unknown error: got code %s", status.Code(err))
+	}
+	for _, e := range rpcErrors {
+		if errors.Is(err, e.err) {
+			t.Errorf("unknown error matches %v", e.err)
+		}
+	}
+
+	// transport errors are kept as they are
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	if err := fromStatusError(toStatusError(unavailable)); !isPeerUnavailable(err) {
+		t.Errorf("unavailable: got %v", err)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ciiim/cloudborad/internal/fs/peers"
 
 	"github.com/ciiim/cloudborad/internal/fs/fspb"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -17,21 +21,50 @@ import (
 // RPC Server Port : 9632
 
 type rpcServer struct {
-	fs DistributeFileSystem
+	fs    DistributeFileSystem
+	local localFileSystem
 	fspb.UnimplementedPeerServiceServer
+
+	// requests being served, reported as load
+	inflight atomic.Int64
 }
 
+/*
+Operations on the data stored on this peer.
+
+Requests from other peers are already routed to this peer,
+rpc server must not route them again.
+*/
+type localFileSystem interface {
+	getLocally(ctx context.Context, key string) (File, error)
+	storeLocally(ctx context.Context, key, name string, value []byte) error
+	deleteLocally(ctx context.Context, key string) error
+	hasLocally(ctx context.Context, key string) (bool, error)
+}
+
+var _ localFileSystem = (*DFS)(nil)
+var _ localFileSystem = (*DTFS)(nil)
+
 func newRpcServer(fs DistributeFileSystem) *rpcServer {
+	local, ok := fs.(localFileSystem)
+	if !ok {
+		panic("rpc server: file system cannot be operated locally")
+	}
 	return &rpcServer{
-		fs: fs,
+		fs:    fs,
+		local: local,
 	}
 }
 
 func (r *rpcServer) Get(ctx context.Context, key *fspb.Key) (*fspb.GetResponse, error) {
-	file, err := r.fs.Get(key.Key)
+	file, err := r.local.getLocally(ctx, key.Key)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
+	return fileToPBGetResponse(file), nil
+}
+
+func fileToPBGetResponse(file File) *fspb.GetResponse {
 	fi := file.Stat()
 
 	//convert subdir to pb.SubInfo
@@ -59,66 +92,239 @@ func (r *rpcServer) Get(ctx context.Context, key *fspb.Key) (*fspb.GetResponse,
 			IsDir:    fi.IsDir(),
 			DirInfo:  pbSubDir,
 		},
-		PeerInfo: &fspb.PeerInfo{
-			Name:   fi.PeerInfo().PName(),
-			Addr:   fi.PeerInfo().PAddr(),
-			Stat:   int64(fi.PeerInfo().PStat()),
-			Action: int64(peers.P_ACTION_NONE),
-		},
-	}, nil
+		PeerInfo: dPeerInfoToPBPeerInfo(fi.PeerInfo(), peers.P_ACTION_NONE),
+	}
 }
 
 func (r *rpcServer) Put(ctx context.Context, req *fspb.PutRequest) (*emptypb.Empty, error) {
-	if err := r.fs.Store(req.Key.Key, req.Filename, req.Value); err != nil {
-		return &emptypb.Empty{}, err
+	if err := r.local.storeLocally(ctx, req.Key.Key, req.Filename, req.Value); err != nil {
+		return nil, err
 	}
 	return &emptypb.Empty{}, nil
 }
 
 func (r *rpcServer) Delete(ctx context.Context, key *fspb.Key) (*emptypb.Empty, error) {
-	if err := r.fs.Delete(key.Key); err != nil {
-		return &emptypb.Empty{}, err
+	if err := r.local.deleteLocally(ctx, key.Key); err != nil {
+		return nil, err
 	}
 	return &emptypb.Empty{}, nil
 }
 
+func (r *rpcServer) Has(ctx context.Context, key *fspb.Key) (*fspb.HasResponse, error) {
+	exists, err := r.local.hasLocally(ctx, key.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &fspb.HasResponse{Exists: exists}, nil
+}
+
+/*
+Answer the keys in order until their data passes BATCH_MAX_BYTES,
+at least one is answered, the client asks the rest again.
+*/
+func (r *rpcServer) BatchGet(ctx context.Context, req *fspb.BatchKeys) (*fspb.BatchGetResponse, error) {
+	resp := &fspb.BatchGetResponse{Results: make([]*fspb.BatchGetResult, 0, len(req.Keys))}
+	size := 0
+	for _, key := range req.Keys {
+		result := &fspb.BatchGetResult{Key: key.Key}
+		file, err := r.local.getLocally(ctx, key.Key)
+		if err != nil {
+			result.Error = toKeyError(err)
+		} else {
+			if size > 0 && size+len(file.Data()) > BATCH_MAX_BYTES {
+				break
+			}
+			size += len(file.Data())
+			result.File = fileToPBGetResponse(file)
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	return resp, nil
+}
+
+func (r *rpcServer) BatchPut(ctx context.Context, req *fspb.BatchPutRequest) (*fspb.BatchResponse, error) {
+	resp := &fspb.BatchResponse{Results: make([]*fspb.BatchResult, 0, len(req.Items))}
+	for _, item := range req.Items {
+		err := r.local.storeLocally(ctx, item.Key.Key, item.Filename, item.Value)
+		resp.Results = append(resp.Results, &fspb.BatchResult{Key: item.Key.Key, Error: toKeyError(err)})
+	}
+	return resp, nil
+}
+
+func (r *rpcServer) BatchDelete(ctx context.Context, req *fspb.BatchKeys) (*fspb.BatchResponse, error) {
+	resp := &fspb.BatchResponse{Results: make([]*fspb.BatchResult, 0, len(req.Keys))}
+	for _, key := range req.Keys {
+		err := r.local.deleteLocally(ctx, key.Key)
+		resp.Results = append(resp.Results, &fspb.BatchResult{Key: key.Key, Error: toKeyError(err)})
+	}
+	return resp, nil
+}
+
+func (r *rpcServer) BatchHas(ctx context.Context, req *fspb.BatchKeys) (*fspb.BatchHasResponse, error) {
+	resp := &fspb.BatchHasResponse{}
+	for _, key := range req.Keys {
+		exists, err := r.local.hasLocally(ctx, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			resp.Exists = append(resp.Exists, key.Key)
+		}
+	}
+	return resp, nil
+}
+
+func (r *rpcServer) BatchTouch(ctx context.Context, req *fspb.BatchKeys) (*fspb.BatchHasResponse, error) {
+	t, ok := r.fs.(blockToucher)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "blocks are not stored here")
+	}
+	resp := &fspb.BatchHasResponse{}
+	for _, key := range req.Keys {
+		exists, err := t.touchLocally(ctx, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			resp.Exists = append(resp.Exists, key.Key)
+		}
+	}
+	return resp, nil
+}
+
 func (r *rpcServer) ListPeer(ctx context.Context, empty *emptypb.Empty) (*fspb.PeerList, error) {
 	list := r.fs.Peer().PList()
 	pbList := make([]*fspb.PeerInfo, 0, len(list))
 	for _, v := range list {
-		pbList = append(pbList, &fspb.PeerInfo{
-			Name:   v.PName(),
-			Addr:   v.PAddr(),
-			Stat:   int64(v.PStat()),
-			Action: int64(peers.P_ACTION_NONE),
-		})
+		pbList = append(pbList, dPeerInfoToPBPeerInfo(v, peers.P_ACTION_NONE))
 	}
 	return &fspb.PeerList{
 		Peers: pbList,
 	}, nil
 }
 
-func (r *rpcServer) GetPeerAction(ctx context.Context, pi *fspb.PeerInfo) (*emptypb.Empty, error) {
-	if err := r.fs.Peer().PSync(DPeerInfo{
-		PeerName: pi.Name,
-		PeerAddr: pi.Addr,
-		PeerStat: peers.PeerStatType(pi.Stat),
-	}, peers.PeerActionType(pi.GetAction())); err != nil {
-		return &emptypb.Empty{}, err
+func (r *rpcServer) PeerSync(ctx context.Context, pi *fspb.PeerInfo) (*fspb.PeerList, error) {
+	if err := r.fs.Peer().PSync(pbPeerInfoToDPeerInfo(pi), peers.PeerActionType(pi.GetAction())); err != nil {
+		return nil, err
 	}
-	return &emptypb.Empty{}, nil
+	return r.ListPeer(ctx, &emptypb.Empty{})
+}
+
+func (r *rpcServer) Ping(ctx context.Context, empty *emptypb.Empty) (*fspb.PeerInfo, error) {
+	return dPeerInfoToPBPeerInfo(r.fs.Peer().Info(), peers.P_ACTION_NONE), nil
+}
+
+func (r *rpcServer) Stats(ctx context.Context, empty *emptypb.Empty) (*fspb.NodeStats, error) {
+	src, ok := r.fs.(statsSource)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "stats is not supported")
+	}
+	stats := src.localStats()
+	return &fspb.NodeStats{
+		Peer:     dPeerInfoToPBPeerInfo(stats.Peer, peers.P_ACTION_NONE),
+		Capacity: stats.Capacity,
+		Occupy:   stats.Occupy,
+		Blocks:   stats.Blocks,
+		Spaces:   stats.Spaces,
+		// not counting this request
+		Load: r.inflight.Load() - 1,
+	}, nil
+}
+
+// count requests being served
+func (r *rpcServer) loadInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	r.inflight.Add(1)
+	defer r.inflight.Add(-1)
+	return handler(ctx, req)
+}
+
+func (r *rpcServer) MerkleTree(ctx context.Context, req *fspb.MerkleRequest) (*fspb.MerkleResponse, error) {
+	src, ok := r.fs.(merkleSource)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "anti-entropy is not supported")
+	}
+	tree := src.merkleTreeFor(pbPeerInfoToDPeerInfo(req.Peer))
+	return &fspb.MerkleResponse{Nodes: tree.nodes}, nil
+}
+
+func (r *rpcServer) ListKeys(ctx context.Context, req *fspb.ListKeysRequest) (*fspb.KeyList, error) {
+	src, ok := r.fs.(merkleSource)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "anti-entropy is not supported")
+	}
+	buckets := make([]int, 0, len(req.Buckets))
+	for _, b := range req.Buckets {
+		buckets = append(buckets, int(b))
+	}
+	entries := src.sharedKeys(pbPeerInfoToDPeerInfo(req.Peer), buckets)
+	list := &fspb.KeyList{Keys: make([]*fspb.KeyEntry, 0, len(entries))}
+	for _, e := range entries {
+		list.Keys = append(list.Keys, &fspb.KeyEntry{Key: e.Key, Size: e.Size, Hash: e.Hash})
+	}
+	return list, nil
 }
 
-func (r *rpcServer) run(port string) {
+func (r *rpcServer) ListRefs(ctx context.Context, empty *emptypb.Empty) (*fspb.RefList, error) {
+	src, ok := r.fs.(refSource)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "metadata is not stored here")
+	}
+	keys, err := src.referencedKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fspb.RefList{Keys: keys}, nil
+}
+
+// the port of a file system, bound by Listen or by Serve
+type rpcPort struct {
+	mu sync.Mutex
+	l  net.Listener
+}
+
+// bind the port of addr, defaultPort if addr has none, once
+func (p *rpcPort) listen(addr, defaultPort string) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.l != nil {
+		return p.l, nil
+	}
+	port := defaultPort
+	if _, ap, err := net.SplitHostPort(addr); err == nil && ap != "" {
+		port = ap
+	}
 	l, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		return
+		return nil, err
 	}
 	log.Printf("[RPC Server] Listen: %s\n", l.Addr())
-	s := grpc.NewServer()
+	p.l = l
+	return l, nil
+}
+
+// a port that is never served is released too
+func (p *rpcPort) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.l != nil {
+		p.l.Close()
+	}
+}
+
+// serve on l until done is closed
+func (r *rpcServer) run(l net.Listener, done <-chan struct{}) {
+	// sentinel errors are sent as status with details, see rpcerror.go
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(errorServerInterceptor, r.loadInterceptor),
+		grpc.MaxRecvMsgSize(RPC_MAX_MSG_SIZE),
+		grpc.MaxSendMsgSize(RPC_MAX_MSG_SIZE),
+	)
 	fspb.RegisterPeerServiceServer(s, r)
-	err = s.Serve(l)
-	if err != nil {
+	go func() {
+		<-done
+		s.Stop()
+	}()
+	if err := s.Serve(l); err != nil {
 		log.Println("[RPC Server] Server shutdown:", err)
 		return
 	}
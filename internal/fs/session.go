@@ -0,0 +1,368 @@
+package fs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/database"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	SESSION_DB_NAME = "sessions"
+
+	DEFAULT_SESSION_TTL     = time.Hour * 24
+	SESSION_EXPIRE_INTERVAL = time.Minute
+)
+
+var (
+	ErrSessionNotFound   = errors.New("upload session not found")
+	ErrSessionIncomplete = errors.New("upload session has missing blocks")
+	ErrBlockNotInSession = errors.New("block is not in the upload session")
+)
+
+/*
+UploadSession is a resumable upload.
+
+Blocks are uploaded by index in any order,
+the file appears when the session is finalized.
+*/
+type UploadSession struct {
+	ID       string `json:"id"`
+	SpaceKey string `json:"space"`
+	BasePath string `json:"base"`
+	Filename string `json:"filename"`
+	FileHash string `json:"hash"`
+	Size     int64  `json:"size"`
+
+	// blocks declared at creation, a received block has where it landed
+	Blocks   []Fileblock `json:"blocks"`
+	Received []bool      `json:"received"`
+
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// indexes of the blocks not received yet
+func (s UploadSession) Missing() []int {
+	missing := make([]int, 0, len(s.Blocks))
+	for i, ok := range s.Received {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+type uploadSession struct {
+	UploadSession
+	tx *uploadTx
+}
+
+/*
+UploadSessions keeps resumable uploads of a group.
+
+Sessions are saved in levelDB under rootPath and restored by NewUploadSessions,
+a session expires ttl after its last block.
+*/
+type UploadSessions struct {
+	g       *Group
+	levelDB *leveldb.DB
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*uploadSession
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewUploadSessions(g *Group, rootPath string, ttl time.Duration) (*UploadSessions, error) {
+	db, err := database.NewLevelDB(rootPath + "/" + SESSION_DB_NAME)
+	if err != nil {
+		return nil, err
+	}
+	us := &UploadSessions{
+		g:        g,
+		levelDB:  db,
+		ttl:      ttl,
+		sessions: make(map[string]*uploadSession),
+		closing:  make(chan struct{}),
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var s UploadSession
+		err := json.Unmarshal(iter.Value(), &s)
+		if err == nil && len(s.Received) != len(s.Blocks) {
+			err = errors.New("block count mismatch")
+		}
+		if err != nil {
+			log.Println("[Session] Broken session:", string(iter.Key()), err)
+			continue
+		}
+		// hold its blocks again, so garbage collection keeps them
+		tx := g.beginUpload()
+		for i, block := range s.Blocks {
+			if s.Received[i] {
+				tx.hold(block.Hash)
+			}
+		}
+		us.sessions[s.ID] = &uploadSession{UploadSession: s, tx: tx}
+	}
+	if len(us.sessions) > 0 {
+		log.Printf("[Session] Restore %d upload sessions", len(us.sessions))
+	}
+	return us, iter.Error()
+}
+
+/*
+Create a session for a file.
+
+blocks - every block with its Size and Hash, the sizes must add up to size,
+other fields are ignored
+
+Blocks already stored in the group are received at creation,
+a session whose blocks are all stored can be finalized right away.
+*/
+func (us *UploadSessions) Create(ctx context.Context, spaceKey, basePath, filename, fileHash string, size int64, blocks []Fileblock) (UploadSession, error) {
+	if len(blocks) == 0 {
+		return UploadSession{}, errors.New("upload session: no blocks")
+	}
+	var total int64
+	for i, block := range blocks {
+		if block.Hash == "" {
+			return UploadSession{}, fmt.Errorf("upload session: block %d needs a hash", i)
+		}
+		block.BlockID = int64(i)
+		if err := checkBlockSize(block); err != nil {
+			return UploadSession{}, fmt.Errorf("upload session: %w", err)
+		}
+		total += block.Size
+	}
+	if total != size {
+		return UploadSession{}, fmt.Errorf("upload session: blocks add up to %d bytes, file has %d", total, size)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return UploadSession{}, err
+	}
+	s := &uploadSession{
+		UploadSession: UploadSession{
+			ID:        hex.EncodeToString(id),
+			SpaceKey:  spaceKey,
+			BasePath:  basePath,
+			Filename:  filename,
+			FileHash:  fileHash,
+			Size:      size,
+			Blocks:    make([]Fileblock, len(blocks)),
+			Received:  make([]bool, len(blocks)),
+			ExpiresAt: time.Now().Add(us.TTL()),
+		},
+		tx: us.g.beginUpload(),
+	}
+	// where a block is, is up to the group, not the client
+	hashes := make([]string, len(blocks))
+	for i, block := range blocks {
+		s.Blocks[i] = Fileblock{BlockID: int64(i), Size: block.Size, Hash: block.Hash}
+		hashes[i] = block.Hash
+		// held before the check, so garbage collection does not remove it after
+		s.tx.hold(hashes[i])
+	}
+	located := us.g.locateBlocks(ctx, hashes)
+	for i, hash := range hashes {
+		if at, ok := located[hash]; ok {
+			s.Blocks[i].System, s.Blocks[i].Mirrors = at.System, at.Mirrors
+			s.Received[i] = true
+		}
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if err := us.save(s.UploadSession); err != nil {
+		s.tx.rollback()
+		return UploadSession{}, err
+	}
+	us.sessions[s.ID] = s
+	return s.UploadSession, nil
+}
+
+func (us *UploadSessions) TTL() time.Duration {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.ttl
+}
+
+// change the ttl, a session gets it from its next block
+func (us *UploadSessions) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("session ttl must be positive")
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.ttl = ttl
+	return nil
+}
+
+func (us *UploadSessions) Get(id string) (UploadSession, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	s, ok := us.sessions[id]
+	if !ok {
+		return UploadSession{}, ErrSessionNotFound
+	}
+	return s.copy(), nil
+}
+
+/*
+Store block index of a session, it must match the declared size and hash.
+
+Blocks of a session may be put in parallel,
+a block that is already received is not stored again.
+*/
+func (us *UploadSessions) PutBlock(ctx context.Context, id string, index int, data []byte) (UploadSession, error) {
+	us.mu.Lock()
+	s, ok := us.sessions[id]
+	if !ok {
+		us.mu.Unlock()
+		return UploadSession{}, ErrSessionNotFound
+	}
+	if index < 0 || index >= len(s.Blocks) {
+		us.mu.Unlock()
+		return UploadSession{}, ErrBlockNotInSession
+	}
+	block := s.Blocks[index]
+	received := s.Received[index]
+	us.mu.Unlock()
+
+	if received {
+		return us.Get(id)
+	}
+	if int64(len(data)) != block.Size || blockChecksum(data) != block.Hash {
+		return UploadSession{}, fmt.Errorf("%w: block %d", ErrBlockChecksum, index)
+	}
+	if err := us.g.storeUploadBlock(ctx, s.tx, &block, data); err != nil {
+		return UploadSession{}, err
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if _, ok := us.sessions[id]; !ok {
+		// aborted while the block was stored
+		return UploadSession{}, ErrSessionNotFound
+	}
+	s.Blocks[index] = block
+	s.Received[index] = true
+	s.ExpiresAt = time.Now().Add(us.ttl)
+	if err := us.save(s.UploadSession); err != nil {
+		return UploadSession{}, err
+	}
+	return s.copy(), nil
+}
+
+// write the metadata of the file once every block is received
+func (us *UploadSessions) Finalize(ctx context.Context, id string) error {
+	us.mu.Lock()
+	s, ok := us.sessions[id]
+	if !ok {
+		us.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	if missing := s.Missing(); len(missing) > 0 {
+		us.mu.Unlock()
+		return fmt.Errorf("%w: %d of %d", ErrSessionIncomplete, len(missing), len(s.Blocks))
+	}
+	session := s.copy()
+	us.mu.Unlock()
+
+	// the session is kept if it fails, so it can be finalized again
+	err := us.g.commitUpload(ctx, s.tx, session.SpaceKey, session.FileHash, session.BasePath, session.Filename, session.Blocks)
+	if err != nil {
+		return err
+	}
+	us.remove(id)
+	return nil
+}
+
+// remove a session and the blocks it created, see uploadTx
+func (us *UploadSessions) Abort(id string) error {
+	s := us.remove(id)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+	s.tx.rollback()
+	return nil
+}
+
+func (us *UploadSessions) remove(id string) *uploadSession {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	s, ok := us.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(us.sessions, id)
+	if err := us.levelDB.Delete([]byte(id), nil); err != nil {
+		log.Printf("[Session] Delete session %s error: %s", id, err)
+	}
+	return s
+}
+
+// abort expired sessions until Close
+func (us *UploadSessions) Run() {
+	ticker := time.NewTicker(SESSION_EXPIRE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-us.closing:
+			return
+		case <-ticker.C:
+			us.expire(time.Now())
+		}
+	}
+}
+
+func (us *UploadSessions) expire(now time.Time) {
+	us.mu.Lock()
+	var expired []string
+	for id, s := range us.sessions {
+		if now.After(s.ExpiresAt) {
+			expired = append(expired, id)
+		}
+	}
+	us.mu.Unlock()
+	for _, id := range expired {
+		log.Printf("[Session] Upload session %s expired", id)
+		us.Abort(id)
+	}
+}
+
+func (us *UploadSessions) Close() error {
+	us.closeOnce.Do(func() {
+		close(us.closing)
+	})
+	return us.levelDB.Close()
+}
+
+func (us *UploadSessions) save(s UploadSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return us.levelDB.Put([]byte(s.ID), data, nil)
+}
+
+func (s *uploadSession) copy() UploadSession {
+	c := s.UploadSession
+	c.Blocks = append([]Fileblock{}, s.Blocks...)
+	c.Received = append([]bool{}, s.Received...)
+	return c
+}
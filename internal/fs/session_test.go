@@ -0,0 +1,237 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func newSessionGroup(t *testing.T) *Group {
+	g := newUploadGroup(t)
+	front := NewDTFS(*NewDPeer("front0", "10.0.0.0:9631", 20, nil), t.TempDir())
+	t.Cleanup(func() { front.Close() })
+	g.SetFrontSystem(front)
+	if err := g.NewBorad(context.Background(), "sessionspace"); err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestUploadSession(t *testing.T) {
+	g := newSessionGroup(t)
+	dir := t.TempDir()
+	us, err := NewUploadSessions(g, dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	parts := [][]byte{[]byte("first part "), []byte("second part "), []byte("third part")}
+	var blocks []Fileblock
+	var size int64
+	for _, part := range parts {
+		blocks = append(blocks, Fileblock{Size: int64(len(part)), Hash: blockChecksum(part)})
+		size += int64(len(part))
+	}
+	if _, err := us.Create(ctx, "sessionspace", ".", "file", "", size+1, blocks); err == nil {
+		t.Fatal("session with wrong size created")
+	}
+	big := []Fileblock{{Size: BLOCK_SIZE + 1, Hash: blockChecksum(parts[0])}}
+	if _, err := us.Create(ctx, "sessionspace", ".", "file", "", BLOCK_SIZE+1, big); !errors.Is(err, ErrBlockSize) {
+		t.Fatalf("block larger than BLOCK_SIZE got %v", err)
+	}
+	s, err := us.Create(ctx, "sessionspace", ".", "file", "", size, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any order, a bad block is refused
+	if _, err := us.PutBlock(ctx, s.ID, 1, parts[0]); !errors.Is(err, ErrBlockChecksum) {
+		t.Fatalf("got %v, want ErrBlockChecksum", err)
+	}
+	for _, i := range []int{2, 0} {
+		if s, err = us.PutBlock(ctx, s.ID, i, parts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if missing := s.Missing(); len(missing) != 1 || missing[0] != 1 {
+		t.Fatalf("got missing %v", missing)
+	}
+	if err := us.Finalize(ctx, s.ID); !errors.Is(err, ErrSessionIncomplete) {
+		t.Fatalf("got %v, want ErrSessionIncomplete", err)
+	}
+
+	// restart
+	us.Close()
+	if us, err = NewUploadSessions(g, dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	if s, err = us.Get(s.ID); err != nil || len(s.Missing()) != 1 {
+		t.Fatalf("session after restart got %v, %v", s, err)
+	}
+	if _, err := us.PutBlock(ctx, s.ID, 1, parts[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := us.Finalize(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.Get(s.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("finalized session is kept: %v", err)
+	}
+
+	r, err := g.OpenFile(ctx, "sessionspace", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, bytes.Join(parts, nil)) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestUploadSessionExpire(t *testing.T) {
+	g := newSessionGroup(t)
+	us, err := NewUploadSessions(g, t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	ctx := context.Background()
+
+	data := []byte("block of an expired session")
+	s, err := us.Create(ctx, "sessionspace", ".", "expired", "", int64(len(data)), []Fileblock{{Size: int64(len(data)), Hash: blockChecksum(data)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.PutBlock(ctx, s.ID, 0, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := us.SetTTL(0); err == nil {
+		t.Error("zero ttl accepted")
+	}
+	us.expire(time.Now().Add(time.Minute * 2))
+	if _, err := us.Get(s.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expired session is kept: %v", err)
+	}
+	if g.uploading(blockChecksum(data)) {
+		t.Error("block of the expired session is still held")
+	}
+}
+
+func TestUploadSessionInstant(t *testing.T) {
+	g := newSessionGroup(t)
+	us, err := NewUploadSessions(g, t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	ctx := context.Background()
+
+	data := []byte("content uploaded by someone else")
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// placement given by the client is dropped
+	s, err := us.Create(ctx, "sessionspace", ".", "copy", "", int64(len(data)), []Fileblock{{
+		Size: blocks[0].Size, Hash: blocks[0].Hash, FullPath: "10.9.9.9:9632@" + blocks[0].Hash, System: 3,
+		Erasure: &ErasureLayout{DataShards: 1, Shards: []Fileshard{{Location: "10.9.9.9:9632"}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := s.Missing(); len(missing) != 0 {
+		t.Fatalf("got missing %v", missing)
+	}
+	if b := s.Blocks[0]; b.FullPath != "" || b.Erasure != nil || b.System != 0 {
+		t.Fatalf("got block %+v", b)
+	}
+	if err := us.Finalize(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+	r, err := g.OpenFile(ctx, "sessionspace", "copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestDeleteSharedBlock(t *testing.T) {
+	g := newSessionGroup(t)
+	g.Set(InlinePolicy{})
+	ctx := context.Background()
+
+	content := []byte("block shared by two files")
+	for _, name := range []string{"first", "second"} {
+		if err := g.StoreFile(ctx, "sessionspace", "", ".", name, io.NopCloser(bytes.NewReader(content)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Delete(ctx, "sessionspace", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.GetMetaData(ctx, "sessionspace/first"); err == nil {
+		t.Error("deleted file has metadata")
+	}
+	if data, _ := readFile(t, g, "second"); !bytes.Equal(data, content) {
+		t.Errorf("read %q, want %q", data, content)
+	}
+}
+
+func TestUploadSessionAbortWhileStoring(t *testing.T) {
+	g := newSessionGroup(t)
+	us, err := NewUploadSessions(g, t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer us.Close()
+	ctx := context.Background()
+
+	data := []byte("block stored after the abort")
+	block := Fileblock{Size: int64(len(data)), Hash: blockChecksum(data)}
+	s, err := us.Create(ctx, "sessionspace", ".", "aborted", "", block.Size, []Fileblock{block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.mu.Lock()
+	tx := us.sessions[s.ID].tx
+	us.mu.Unlock()
+	if err := us.Abort(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	// what PutBlock does when the abort comes first
+	if err := g.storeUploadBlock(ctx, tx, &block, data); err != nil {
+		t.Fatal(err)
+	}
+	if g.uploading(block.Hash) {
+		t.Error("block stored after the abort is held")
+	}
+}
+
+func TestUploadSessionCreateFails(t *testing.T) {
+	g := newSessionGroup(t)
+	us, err := NewUploadSessions(g, t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.Close()
+
+	// the session can not be saved, its blocks are not held
+	part := []byte("block of a session never saved")
+	blocks := []Fileblock{{Size: int64(len(part)), Hash: blockChecksum(part)}}
+	if _, err := us.Create(context.Background(), "sessionspace", ".", "file", "", int64(len(part)), blocks); err == nil {
+		t.Fatal("session created without its database")
+	}
+	if g.uploading(blocks[0].Hash) {
+		t.Error("block of the failed session is still held")
+	}
+}
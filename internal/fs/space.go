@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -30,17 +31,20 @@ type Space struct {
 func (s *Space) Store(fullpath string, data []byte) (err error) {
 	sep := strings.Split(fullpath, "/")
 	if strings.Contains(sep[len(sep)-1], DIR_PERFIX) {
-		sep[len(sep)-1] = strings.TrimLeft(sep[len(sep)-1], DIR_PERFIX)
+		sep[len(sep)-1] = strings.TrimPrefix(sep[len(sep)-1], DIR_PERFIX)
 		fullpath = strings.Join(sep, "/")
 		err = s.MkDir(fullpath)
 	} else {
-		err = s.storeFile(fullpath, data, os.O_CREATE|os.O_WRONLY)
+		err = s.storeFile(fullpath, data, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
 	}
 	return err
 }
 
 func (s *Space) Get(fullpath string) (File, error) {
 	stat, err := os.Stat(s.getFullPath(fullpath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrFileNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -94,19 +98,24 @@ func (s *Space) storeFile(fullpath string, data []byte, flag int) error {
 	if s.willFull(int64(len(data))) {
 		return ErrFull
 	}
+	var oldSize int64
+	if info, err := os.Stat(s.getFullPath(fullpath)); err == nil {
+		oldSize = info.Size()
+	}
 	file, err := os.OpenFile(s.getFullPath(fullpath), flag, 0666)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	info, _ := file.Stat()
-	oldSize := info.Size()
 	_, err = file.Write(data)
 	if err != nil {
 		return err
 	}
-	newSize := info.Size()
-	s.occupy += Byte(newSize - oldSize)
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	s.occupy += Byte(info.Size() - oldSize)
 
 	return nil
 }
@@ -177,7 +186,7 @@ func (s *Space) GetSize(fullpath string) (Byte, error) {
 	var size Byte
 	err := filepath.WalkDir(s.getFullPath(fullpath), func(path string, d fs.DirEntry, err error) error {
 		if d == nil {
-			return fmt.Errorf("path %s not exist", path)
+			return fmt.Errorf("path %s not exist: %w", path, ErrFileNotFound)
 		}
 		if d.IsDir() {
 			return nil
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+/*
+BlockPlacer stores blocks and remembers where they landed,
+a block may land outside its replicas when they are full.
+
+locations - peer addrs from Fileblock.Locations
+
+Implemented by DFS.
+*/
+type BlockPlacer interface {
+	StoreBlock(ctx context.Context, key string, filename string, value []byte) ([]peers.PeerInfo, error)
+	GetAt(ctx context.Context, key string, locations []string) (File, error)
+	DeleteAt(ctx context.Context, key string, locations []string) error
+}
+
+var _ BlockPlacer = (*DFS)(nil)
+
+/*
+Store to every replica,
+a replica that is full spills over to the next peer in preference order.
+
+Return the peers the block landed on and the last error.
+*/
+func (d *DFS) StoreBlock(ctx context.Context, key string, filename string, value []byte) ([]peers.PeerInfo, error) {
+	replicas := d.PickReplicas(key)
+	if len(replicas) == 0 {
+		return nil, peers.ErrPeerNotFound
+	}
+	spare := d.spillCandidates(key, replicas)
+	var landed []peers.PeerInfo
+	var err error
+	for _, pi := range replicas {
+		e := d.storeTo(ctx, pi, key, filename, value)
+		for errors.Is(e, ErrFull) && len(spare) > 0 {
+			log.Printf("[DFS] %s is full, spill %s over to %s", pi.PName(), key, spare[0].PName())
+			d.metrics.Inc(METRIC_SPILL_OVER)
+			pi, spare = spare[0], spare[1:]
+			e = d.storeTo(ctx, pi, key, filename, value)
+		}
+		if e != nil {
+			log.Printf("[DFS] Store %s to %s error: %s", key, pi.PName(), e)
+			err = e
+			continue
+		}
+		landed = append(landed, pi)
+	}
+	return landed, err
+}
+
+// peers after the replicas in preference order, skip draining ones
+func (d *DFS) spillCandidates(key string, replicas []peers.PeerInfo) []peers.PeerInfo {
+	var spare []peers.PeerInfo
+	for _, pi := range withoutDraining(d.self.PickN(key, 0)) {
+		if !containsPeer(replicas, pi) {
+			spare = append(spare, pi)
+		}
+	}
+	return spare
+}
+
+/*
+Get from the recorded holders first,
+then look up the ring like Get.
+
+A read served by a recorded holder does not depend on the ring,
+so it survives ring changes without a rebalance.
+*/
+func (d *DFS) GetAt(ctx context.Context, key string, locations []string) (File, error) {
+	file, reads := d.readReplicas(ctx, key, d.peersAt(locations))
+	if file != nil {
+		d.metrics.Inc(METRIC_LOCATION_HIT)
+		return file, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, r := range reads {
+		log.Printf("[DFS] Get %s at %s error: %s", key, r.pi.PName(), r.err)
+	}
+	if len(locations) > 0 {
+		d.metrics.Inc(METRIC_LOCATION_MISS)
+	}
+	return d.Get(ctx, key)
+}
+
+// Delete from replicas and from locations outside them
+func (d *DFS) DeleteAt(ctx context.Context, key string, locations []string) error {
+	err := d.Delete(ctx, key)
+	replicas := d.PickReplicas(key)
+	for _, pi := range d.peersAt(locations) {
+		if containsPeer(replicas, pi) {
+			continue
+		}
+		if e := d.deleteFrom(ctx, pi, key); e != nil && !errors.Is(e, ErrFileNotFound) {
+			log.Printf("[DFS] Delete %s at %s error: %s", key, pi.PName(), e)
+			err = e
+		}
+	}
+	return err
+}
+
+/*
+Peers with these addrs.
+
+A holder that is no longer in the ring is still asked,
+the block may not have been moved since it left.
+*/
+func (d *DFS) peersAt(locations []string) []peers.PeerInfo {
+	list := make([]peers.PeerInfo, 0, len(locations))
+	for _, addr := range locations {
+		list = append(list, d.peerAt(addr))
+	}
+	return list
+}
+
+func (d *DFS) peerAt(addr string) peers.PeerInfo {
+	for _, pi := range d.self.PList() {
+		if pi.PAddr() == addr {
+			return pi
+		}
+	}
+	return DPeerInfo{PeerName: addr, PeerAddr: addr}
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+func TestSpillCandidates(t *testing.T) {
+	p := NewDPeer("peer0", "10.0.0.0:9632", 20, nil)
+	for i := 1; i < 5; i++ {
+		p.PAdd(NewDPeerInfo(fmt.Sprintf("peer%d", i), fmt.Sprintf("10.0.0.%d:9632", i)))
+	}
+	d := NewDFS(p, t.TempDir(), 1024, nil)
+	defer d.Close()
+	d.Set(ReplicaPolicy{Replicas: 2})
+
+	key := "spillkey"
+	replicas := d.PickReplicas(key)
+	spare := d.spillCandidates(key, replicas)
+	if len(replicas)+len(spare) != 5 {
+		t.Fatalf("got %d replicas and %d spare peers, want 5 peers", len(replicas), len(spare))
+	}
+	// spare peers keep preference order
+	want := withoutPeer(withoutPeer(p.PickN(key, 0), replicas[0]), replicas[1])
+	if !reflect.DeepEqual(spare, want) {
+		t.Errorf("got spare %v, want %v", spare, want)
+	}
+
+	fb := Fileblock{FullPath: blockFullPath(key, []peers.PeerInfo{replicas[0], spare[0]})}
+	if got := d.peersAt(fb.Locations()); !reflect.DeepEqual(got, []peers.PeerInfo{replicas[0], spare[0]}) {
+		t.Errorf("got locations %v from %q", got, fb.FullPath)
+	}
+}
+
+func TestDFSGetAt(t *testing.T) {
+	p := NewDPeer("GetAtServer", "127.0.0.1:9632", 20, nil)
+	d := NewDFS(p, t.TempDir(), 1024, nil)
+	defer d.Close()
+	ctx := context.Background()
+
+	key := "getatkey"
+	landed, err := d.StoreBlock(ctx, key, key, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := Fileblock{Hash: key, FullPath: blockFullPath(key, landed)}
+	if _, err := d.GetAt(ctx, key, fb.Locations()); err != nil {
+		t.Fatal(err)
+	}
+	if hit := d.metrics.Get(METRIC_LOCATION_HIT); hit != 1 {
+		t.Errorf("got %d location hits, want 1", hit)
+	}
+
+	// the recorded holder is gone, fall back to the ring
+	file, err := d.GetAt(ctx, key, []string{"127.0.0.1:1"})
+	if err != nil || string(file.Data()) != "data" {
+		t.Fatalf("got %v, %v", file, err)
+	}
+	if miss := d.metrics.Get(METRIC_LOCATION_MISS); miss != 1 {
+		t.Errorf("got %d location misses, want 1", miss)
+	}
+}
@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+/*
+Capacity and usage of one peer of a file system.
+
+Blocks is only counted by DFS, Spaces only by DTFS.
+
+Load is the number of requests the peer's rpc server is serving.
+*/
+type NodeStats struct {
+	Peer     DPeerInfo `json:"peer"`
+	Capacity int64     `json:"capacity"`
+	Occupy   int64     `json:"occupy"`
+	Blocks   int64     `json:"blocks"`
+	Spaces   int64     `json:"spaces"`
+	Load     int64     `json:"load"`
+
+	// circuit breaker of the peer as seen by the node that asked
+	Breaker BreakerState `json:"breaker,omitempty"`
+
+	// not empty if the peer did not answer
+	Error string `json:"error,omitempty"`
+}
+
+type ClusterStats struct {
+	Nodes []NodeStats `json:"nodes"`
+
+	// sum of the nodes that answered
+	Capacity int64 `json:"capacity"`
+	Occupy   int64 `json:"occupy"`
+	Blocks   int64 `json:"blocks"`
+	Spaces   int64 `json:"spaces"`
+
+	// occupy / capacity
+	Usage float64 `json:"usage"`
+}
+
+// implemented by DFS and DTFS, used by rpc server
+type statsSource interface {
+	localStats() NodeStats
+}
+
+// implemented by DFS and DTFS
+type StatsReporter interface {
+	Stats(ctx context.Context) []NodeStats
+}
+
+// implemented by DPeer
+type statsPeer interface {
+	Stats(ctx context.Context, pi peers.PeerInfo) (NodeStats, error)
+}
+
+// implemented by DPeer
+type breakerPeer interface {
+	BreakerStates() map[string]BreakerState
+}
+
+var _ statsSource = (*DFS)(nil)
+var _ statsSource = (*DTFS)(nil)
+var _ StatsReporter = (*DFS)(nil)
+var _ StatsReporter = (*DTFS)(nil)
+var _ statsPeer = (*DPeer)(nil)
+
+func (d *DFS) localStats() NodeStats {
+	var blocks int64
+	d.rangeFileInfo(func(key string, bfi BasicFileInfo) bool {
+		blocks++
+		return true
+	})
+	return NodeStats{
+		Peer:     d.self.Info().(DPeerInfo),
+		Capacity: d.capacity,
+		Occupy:   d.occupied(),
+		Blocks:   blocks,
+	}
+}
+
+func (dt *DTFS) localStats() NodeStats {
+	stats := NodeStats{Peer: dt.self.info}
+	spaces, _ := dt.ListSpaces()
+	for _, spaceKey := range spaces {
+		space := dt.GetSpace(spaceKey)
+		if space == nil {
+			continue
+		}
+		stats.Spaces++
+		stats.Capacity += space.Cap()
+		stats.Occupy += space.occupy
+	}
+	return stats
+}
+
+// stats of every peer in the ring
+func (d *DFS) Stats(ctx context.Context) []NodeStats {
+	return peerStats(ctx, d.self, d)
+}
+
+func (dt *DTFS) Stats(ctx context.Context) []NodeStats {
+	return peerStats(ctx, dt.self, dt)
+}
+
+/*
+Ask every peer for its stats in parallel.
+
+This peer is asked by rpc too, so its load is known,
+local stats are used if its rpc server is not running.
+*/
+func peerStats(ctx context.Context, self peers.Peer, local statsSource) []NodeStats {
+	list := self.PList()
+	stats := make([]NodeStats, len(list))
+	sp, ok := self.(statsPeer)
+	var wg sync.WaitGroup
+	wg.Add(len(list))
+	for i, pi := range list {
+		go func(i int, pi peers.PeerInfo) {
+			defer wg.Done()
+			if ok {
+				s, err := sp.Stats(ctx, pi)
+				if err == nil {
+					stats[i] = s
+					return
+				}
+				dpi, _ := pi.(DPeerInfo)
+				stats[i] = NodeStats{Peer: dpi, Error: err.Error()}
+			}
+			if pi.Equal(self.Info()) {
+				stats[i] = local.localStats()
+			}
+		}(i, pi)
+	}
+	wg.Wait()
+	if bp, ok := self.(breakerPeer); ok {
+		states := bp.BreakerStates()
+		for i, pi := range list {
+			stats[i].Breaker = states[pi.PName()]
+		}
+	}
+	return stats
+}
+
+func sumStats(nodes []NodeStats) ClusterStats {
+	cs := ClusterStats{Nodes: nodes}
+	for _, n := range nodes {
+		if n.Error != "" {
+			continue
+		}
+		cs.Capacity += n.Capacity
+		cs.Occupy += n.Occupy
+		cs.Blocks += n.Blocks
+		cs.Spaces += n.Spaces
+	}
+	if cs.Capacity > 0 {
+		cs.Usage = float64(cs.Occupy) / float64(cs.Capacity)
+	}
+	return cs
+}
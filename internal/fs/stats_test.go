@@ -0,0 +1,32 @@
+package fs
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDFSStats(t *testing.T) {
+	p := NewDPeer("StatsServer", "127.0.0.1:9", 20, nil)
+	d := NewDFS(p, t.TempDir(), 1024, nil)
+	defer d.Close()
+	ctx := context.Background()
+
+	for _, key := range []string{"statskey0", "statskey1"} {
+		if err := d.Store(ctx, key, key+".txt", []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rpc server is not running, local stats are used
+	nodes := d.Stats(ctx)
+	if len(nodes) != 1 {
+		t.Fatalf("got %d nodes, want 1", len(nodes))
+	}
+	cs := sumStats(append(nodes, NodeStats{Capacity: 1024, Occupy: 100, Error: "unavailable"}))
+	if cs.Capacity != 1024 || cs.Occupy != 20 || cs.Blocks != 2 {
+		t.Errorf("got capacity %d, occupy %d, blocks %d", cs.Capacity, cs.Occupy, cs.Blocks)
+	}
+	if cs.Usage != 20.0/1024 {
+		t.Errorf("got usage %f", cs.Usage)
+	}
+}
@@ -109,6 +109,25 @@ func (t *treeFS) GetSpace(spaceKey string) *Space {
 	return s
 }
 
+// list space keys stored in this tree file system
+func (t *treeFS) ListSpaces() ([]string, error) {
+	entries, err := os.ReadDir(t.rootPath)
+	if err != nil {
+		return nil, err
+	}
+	var spaces []string
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(t.rootPath, e.Name(), STAT_FILE)); err != nil {
+			continue
+		}
+		spaces = append(spaces, e.Name())
+	}
+	return spaces, nil
+}
+
 func (t *treeFS) ModifySpace(spaceKey string, cap Byte) error {
 	space, ok := t.openSpaces[spaceKey]
 	if !ok {
@@ -118,9 +137,8 @@ func (t *treeFS) ModifySpace(spaceKey string, cap Byte) error {
 }
 
 func (t *treeFS) RemoveSpace(spaceKey string) error {
-
-	//TODO: check if space is open
-
+	// an open space would be found again by GetSpace
+	delete(t.openSpaces, spaceKey)
 	return os.RemoveAll(filepath.Join(t.rootPath, spaceKey))
 }
 
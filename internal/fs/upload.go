@@ -0,0 +1,611 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	DEFAULT_UPLOAD_CONCURRENCY = 4
+	DEFAULT_UPLOAD_TIMEOUT     = time.Hour
+
+	// time to remove the blocks of an upload rolled back
+	ROLLBACK_TIMEOUT = time.Minute
+)
+
+var (
+	ErrBlockChecksum = errors.New("block checksum mismatch")
+	ErrBlockSize     = errors.New("block size out of range")
+)
+
+/*
+UploadPolicy decides how Group.StoreFile stores blocks.
+
+Concurrency - blocks stored at the same time,
+at most this many blocks are held in memory.
+
+Verify - read every block back after it is stored.
+
+Timeout - an upload that takes longer fails and is rolled back, 0 means no limit.
+
+Use Group.Set(UploadPolicy{...}) to change it.
+*/
+type UploadPolicy struct {
+	Concurrency int
+	Verify      bool
+	Timeout     time.Duration
+}
+
+var DefaultUploadPolicy = UploadPolicy{
+	Concurrency: DEFAULT_UPLOAD_CONCURRENCY,
+	Timeout:     DEFAULT_UPLOAD_TIMEOUT,
+}
+
+/*
+BlockChecker tells if blocks are stored without reading them.
+
+HasBlocks reports a block missing if no replica answered.
+
+Implemented by DFS.
+*/
+type BlockChecker interface {
+	HasBlock(ctx context.Context, key string) (bool, error)
+	HasBlocks(ctx context.Context, keys []string) map[string]bool
+
+	// HasBlocks that refreshes the mod time of the blocks found, see GCPolicy
+	TouchBlocks(ctx context.Context, keys []string) map[string]bool
+}
+
+var _ BlockChecker = (*DFS)(nil)
+
+// implemented by DPeer
+type hasPeer interface {
+	Has(ctx context.Context, pi peers.PeerInfo, key string) (bool, error)
+}
+
+/*
+Ask the replicas of key if they have it,
+error only if no replica answered.
+*/
+func (d *DFS) HasBlock(ctx context.Context, key string) (bool, error) {
+	var err error = peers.ErrPeerNotFound
+	answered := false
+	for _, pi := range d.PickReplicas(key) {
+		exists, e := d.hasOn(ctx, pi, key)
+		if e != nil {
+			err = e
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+		answered = true
+	}
+	if answered {
+		return false, nil
+	}
+	return false, err
+}
+
+/*
+Ask every replica of the keys, with one call per peer,
+a key is stored if any replica has it.
+*/
+func (d *DFS) HasBlocks(ctx context.Context, keys []string) map[string]bool {
+	return d.askReplicas(ctx, keys, false)
+}
+
+func (d *DFS) TouchBlocks(ctx context.Context, keys []string) map[string]bool {
+	return d.askReplicas(ctx, keys, true)
+}
+
+func (d *DFS) askReplicas(ctx context.Context, keys []string, touch bool) map[string]bool {
+	exists := make(map[string]bool, len(keys))
+	batches := peerBatches{}
+	for i, key := range keys {
+		for _, pi := range d.PickReplicas(key) {
+			batches.add(pi, i)
+		}
+	}
+	var mu sync.Mutex
+	batches.run(func(pb *peerBatch) {
+		batchKeys := make([]string, 0, len(pb.idx))
+		for _, i := range pb.idx {
+			batchKeys = append(batchKeys, keys[i])
+		}
+		found, err := d.batchHasFrom(ctx, pb.pi, batchKeys, touch)
+		if err != nil {
+			log.Printf("[DFS] BatchHas %d keys on %s error: %s", len(batchKeys), pb.pi.PName(), err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range found {
+			exists[key] = true
+		}
+	})
+	return exists
+}
+
+func (d *DFS) hasOn(ctx context.Context, pi peers.PeerInfo, key string) (bool, error) {
+	if pi.Equal(d.self.Info()) {
+		return d.hasLocally(ctx, key)
+	}
+	hp, ok := d.self.(hasPeer)
+	if !ok {
+		return false, ErrInternal
+	}
+	return hp.Has(ctx, pi, key)
+}
+
+/*
+uploadTx is the record of one upload.
+
+It holds the blocks of the upload, garbage collection keeps a held block.
+Rollback removes the blocks the upload created, ones no store system had before it,
+unless another upload held them meanwhile, that upload may commit a file that references them.
+Other blocks of the upload are left to garbage collection, see GCPolicy.
+*/
+type uploadTx struct {
+	g *Group
+
+	mu sync.Mutex
+	// holds of a hash by this upload
+	held map[string]int
+	// blocks this upload created, with where they landed
+	created []Fileblock
+	// committed or rolled back, blocks stored after it are not held
+	done bool
+}
+
+func (g *Group) beginUpload() *uploadTx {
+	return &uploadTx{g: g, held: make(map[string]int)}
+}
+
+// keep hash from being collected while the upload runs
+func (tx *uploadTx) hold(hash string) {
+	tx.g.uploadMu.Lock()
+	defer tx.g.uploadMu.Unlock()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	if tx.g.inflight[hash] > tx.held[hash] {
+		tx.g.shared[hash] = true
+	}
+	tx.g.inflight[hash]++
+	tx.held[hash]++
+}
+
+// record a block stored by this upload that no store system had
+func (tx *uploadTx) create(block Fileblock) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.created = append(tx.created, block)
+}
+
+func (tx *uploadTx) release() {
+	tx.g.uploadMu.Lock()
+	defer tx.g.uploadMu.Unlock()
+	tx.releaseLocked()
+}
+
+// g.uploadMu must be held
+func (tx *uploadTx) releaseLocked() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	for hash, n := range tx.held {
+		if tx.g.inflight[hash] -= n; tx.g.inflight[hash] <= 0 {
+			delete(tx.g.inflight, hash)
+			delete(tx.g.shared, hash)
+		}
+	}
+	tx.held = nil
+	tx.created = nil
+	tx.done = true
+}
+
+func (tx *uploadTx) commit() {
+	tx.release()
+}
+
+/*
+Give up the upload and remove the blocks it created.
+
+Uploads wait to hold a block until the removal is done,
+so none finds a block that is being removed.
+*/
+func (tx *uploadTx) rollback() {
+	g := tx.g
+	g.uploadMu.Lock()
+	defer g.uploadMu.Unlock()
+	tx.mu.Lock()
+	var remove []Fileblock
+	for _, block := range tx.created {
+		if !g.shared[block.Hash] {
+			remove = append(remove, block)
+		}
+	}
+	tx.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ROLLBACK_TIMEOUT)
+	defer cancel()
+	for _, block := range remove {
+		for _, i := range block.systems() {
+			if err := g.deleteBlockFrom(ctx, i, block); err != nil {
+				log.Printf("[Group] Rollback remove block %s error: %s", block.Hash, err)
+			}
+		}
+	}
+	log.Printf("[Group] Rollback upload, %d blocks removed", len(remove))
+	tx.releaseLocked()
+}
+
+/*
+True if a store system has the block or a shard of it, the block is touched,
+so garbage collection keeps it for an upload that stores it again.
+A system that can not tell counts as having it.
+*/
+func (g *Group) touchBlock(ctx context.Context, hash string) bool {
+	return g.touchBlocks(ctx, []string{hash})[hash]
+}
+
+// touchBlock for many blocks, with one call per store system
+func (g *Group) touchBlocks(ctx context.Context, hashes []string) map[string]bool {
+	existed := make(map[string]bool, len(hashes))
+	block := make(map[string]string) // key -> hash of its block
+	keys := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		block[hash] = hash
+		keys = append(keys, hash)
+		for i := 0; i < g.erasure.DataShards+g.erasure.ParityShards; i++ {
+			block[shardKey(hash, i)] = hash
+			keys = append(keys, shardKey(hash, i))
+		}
+	}
+	for _, fs := range g.StoreSystems {
+		checker, ok := fs.(BlockChecker)
+		if !ok {
+			for _, hash := range hashes {
+				existed[hash] = true
+			}
+			return existed
+		}
+		for key, exists := range checker.TouchBlocks(ctx, keys) {
+			if exists {
+				existed[block[key]] = true
+			}
+		}
+	}
+	return existed
+}
+
+/*
+Tell which blocks are stored, by their hash, so an upload can skip them.
+
+With STORE_MIRROR a block is stored if every store system has it,
+otherwise if any has it, a system that can not tell means missing.
+*/
+func (g *Group) CheckBlocks(ctx context.Context, hashes []string) map[string]bool {
+	stored := make(map[string]bool)
+	for hash := range g.locateBlocks(ctx, hashes) {
+		stored[hash] = true
+	}
+	return stored
+}
+
+/*
+Find the stored blocks as CheckBlocks does, with where they are.
+
+Only full copies on the replicas of a hash are found,
+spilled and erasure coded blocks are not, they are uploaded again.
+Found blocks are touched, so garbage collection keeps them for its grace period,
+a file that references them is committed in it.
+*/
+func (g *Group) locateBlocks(ctx context.Context, hashes []string) map[string]Fileblock {
+	systems := make(map[string][]int, len(hashes))
+	for i, fs := range g.StoreSystems {
+		checker, ok := fs.(BlockChecker)
+		if !ok {
+			continue
+		}
+		for hash, exists := range checker.TouchBlocks(ctx, hashes) {
+			if exists {
+				systems[hash] = append(systems[hash], i)
+			}
+		}
+	}
+	located := make(map[string]Fileblock, len(systems))
+	for hash, on := range systems {
+		if g.store.Mode == STORE_MIRROR && len(on) != len(g.StoreSystems) {
+			continue
+		}
+		block := Fileblock{Hash: hash, System: on[0]}
+		if g.store.Mode == STORE_MIRROR {
+			for _, i := range on[1:] {
+				block.Mirrors = append(block.Mirrors, BlockCopy{System: i})
+			}
+		}
+		located[hash] = block
+	}
+	return located
+}
+
+/*
+Read blocks from stream and store them in parallel,
+blocks read one after another are stored together, see storeUploadBlocks.
+
+blocks - boundaries of the blocks, empty to split the stream by the ChunkPolicy.
+Hash of a block is its checksum, a block that does not match is refused,
+an empty Hash is filled in.
+
+Return the blocks with where they landed, after every one is stored.
+The first error stops the upload.
+*/
+func (g *Group) storeBlocks(ctx context.Context, tx *uploadTx, stream io.Reader, blocks []Fileblock) ([]Fileblock, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	concurrency := g.upload.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	split := len(blocks) == 0
+	chunks := newChunker(g.chunk, stream)
+	var stored []*Fileblock
+	var wg sync.WaitGroup
+
+	// blocks read and not stored yet, each holds a slot of sem
+	var pending []*Fileblock
+	var pendingData [][]byte
+	pendingBytes := 0
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		blocks, data := pending, pendingData
+		pending, pendingData, pendingBytes = nil, nil, 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				for range blocks {
+					<-sem
+				}
+			}()
+			if err := g.storeUploadBlocks(ctx, tx, blocks, data); err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	for i := 0; split || i < len(blocks); i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			fail(ctx.Err())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		var block Fileblock
+		var data []byte
+		var err error
+		if split {
+			data, err = chunks.next()
+			block = Fileblock{BlockID: int64(i), Size: int64(len(data))}
+		} else {
+			block = blocks[i]
+			if err = checkBlockSize(block); err == nil {
+				data = make([]byte, block.Size)
+				_, err = io.ReadFull(stream, data)
+			}
+		}
+		if split && err == io.EOF {
+			<-sem
+			flush()
+			break
+		}
+		if err != nil {
+			fail(fmt.Errorf("read block %d: %w", i, err))
+			<-sem
+			break
+		}
+
+		sum := blockChecksum(data)
+		if block.Hash == "" {
+			block.Hash = sum
+		} else if block.Hash != sum {
+			fail(fmt.Errorf("%w: block %d", ErrBlockChecksum, block.BlockID))
+			<-sem
+			break
+		}
+
+		stored = append(stored, &block)
+		pending = append(pending, &block)
+		pendingData = append(pendingData, data)
+		pendingBytes += len(data)
+		if len(pending) == concurrency || pendingBytes >= BATCH_MAX_BYTES || (!split && i == len(blocks)-1) {
+			flush()
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	result := make([]Fileblock, len(stored))
+	for i, block := range stored {
+		result[i] = *block
+	}
+	return result, nil
+}
+
+// a block given by a client has 1 to BLOCK_SIZE bytes
+func checkBlockSize(block Fileblock) error {
+	if block.Size <= 0 || block.Size > BLOCK_SIZE {
+		return fmt.Errorf("%w: block %d has %d bytes", ErrBlockSize, block.BlockID, block.Size)
+	}
+	return nil
+}
+
+/*
+Store one block of an upload and hold it in tx,
+block gets where it landed.
+*/
+func (g *Group) storeUploadBlock(ctx context.Context, tx *uploadTx, block *Fileblock, data []byte) error {
+	tx.hold(block.Hash)
+	existed := g.touchBlock(ctx, block.Hash)
+	if err := g.StoreBlock(ctx, block, data); err != nil {
+		return fmt.Errorf("store block %d: %w", block.BlockID, err)
+	}
+	if !existed {
+		tx.create(*block)
+	}
+	if !g.upload.Verify {
+		return nil
+	}
+	got, err := g.GetBlockData(ctx, *block)
+	if err == nil && blockChecksum(got) != block.Hash {
+		err = ErrBlockChecksum
+	}
+	if err != nil {
+		return fmt.Errorf("verify block %d: %w", block.BlockID, err)
+	}
+	return nil
+}
+
+// the first store system, if blocks of an upload can go to it in batches
+func (g *Group) blockBatcher() (BlockBatcher, bool) {
+	if len(g.StoreSystems) == 0 || g.store.Mode == STORE_MIRROR {
+		return nil, false
+	}
+	fs := g.StoreSystems[0]
+	if _, ok := fs.(ErasureCoder); ok && g.erasure.DataShards > 0 {
+		return nil, false
+	}
+	batcher, ok := fs.(BlockBatcher)
+	return batcher, ok
+}
+
+/*
+Store blocks of an upload like storeUploadBlock,
+with one call per peer if the first store system is a BlockBatcher
+and the blocks are neither mirrored nor erasure coded.
+A block that fails there is stored by StoreBlock.
+
+Return the first error, after every block is stored or failed.
+*/
+func (g *Group) storeUploadBlocks(ctx context.Context, tx *uploadTx, blocks []*Fileblock, data [][]byte) error {
+	batcher, ok := g.blockBatcher()
+	if !ok {
+		errs := make([]error, len(blocks))
+		var wg sync.WaitGroup
+		for i := range blocks {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = g.storeUploadBlock(ctx, tx, blocks[i], data[i])
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	hashes := make([]string, 0, len(blocks))
+	items := make([]BatchItem, 0, len(blocks))
+	for i, block := range blocks {
+		tx.hold(block.Hash)
+		hashes = append(hashes, block.Hash)
+		items = append(items, BatchItem{Key: block.Hash, Filename: block.Hash, Value: data[i]})
+	}
+	existed := g.touchBlocks(ctx, hashes)
+	var err error
+	for i, r := range batcher.BatchStore(ctx, items) {
+		block := blocks[i]
+		block.System = 0
+		if r.Err == nil {
+			block.FullPath = blockFullPath(block.Hash, r.Landed)
+		} else if e := g.StoreBlock(ctx, block, data[i]); e != nil {
+			if err == nil {
+				err = fmt.Errorf("store block %d: %w", block.BlockID, e)
+			}
+			continue
+		}
+		if !existed[block.Hash] {
+			tx.create(*block)
+		}
+	}
+	if err != nil || !g.upload.Verify {
+		return err
+	}
+
+	stored := make([]Fileblock, 0, len(blocks))
+	for _, block := range blocks {
+		stored = append(stored, *block)
+	}
+	got, errs := g.getBlocksData(ctx, stored)
+	for i, block := range stored {
+		err := errs[i]
+		if err == nil && blockChecksum(got[i]) != block.Hash {
+			err = ErrBlockChecksum
+		}
+		if err != nil {
+			return fmt.Errorf("verify block %d: %w", block.BlockID, err)
+		}
+	}
+	return nil
+}
+
+/*
+Write the metadata of an upload whose blocks are all stored,
+the upload is committed if it succeeds.
+*/
+func (g *Group) commitUpload(ctx context.Context, tx *uploadTx, spaceKey, filehash, basePath, filename string, blocks []Fileblock) error {
+	var filesize int64
+	for _, block := range blocks {
+		filesize += block.Size
+	}
+	return g.commitMetaData(ctx, tx, spaceKey, basePath, newMetaData(filename, filehash, filesize, time.Now(), blocks))
+}
+
+func (g *Group) commitMetaData(ctx context.Context, tx *uploadTx, spaceKey, basePath string, metadata Metadata) error {
+	data, err := marshalMetaData(metadata)
+	if err != nil {
+		return err
+	}
+	if err := g.FrontSystem.Store(ctx, spaceKey, filepath.Join(basePath, metadata.Filename+META_FILE_SUFFIX), data); err != nil {
+		return err
+	}
+	tx.commit()
+	return nil
+}
@@ -0,0 +1,175 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newUploadGroup(t *testing.T) *Group {
+	d, _ := newMemDFS(t, "peer", 0, 4)
+	g := NewGroup("upload", nil)
+	g.UseFS(d)
+	return g
+}
+
+func TestStoreBlocksSplit(t *testing.T) {
+	g := newUploadGroup(t)
+	g.Set(UploadPolicy{Concurrency: 2, Verify: true})
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, int(BLOCK_SIZE)/2)
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || blocks[2].Size != int64(len(data))-2*int64(BLOCK_SIZE) {
+		t.Fatalf("got %d blocks", len(blocks))
+	}
+	var got []byte
+	for i, block := range blocks {
+		if block.BlockID != int64(i) || len(block.Locations()) == 0 {
+			t.Fatalf("got block %+v", block)
+		}
+		b, err := g.GetBlockData(ctx, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("blocks do not add up to the file")
+	}
+
+	if blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(nil), nil); err != nil || len(blocks) != 0 {
+		t.Errorf("empty file got %d blocks, %v", len(blocks), err)
+	}
+}
+
+func TestStoreBlocksChecksum(t *testing.T) {
+	g := newUploadGroup(t)
+	ctx := context.Background()
+
+	data := []byte("first blocksecond block")
+	blocks := []Fileblock{
+		{BlockID: 0, Size: 11, Hash: blockChecksum(data[:11])},
+		{BlockID: 1, Size: 12, Hash: blockChecksum([]byte("not the data"))},
+	}
+	if _, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), blocks); !errors.Is(err, ErrBlockChecksum) {
+		t.Fatalf("got %v, want ErrBlockChecksum", err)
+	}
+
+	blocks[1].Hash = ""
+	stored, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored[1].Hash != blockChecksum(data[11:]) {
+		t.Errorf("got hash %s", stored[1].Hash)
+	}
+
+	// the stream is shorter than the blocks
+	if _, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data[:15]), blocks); err == nil {
+		t.Error("short stream stored")
+	}
+
+	// sizes are checked before anything is read
+	for _, size := range []int64{-1, 0, BLOCK_SIZE + 1} {
+		sized := []Fileblock{{Size: size}}
+		if _, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), sized); !errors.Is(err, ErrBlockSize) {
+			t.Errorf("size %d got %v, want ErrBlockSize", size, err)
+		}
+		if err := g.StoreFile(ctx, "space", "", "/", "file", io.NopCloser(bytes.NewReader(data)), sized); !errors.Is(err, ErrBlockSize) {
+			t.Errorf("file with block size %d got %v, want ErrBlockSize", size, err)
+		}
+	}
+}
+
+func TestStoreFileRollback(t *testing.T) {
+	g := newUploadGroup(t)
+	g.Set(UploadPolicy{Concurrency: 1})
+	d := g.StoreSystems[0].(*DFS)
+	ctx := context.Background()
+
+	shared := []byte("block shared with another file")
+	if err := g.StoreBlock(ctx, &Fileblock{Hash: blockChecksum(shared), Size: int64(len(shared))}, shared); err != nil {
+		t.Fatal(err)
+	}
+	fresh := []byte("block of this upload")
+	data := append(append(append([]byte{}, fresh...), shared...), "broken"...)
+	blocks := []Fileblock{
+		{BlockID: 0, Size: int64(len(fresh))},
+		{BlockID: 1, Size: int64(len(shared))},
+		{BlockID: 2, Size: 6, Hash: blockChecksum([]byte("other!"))},
+	}
+	err := g.StoreFile(ctx, "space", "", "/", "file", io.NopCloser(bytes.NewReader(data)), blocks)
+	if !errors.Is(err, ErrBlockChecksum) {
+		t.Fatalf("got %v, want ErrBlockChecksum", err)
+	}
+
+	// a block stored before is kept, no longer held
+	if ok, _ := d.HasBlock(ctx, blockChecksum(shared)); !ok {
+		t.Error("block stored before the upload is removed")
+	}
+	if len(g.inflight) != 0 {
+		t.Errorf("blocks %v still held", g.inflight)
+	}
+
+	// a block the upload created is removed
+	created := []byte("block created by an upload")
+	tx := g.beginUpload()
+	if err := g.storeUploadBlock(ctx, tx, &Fileblock{Hash: blockChecksum(created), Size: int64(len(created))}, created); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := d.HasBlock(ctx, blockChecksum(created)); !ok {
+		t.Fatal("block is not stored")
+	}
+	tx.rollback()
+	if ok, _ := d.HasBlock(ctx, blockChecksum(created)); ok {
+		t.Error("block created by the upload is kept")
+	}
+
+	// an upload of the same block committed meanwhile keeps it
+	same := []byte("block of two uploads")
+	first, second := g.beginUpload(), g.beginUpload()
+	for _, tx := range []*uploadTx{first, second} {
+		if err := g.storeUploadBlock(ctx, tx, &Fileblock{Hash: blockChecksum(same), Size: int64(len(same))}, same); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.commit()
+	second.rollback()
+	if ok, _ := d.HasBlock(ctx, blockChecksum(same)); !ok {
+		t.Error("block of the committed upload is removed")
+	}
+
+	// a block created while another upload holds it is kept too
+	both := []byte("block held by two uploads")
+	first, second = g.beginUpload(), g.beginUpload()
+	second.hold(blockChecksum(both))
+	if err := g.storeUploadBlock(ctx, first, &Fileblock{Hash: blockChecksum(both), Size: int64(len(both))}, both); err != nil {
+		t.Fatal(err)
+	}
+	first.rollback()
+	second.commit()
+	if ok, _ := d.HasBlock(ctx, blockChecksum(both)); !ok {
+		t.Error("block held by another upload is removed")
+	}
+}
+
+func TestCheckBlocks(t *testing.T) {
+	g := newUploadGroup(t)
+	ctx := context.Background()
+
+	data := []byte("block stored before the check")
+	blocks, err := g.storeBlocks(ctx, g.beginUpload(), bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := g.CheckBlocks(ctx, []string{blocks[0].Hash, blockChecksum([]byte("never stored"))})
+	if len(stored) != 1 || !stored[blocks[0].Hash] {
+		t.Errorf("got %v", stored)
+	}
+}
@@ -1 +1,341 @@
 package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ciiim/cloudborad/internal/fs"
+	"github.com/ciiim/cloudborad/internal/fs/peers"
+)
+
+const (
+	// a group has two ports, the front system's and the next one for the store system,
+	// groups get the lowest free pair from GROUP_PORT_BASE unless a port is given
+	GROUP_PORT_BASE = 9631
+	GROUP_PORT_MAX  = 65534
+
+	REGISTRY_FILE_PREFIX = "./groups_"
+)
+
+var (
+	ErrGroupExist    = errors.New("group exist")
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupName     = errors.New("group name must be letters, digits, '-' or '_'")
+	ErrGroupPorts    = errors.New("ports of the group are in use")
+	ErrJoinAddr      = errors.New("join address must be a host without port")
+)
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+/*
+GroupHost is a group served by this server, with its upload sessions.
+*/
+type GroupHost struct {
+	Name      string
+	FrontPort int
+	StorePort int
+
+	Group *fs.Group
+
+	// resumable uploads to Group
+	Sessions *fs.UploadSessions
+}
+
+// a saved group with its ports, a group keeps them across restarts
+type groupEntry struct {
+	Name      string `json:"name"`
+	FrontPort int    `json:"frontPort"`
+	StorePort int    `json:"storePort"`
+}
+
+/*
+Create the file systems of a group on the given ports.
+
+ffs is the front file system, it must be a tree structure
+*/
+func newGroupHost(name string, frontPort, storePort int, serverName, addr string, sessionTTL time.Duration) (*GroupHost, error) {
+	ffs := fs.NewDTFS(*fs.NewDPeer("front0_"+serverName+"_"+name, net.JoinHostPort(addr, strconv.Itoa(frontPort)), 20, nil), "./front0_"+serverName+"_"+name)
+	sfs := fs.NewDFS(*fs.NewDPeer("store0_"+serverName+"_"+name, net.JoinHostPort(addr, strconv.Itoa(storePort)), 20, nil), "./store0_"+serverName+"_"+name, 1024*1024*1024, nil)
+	if ffs == nil || sfs == nil {
+		return nil, fmt.Errorf("new group %s failed", name)
+	}
+	g := fs.NewGroup(name, ffs)
+	g.UseFS(sfs)
+	sessions, err := fs.NewUploadSessions(g, "./session0_"+serverName+"_"+name, sessionTTL)
+	if err != nil {
+		g.Close()
+		return nil, err
+	}
+	return &GroupHost{Name: name, FrontPort: frontPort, StorePort: storePort, Group: g, Sessions: sessions}, nil
+}
+
+func (h *GroupHost) serve() {
+	go h.Group.Serve()
+	go h.Sessions.Run()
+}
+
+type peerLister interface {
+	GetPeerListFromPeer(pi peers.PeerInfo) []peers.PeerInfo
+}
+
+// the peer at addr must be a system of this group, peers of other groups share the host
+func checkGroupPeer(self peers.Peer, group, addr string) error {
+	lister, ok := self.(peerLister)
+	if !ok {
+		return nil
+	}
+	for _, pi := range lister.GetPeerListFromPeer(fs.NewDPeerInfo(addr, addr)) {
+		if pi.PAddr() == addr {
+			if !strings.HasSuffix(pi.PName(), "_"+group) {
+				return fmt.Errorf("%s serves %s, not group %s", addr, pi.PName(), group)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no group %s at %s", group, addr)
+}
+
+/*
+Join the group on the server at peerHost,
+its systems must be on the ports of this group, see Server.CreateGroup.
+*/
+func (h *GroupHost) Join(peerName, peerHost string) error {
+	if _, _, err := net.SplitHostPort(peerHost); err == nil {
+		return ErrJoinAddr
+	}
+	frontAddr := net.JoinHostPort(peerHost, strconv.Itoa(h.FrontPort))
+	storeAddr := net.JoinHostPort(peerHost, strconv.Itoa(h.StorePort))
+	front := h.Group.FrontSystem.Peer()
+	if err := checkGroupPeer(front, h.Name, frontAddr); err != nil {
+		return err
+	}
+	for _, sfs := range h.Group.StoreSystems {
+		if err := checkGroupPeer(sfs.Peer(), h.Name, storeAddr); err != nil {
+			return err
+		}
+	}
+	err := front.PActionTo(peers.P_ACTION_JOIN, fs.NewDPeerInfo(peerName, frontAddr))
+	if err != nil {
+		return err
+	}
+	for _, sfs := range h.Group.StoreSystems {
+		err = sfs.Peer().PActionTo(peers.P_ACTION_JOIN, fs.NewDPeerInfo(peerName, storeAddr))
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[Server] Group %s join success", h.Name)
+	return nil
+}
+
+func (h *GroupHost) Quit() {
+	h.Group.Quit()
+}
+
+func (h *GroupHost) Close() error {
+	h.Quit()
+	if err := h.Sessions.Close(); err != nil {
+		log.Printf("[Server] Close upload sessions of %s error: %s", h.Name, err)
+	}
+	return h.Group.Close()
+}
+
+/*
+Host a new group and save it in the registry.
+
+frontPort - port of the front system, the store system is on the next one,
+0 takes the lowest free pair. Servers of a group must use the same ports,
+give the ports a group got on its first server to the others.
+
+The ports are bound here, the group is served if the server is started.
+*/
+func (s *Server) CreateGroup(name string, frontPort int) (*GroupHost, error) {
+	if !groupNamePattern.MatchString(name) {
+		return nil, ErrGroupName
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[name]; ok {
+		return nil, ErrGroupExist
+	}
+	frontPort, err := s.groupPorts(frontPort)
+	if err != nil {
+		return nil, err
+	}
+	h, err := newGroupHost(name, frontPort, frontPort+1, s.name, s.addr, s.sessionTTL)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Group.Listen(); err != nil {
+		h.Close()
+		return nil, fmt.Errorf("%w: %s", ErrGroupPorts, err)
+	}
+	s.groups[name] = h
+	if err := s.saveRegistry(); err != nil {
+		delete(s.groups, name)
+		h.Close()
+		return nil, err
+	}
+	if s.started {
+		h.serve()
+	}
+	log.Printf("[Server] Create group %s on ports %d, %d", name, h.FrontPort, h.StorePort)
+	return h, nil
+}
+
+/*
+Stop hosting a group and remove it from the registry.
+
+Files of the group are kept on disk, creating it again serves them.
+*/
+func (s *Server) DeleteGroup(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	delete(s.groups, name)
+	if err := s.saveRegistry(); err != nil {
+		s.groups[name] = h
+		return err
+	}
+	log.Printf("[Server] Delete group %s", name)
+	return h.Close()
+}
+
+/*
+Set how long an upload session is kept after its last block,
+for hosted groups and groups created later.
+*/
+func (s *Server) SetSessionTTL(ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.groups {
+		if err := h.Sessions.SetTTL(ttl); err != nil {
+			return err
+		}
+	}
+	s.sessionTTL = ttl
+	return nil
+}
+
+func (s *Server) GetGroup(name string) (*GroupHost, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.groups[name]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	return h, nil
+}
+
+// names of hosted groups, sorted
+func (s *Server) ListGroups() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Front port of a new group, the store port is the next one.
+
+frontPort - 0 for the lowest pair from GROUP_PORT_BASE that no group has
+and nothing listens on. s.mu is held
+*/
+func (s *Server) groupPorts(frontPort int) (int, error) {
+	if frontPort != 0 {
+		if frontPort < 0 || frontPort > GROUP_PORT_MAX {
+			return 0, fmt.Errorf("port %d out of range", frontPort)
+		}
+		if h := s.groupOnPorts(frontPort); h != nil {
+			return 0, fmt.Errorf("%w: group %s", ErrGroupPorts, h.Name)
+		}
+		return frontPort, nil
+	}
+	for port := GROUP_PORT_BASE; port <= GROUP_PORT_MAX; port += 2 {
+		if s.groupOnPorts(port) == nil && portFree(port) && portFree(port+1) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no free ports", ErrGroupPorts)
+}
+
+// the group with port frontPort or frontPort+1, s.mu is held
+func (s *Server) groupOnPorts(frontPort int) *GroupHost {
+	for _, h := range s.groups {
+		if h.FrontPort <= frontPort+1 && frontPort <= h.StorePort {
+			return h
+		}
+	}
+	return nil
+}
+
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func (s *Server) registryPath() string {
+	return REGISTRY_FILE_PREFIX + s.name + ".json"
+}
+
+// host the groups in the registry, a missing registry has no groups
+func (s *Server) loadRegistry() error {
+	data, err := os.ReadFile(s.registryPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []groupEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("read group registry: %w", err)
+	}
+	for _, e := range entries {
+		h, err := newGroupHost(e.Name, e.FrontPort, e.StorePort, s.name, s.addr, s.sessionTTL)
+		if err != nil {
+			return err
+		}
+		s.groups[e.Name] = h
+	}
+	log.Printf("[Server] Restore %d groups", len(entries))
+	return nil
+}
+
+// write to a temp file first, so a crash does not leave half a registry, s.mu is held
+func (s *Server) saveRegistry() error {
+	entries := make([]groupEntry, 0, len(s.groups))
+	for _, h := range s.groups {
+		entries = append(entries, groupEntry{Name: h.Name, FrontPort: h.FrontPort, StorePort: h.StorePort})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FrontPort < entries[j].FrontPort })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.registryPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.registryPath())
+}
@@ -3,23 +3,31 @@ package server
 import (
 	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/ciiim/cloudborad/internal/fs"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	// key of the *GroupHost of a request in gin.Context
+	GROUP_CONTEXT_KEY = "group"
+)
+
+/*
+Requests under /api/v1/group/:group go to the named group,
+the same requests under /api/v1 go to the default group.
+*/
 func initRoute(s *Server) *gin.Engine {
 	r := gin.Default()
 	apiGroup := r.Group("/api/v1")
 	{
-		apiGroup.GET("/board", s.GetDir)
-		apiGroup.PUT("/board", s.MkDir)
-		apiGroup.PUT("/board/:key", s.NewBoard)
-
-		apiGroup.GET("/cluster", s.GetCluster)
-		apiGroup.PUT("/cluster/:name/:addr", s.JoinCluster)
-		apiGroup.DELETE("/cluster", s.QuitCluster)
+		apiGroup.GET("/groups", s.ListGroupsHandler)
+		apiGroup.PUT("/groups/:name", s.CreateGroupHandler)
+		apiGroup.DELETE("/groups/:name", s.DeleteGroupHandler)
 	}
+	groupRoute(s, r.Group("/api/v1", s.useDefaultGroup))
+	groupRoute(s, r.Group("/api/v1/group/:group", s.useGroup))
 	adminGroup := r.Group("/admin")
 	{
 		adminGroup.GET("/index")
@@ -27,8 +35,131 @@ func initRoute(s *Server) *gin.Engine {
 	return r
 }
 
+func groupRoute(s *Server, apiGroup *gin.RouterGroup) {
+	apiGroup.GET("/board", s.GetDir)
+	apiGroup.PUT("/board", s.MkDir)
+	apiGroup.PUT("/board/:key", s.NewBoard)
+
+	apiGroup.GET("/cluster", s.GetCluster)
+	// addr is the host of the other server, the group has the same ports there
+	apiGroup.PUT("/cluster/:name/:addr", s.JoinCluster)
+	apiGroup.DELETE("/cluster", s.QuitCluster)
+
+	apiGroup.GET("/cluster/decommission", s.GetDecommission)
+	apiGroup.PUT("/cluster/decommission", s.StartDecommission)
+	apiGroup.DELETE("/cluster/decommission", s.CancelDecommission)
+
+	// ?dry_run=true only counts legacy metadata
+	apiGroup.POST("/cluster/metadata/migrate", s.MigrateMetaData)
+
+	// ?dry_run=true only reports blocks to delete
+	apiGroup.POST("/cluster/gc", s.CollectGarbage)
+
+	apiGroup.GET("/metrics", s.GetMetrics)
+
+	apiGroup.POST("/upload", s.CreateUploadSession)
+	apiGroup.GET("/upload/:id", s.GetUploadSession)
+	apiGroup.PUT("/upload/:id/:index", s.PutUploadBlock)
+	apiGroup.POST("/upload/:id", s.FinalizeUploadSession)
+	apiGroup.DELETE("/upload/:id", s.AbortUploadSession)
+	apiGroup.POST("/blocks/check", s.CheckBlocks)
+}
+
+func (s *Server) useDefaultGroup(ctx *gin.Context) {
+	s.useGroupNamed(ctx, s.defaultGroup)
+}
+
+func (s *Server) useGroup(ctx *gin.Context) {
+	s.useGroupNamed(ctx, ctx.Param("group"))
+}
+
+func (s *Server) useGroupNamed(ctx *gin.Context, name string) {
+	h, err := s.GetGroup(name)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.Set(GROUP_CONTEXT_KEY, h)
+	ctx.Next()
+}
+
+// group of the request, set by useGroup
+func host(ctx *gin.Context) *GroupHost {
+	return ctx.MustGet(GROUP_CONTEXT_KEY).(*GroupHost)
+}
+
+/*
+Group API
+*/
+
+func (s *Server) ListGroupsHandler(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"groups":  s.ListGroups(),
+		"default": s.defaultGroup,
+	})
+}
+
+/*
+port - optional, port of the front system, the store system is on the next one,
+the lowest free pair if it is not given
+*/
+func (s *Server) CreateGroupHandler(ctx *gin.Context) {
+	var port int
+	if p := ctx.Query("port"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			ctx.JSON(http.StatusOK, gin.H{
+				"msg":     "port must be a number",
+				"success": false,
+			})
+			return
+		}
+	}
+	h, err := s.CreateGroup(ctx.Param("name"), port)
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":       "success",
+		"success":   true,
+		"frontport": h.FrontPort,
+		"storeport": h.StorePort,
+	})
+}
+
+func (s *Server) DeleteGroupHandler(ctx *gin.Context) {
+	if ctx.Param("name") == s.defaultGroup {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     "can not delete the default group",
+			"success": false,
+		})
+		return
+	}
+	err := s.DeleteGroup(ctx.Param("name"))
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+	})
+}
+
 func (s *Server) GetCluster(ctx *gin.Context) {
-	list := s.Group.FrontSystem.Peer().PList()
+	list := host(ctx).Group.FrontSystem.Peer().PList()
 	dpeerList := make([]fs.DPeerInfo, 0, len(list))
 	for _, peer := range list {
 		dpeerList = append(dpeerList, peer.(fs.DPeerInfo))
@@ -38,11 +169,93 @@ func (s *Server) GetCluster(ctx *gin.Context) {
 		"success":  true,
 		"peernum":  len(list),
 		"peerlist": dpeerList,
+		"stats":    host(ctx).Group.ClusterStats(ctx.Request.Context()),
+	})
+}
+
+func (s *Server) GetMetrics(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"metrics": host(ctx).Group.Metrics(),
 	})
 }
 
 func (s *Server) QuitCluster(ctx *gin.Context) {
-	s.Quit()
+	host(ctx).Quit()
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+	})
+}
+
+func (s *Server) GetDecommission(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":      "success",
+		"success":  true,
+		"progress": host(ctx).Group.DecommissionProgress(),
+	})
+}
+
+func (s *Server) StartDecommission(ctx *gin.Context) {
+	err := host(ctx).Group.Decommission()
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":      "success",
+		"success":  true,
+		"progress": host(ctx).Group.DecommissionProgress(),
+	})
+}
+
+func (s *Server) MigrateMetaData(ctx *gin.Context) {
+	result, err := host(ctx).Group.MigrateMetaData(ctx.Request.Context(), ctx.Query("dry_run") == "true")
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+			"result":  result,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"result":  result,
+	})
+}
+
+func (s *Server) CollectGarbage(ctx *gin.Context) {
+	report, err := host(ctx).Group.CollectGarbage(ctx.Request.Context(), ctx.Query("dry_run") == "true")
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+			"report":  report,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"report":  report,
+	})
+}
+
+func (s *Server) CancelDecommission(ctx *gin.Context) {
+	err := host(ctx).Group.CancelDecommission()
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{
 		"msg":     "success",
 		"success": true,
@@ -50,7 +263,7 @@ func (s *Server) QuitCluster(ctx *gin.Context) {
 }
 
 func (s *Server) JoinCluster(ctx *gin.Context) {
-	err := s.Join(ctx.Param("name"), ctx.Param("addr"))
+	err := host(ctx).Join(ctx.Param("name"), ctx.Param("addr"))
 	if err != nil {
 		ctx.JSON(http.StatusOK, gin.H{
 			"msg":     err.Error(),
@@ -70,7 +283,7 @@ Space API
 */
 
 func (s *Server) NewBoard(ctx *gin.Context) {
-	err := s.Group.NewBorad(ctx.Param("key"))
+	err := host(ctx).Group.NewBorad(ctx.Request.Context(), ctx.Param("key"))
 	if err != nil {
 		ctx.JSON(http.StatusOK, gin.H{
 			"msg":     err.Error(),
@@ -93,7 +306,7 @@ func (s *Server) MkDir(ctx *gin.Context) {
 		base = "."
 	}
 	dirName, _ := ctx.GetQuery("dir")
-	err := s.Group.Mkdir(key, base, dirName)
+	err := host(ctx).Group.Mkdir(ctx.Request.Context(), key, base, dirName)
 	if err != nil {
 		ctx.JSON(http.StatusOK, gin.H{
 			"msg":     err.Error(),
@@ -114,7 +327,7 @@ func (s *Server) GetDir(ctx *gin.Context) {
 		base = "."
 	}
 	dirName, _ := ctx.GetQuery("dir")
-	file, err := s.Group.GetDir(key, base, dirName)
+	file, err := host(ctx).Group.GetDir(ctx.Request.Context(), key, base, dirName)
 	info := file.Stat().SubDir()
 	if err != nil {
 		ctx.JSON(http.StatusOK, gin.H{
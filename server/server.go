@@ -2,14 +2,31 @@ package server
 
 import (
 	"log"
-
-	"github.com/ciiim/cloudborad/internal/fs/peers"
+	"sync"
+	"time"
 
 	"github.com/ciiim/cloudborad/internal/fs"
 )
 
+/*
+Server hosts named groups, requests are routed by group name,
+see initRoute.
+
+Hosted groups are saved in a registry and restored by NewServer.
+*/
 type Server struct {
-	Group *fs.Group
+	name string
+	addr string
+
+	// group of requests without a group name
+	defaultGroup string
+
+	// upload sessions of new groups, see SetSessionTTL
+	sessionTTL time.Duration
+
+	mu      sync.RWMutex
+	groups  map[string]*GroupHost
+	started bool
 }
 
 func StartServer() {
@@ -18,54 +35,68 @@ func StartServer() {
 }
 
 /*
-ffs is the front file system
-
-it must be a tree structure
+New server with the groups in its registry,
+groupName is the default group, it is created if it is not there.
 */
 func NewServer(groupName, serverName, addr string) *Server {
-	ffs := fs.NewDTFS(*fs.NewDPeer("front0_"+serverName+"_"+groupName, addr+":"+fs.FRONT_PORT, 20, nil), "./front0_"+serverName+"_"+groupName)
-	sfs := fs.NewDFS(*fs.NewDPeer("store0_"+serverName+"_"+groupName, addr+":"+fs.FILE_STORE_PORT, 20, nil), "./store0_"+serverName+"_"+groupName, 1024*1024*1024, nil)
-	if ffs == nil || sfs == nil {
-		log.Fatal("New server failed")
-	}
 	server := &Server{
-		Group: fs.NewGroup(groupName, ffs),
+		name:         serverName,
+		addr:         addr,
+		defaultGroup: groupName,
+		sessionTTL:   fs.DEFAULT_SESSION_TTL,
+		groups:       make(map[string]*GroupHost),
+	}
+	if err := server.loadRegistry(); err != nil {
+		log.Fatal("Load group registry failed: ", err)
+	}
+	if _, err := server.GetGroup(groupName); err != nil {
+		if _, err := server.CreateGroup(groupName, 0); err != nil {
+			log.Fatal("New server failed: ", err)
+		}
 	}
-	server.Group.UseFS(sfs)
 	fs.DebugOn()
 	return server
 }
 
 func (s *Server) StartServer() {
 	r := initRoute(s)
-	go s.Group.Serve()
+	s.mu.Lock()
+	s.started = true
+	for _, h := range s.groups {
+		if err := h.Group.Listen(); err != nil {
+			log.Printf("[Server] Group %s can not be served: %s", h.Name, err)
+			continue
+		}
+		h.serve()
+	}
+	s.mu.Unlock()
 	r.Run(":8080")
 }
 
+// the default group
+func (s *Server) Default() *GroupHost {
+	h, _ := s.GetGroup(s.defaultGroup)
+	return h
+}
+
 func (s *Server) Join(peerName, peerAddr string) error {
-	dest := fs.NewDPeerInfo(peerName, peerAddr)
-	err := s.Group.FrontSystem.Peer().PActionTo(peers.P_ACTION_JOIN, dest)
-	if err != nil {
-		return err
-	}
-	for _, fs := range s.Group.StoreSystems {
-		err = fs.Peer().PActionTo(peers.P_ACTION_JOIN, dest)
-		if err != nil {
-			return err
-		}
-	}
-	log.Println("[Server] Join group success")
-	return nil
+	return s.Default().Join(peerName, peerAddr)
 }
 
 func (s *Server) Quit() {
-	s.Group.FrontSystem.Peer().PSync(s.Group.FrontSystem.Peer().Info(), peers.P_ACTION_QUIT)
-	for _, fs := range s.Group.StoreSystems {
-		fs.Peer().PSync(s.Group.FrontSystem.Peer().Info(), peers.P_ACTION_QUIT)
-	}
+	s.Default().Quit()
 }
 
+// close every group, return the last error
 func (s *Server) Close() error {
-	s.Quit()
-	return s.Group.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for name, h := range s.groups {
+		if e := h.Close(); e != nil {
+			err = e
+			log.Printf("[Server] Close group %s error: %s", name, e)
+		}
+	}
+	return err
 }
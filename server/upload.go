@@ -0,0 +1,143 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ciiim/cloudborad/internal/fs"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Upload session API
+
+POST   /upload                create a session, body is createSessionRequest
+GET    /upload/:id            state of the session and its missing blocks
+PUT    /upload/:id/:index     upload block index, body is the block data
+POST   /upload/:id            finalize, the file appears
+DELETE /upload/:id            abort
+
+POST   /blocks/check          which blocks are stored, body is checkBlocksRequest,
+                              stored blocks need not be uploaded
+*/
+
+type createSessionRequest struct {
+	Space    string         `json:"space"`
+	Base     string         `json:"base"`
+	Filename string         `json:"filename"`
+	Hash     string         `json:"hash"`
+	Size     int64          `json:"size"`
+	Blocks   []fs.Fileblock `json:"blocks"`
+}
+
+type checkBlocksRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+func sessionResponse(ctx *gin.Context, session fs.UploadSession, err error) {
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"session": session,
+		"missing": session.Missing(),
+	})
+}
+
+func (s *Server) CreateUploadSession(ctx *gin.Context) {
+	var req createSessionRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		sessionResponse(ctx, fs.UploadSession{}, err)
+		return
+	}
+	if req.Base == "root" || req.Base == "" {
+		req.Base = "."
+	}
+	session, err := host(ctx).Sessions.Create(ctx.Request.Context(), req.Space, req.Base, req.Filename, req.Hash, req.Size, req.Blocks)
+	sessionResponse(ctx, session, err)
+}
+
+func (s *Server) GetUploadSession(ctx *gin.Context) {
+	session, err := host(ctx).Sessions.Get(ctx.Param("id"))
+	sessionResponse(ctx, session, err)
+}
+
+func (s *Server) PutUploadBlock(ctx *gin.Context) {
+	index, err := strconv.Atoi(ctx.Param("index"))
+	if err != nil {
+		sessionResponse(ctx, fs.UploadSession{}, fs.ErrBlockNotInSession)
+		return
+	}
+	// a block is never larger than BLOCK_SIZE, the extra byte finds longer bodies
+	data, err := io.ReadAll(io.LimitReader(ctx.Request.Body, int64(fs.BLOCK_SIZE)+1))
+	if err != nil {
+		sessionResponse(ctx, fs.UploadSession{}, err)
+		return
+	}
+	session, err := host(ctx).Sessions.PutBlock(ctx.Request.Context(), ctx.Param("id"), index, data)
+	sessionResponse(ctx, session, err)
+}
+
+func (s *Server) FinalizeUploadSession(ctx *gin.Context) {
+	err := host(ctx).Sessions.Finalize(ctx.Request.Context(), ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+	})
+}
+
+func (s *Server) AbortUploadSession(ctx *gin.Context) {
+	err := host(ctx).Sessions.Abort(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+	})
+}
+
+func (s *Server) CheckBlocks(ctx *gin.Context) {
+	var req checkBlocksRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusOK, gin.H{
+			"msg":     err.Error(),
+			"success": false,
+		})
+		return
+	}
+	stored := host(ctx).Group.CheckBlocks(ctx.Request.Context(), req.Hashes)
+	exists := make([]string, 0, len(stored))
+	missing := make([]string, 0, len(req.Hashes)-len(stored))
+	for _, hash := range req.Hashes {
+		if stored[hash] {
+			exists = append(exists, hash)
+		} else {
+			missing = append(missing, hash)
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"msg":     "success",
+		"success": true,
+		"exists":  exists,
+		"missing": missing,
+	})
+}